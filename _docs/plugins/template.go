@@ -4,8 +4,33 @@ import (
 	"net"
 )
 
+// APIVersion is the plugin API version this plugin was built against.
+var APIVersion = 2
+
+// Optional metadata reported by the Broker for loaded plugins.
+var (
+	PluginName    = "template"
+	PluginVersion = "1.0.0"
+	RequiredHooks = []string{}
+)
+
 // func Bootstrap() {}
 // func Bootstrap(conf map[interface{}]interface{}) {}
+// func Reconfigure(conf map[interface{}]interface{}) error { return nil }
+
+// Hooks receiving the connection info (requires importing "gott"),
+// each one replaces its counterpart below if exported.
+// func OnSocketOpenInfo(conn net.Conn, info gott.ConnInfo) bool { return true }
+// func OnBeforeConnectInfo(info gott.ConnInfo, password string) bool { return true }
+// func OnConnectInfo(info gott.ConnInfo, password string) bool { return true }
+// func OnMessageInfo(info gott.ConnInfo, topic, payload []byte, dup, qos byte, retain bool) {}
+// func OnBeforePublishInfo(info gott.ConnInfo, topic, payload []byte, dup, qos byte, retain bool) bool { return true }
+// func OnPublishInfo(info gott.ConnInfo, topic, payload []byte, dup, qos byte, retain bool) {}
+// func OnBeforeSubscribeInfo(info gott.ConnInfo, topic []byte, qos byte) bool { return true }
+// func OnSubscribeInfo(info gott.ConnInfo, topic []byte, qos byte) {}
+// func OnBeforeUnsubscribeInfo(info gott.ConnInfo, topic []byte) bool { return true }
+// func OnUnsubscribeInfo(info gott.ConnInfo, topic []byte) {}
+// func OnDisconnectInfo(info gott.ConnInfo, graceful bool) {}
 
 func OnSocketOpen(conn net.Conn) bool {
 	return true
@@ -41,4 +66,6 @@ func OnUnsubscribe(clientID, username string, topic []byte) {}
 
 func OnDisconnect(clientID, username string, graceful bool) {}
 
+func OnSessionExpired(clientID string) {}
+
 func Cleanup() {}
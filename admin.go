@@ -0,0 +1,638 @@
+package gott
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	js "github.com/json-iterator/go"
+	"go.uber.org/zap"
+)
+
+const (
+	adminAPIPrefix      = "/api/"
+	maxAdminPayloadSize = 256 * 1024 * 1024 // maximum PUBLISH remaining length
+	defaultTraceTime    = time.Minute
+	maxTraceTime        = time.Hour
+)
+
+type adminServer struct {
+	config Config
+	mux    *http.ServeMux
+}
+
+func newAdminServer(c Config) *adminServer {
+	as := &adminServer{config: c, mux: http.NewServeMux()}
+	as.mux.HandleFunc(adminAPIPrefix+"clients", as.handleClients)
+	as.mux.HandleFunc(adminAPIPrefix+"clients/", as.handleClient)
+	as.mux.HandleFunc(adminAPIPrefix+"sessions", as.handleSessions)
+	as.mux.HandleFunc(adminAPIPrefix+"sessions/", as.handleSession)
+	as.mux.HandleFunc(adminAPIPrefix+"topics", as.handleTopics)
+	as.mux.HandleFunc(adminAPIPrefix+"retained", as.handleRetained)
+	as.mux.HandleFunc(adminAPIPrefix+"plugins", as.handlePlugins)
+	as.mux.HandleFunc(adminAPIPrefix+"plugins/", as.handlePlugin)
+	as.mux.HandleFunc(adminAPIPrefix+"stats", as.handleStats)
+	as.mux.HandleFunc(adminAPIPrefix+"store", as.handleStore)
+	as.mux.HandleFunc(adminAPIPrefix+"store/verify", as.handleStoreVerify)
+	as.mux.HandleFunc(adminAPIPrefix+"store/repair", as.handleStoreVerify)
+	as.mux.HandleFunc(adminAPIPrefix+"store/gc", as.handleStoreGC)
+	as.mux.HandleFunc(adminAPIPrefix+"backup", as.handleBackup)
+	as.mux.HandleFunc(adminAPIPrefix+"publish", as.handlePublish)
+	as.mux.HandleFunc(adminAPIPrefix+"trace", as.handleTrace)
+	if c.Admin.Dashboard {
+		as.mux.HandleFunc(dashboardPrefix, as.handleDashboard)
+		as.mux.HandleFunc(dashboardPrefix+"config", as.handleDashboardConfig)
+		as.mux.HandleFunc("/", as.handleRoot)
+	}
+	return as
+}
+
+func (as *adminServer) Listen() {
+	err := http.ListenAndServe(as.config.Admin.Listen, as)
+	if err != nil {
+		log.Fatal("ListenAndServe admin: ", err)
+	}
+}
+
+// ListenUnix serves the API on a Unix socket. Access is controlled by the socket's file permissions
+// so requests over it are not authenticated.
+func (as *adminServer) ListenUnix() {
+	_ = os.Remove(as.config.Admin.Socket)
+
+	l, err := net.Listen("unix", as.config.Admin.Socket)
+	if err != nil {
+		log.Fatal("Listen admin socket: ", err)
+	}
+	if err = os.Chmod(as.config.Admin.Socket, 0600); err != nil {
+		log.Fatal("Chmod admin socket: ", err)
+	}
+
+	err = http.Serve(l, as)
+	if err != nil {
+		log.Fatal("Serve admin socket: ", err)
+	}
+}
+
+// ServeHTTP authenticates every request before passing it to the API handlers.
+func (as *adminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, unix := r.Context().Value(http.LocalAddrContextKey).(*net.UnixAddr); !unix && !as.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="gott"`)
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	if !csrfSafe(r) {
+		writeError(w, http.StatusForbidden, "requests authenticated with basic auth that change the broker must set the X-Requested-With header")
+		return
+	}
+	as.mux.ServeHTTP(w, r)
+}
+
+// csrfSafe reports whether a request can't have been forged by another site.
+// Browsers send the basic auth credentials of the dashboard with forms posted to the admin listener by any site,
+// but they only send custom headers cross-site after a CORS preflight, which the admin API never allows.
+// Bearer tokens and the Unix socket can't be used by forms.
+func csrfSafe(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	if _, _, basic := r.BasicAuth(); !basic {
+		return true
+	}
+	return r.Header.Get("X-Requested-With") != ""
+}
+
+func (as *adminServer) authorized(r *http.Request) bool {
+	cnf := as.config.Admin
+
+	if cnf.Token != "" {
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			return secureCompare(strings.TrimPrefix(auth, "Bearer "), cnf.Token)
+		}
+	}
+
+	if username, password, ok := r.BasicAuth(); ok {
+		// browsers can't send bearer tokens, the token is accepted as the basic auth password for the dashboard
+		if cnf.Token != "" && secureCompare(password, cnf.Token) {
+			return true
+		}
+		if cnf.Username != "" {
+			return secureCompare(username, cnf.Username) && secureCompare(password, cnf.Password)
+		}
+	}
+
+	return false
+}
+
+func secureCompare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, err := js.Marshal(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	body, _ := js.Marshal(map[string]string{"error": msg})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+// errorStatus maps the errors returned by the Broker's management methods to HTTP status codes.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrPluginNotLoaded):
+		return http.StatusNotFound
+	case errors.Is(err, ErrPluginLoaded):
+		return http.StatusConflict
+	case errors.Is(err, ErrPluginName):
+		return http.StatusBadRequest
+	}
+
+	switch err {
+	case ErrClientNotFound, ErrSessionNotFound, ErrRetainedNotFound:
+		return http.StatusNotFound
+	case ErrSessionInUse:
+		return http.StatusConflict
+	case ErrInvalidTopicName, ErrInvalidQoS, ErrInvalidTopicFilter, ErrEmptyTrace:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// pathParam returns the escaped remainder of the URL path after prefix.
+// Client IDs may contain slashes so the whole remainder is used.
+func pathParam(r *http.Request, prefix string) string {
+	return strings.TrimPrefix(r.URL.Path, prefix)
+}
+
+// GET /api/clients
+func (as *adminServer) handleClients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	writeJSON(w, http.StatusOK, GOTT.Clients())
+}
+
+// GET, DELETE /api/clients/{id}
+func (as *adminServer) handleClient(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, adminAPIPrefix+"clients/")
+
+	switch r.Method {
+	case http.MethodGet:
+		info, err := GOTT.Client(id)
+		if err != nil {
+			writeError(w, errorStatus(err), err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	case http.MethodDelete:
+		if err := GOTT.DisconnectClient(id); err != nil {
+			writeError(w, errorStatus(err), err.Error())
+			return
+		}
+		GOTT.logger.Info("admin disconnected client", zap.String("id", id))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodDelete)
+	}
+}
+
+// GET /api/sessions
+func (as *adminServer) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	sessions, err := GOTT.Sessions()
+	if err != nil {
+		writeError(w, errorStatus(err), err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+// GET, DELETE /api/sessions/{id}
+func (as *adminServer) handleSession(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, adminAPIPrefix+"sessions/")
+
+	switch r.Method {
+	case http.MethodGet:
+		info, err := GOTT.Session(id)
+		if err != nil {
+			writeError(w, errorStatus(err), err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	case http.MethodDelete:
+		if err := GOTT.DeleteSession(id); err != nil {
+			writeError(w, errorStatus(err), err.Error())
+			return
+		}
+		GOTT.logger.Info("admin deleted session", zap.String("id", id))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodDelete)
+	}
+}
+
+// GET /api/topics?prefix=a/b&client=id
+func (as *adminServer) handleTopics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	if clientID := r.URL.Query().Get("client"); clientID != "" {
+		writeJSON(w, http.StatusOK, GOTT.ClientSubscriptions(clientID))
+		return
+	}
+	writeJSON(w, http.StatusOK, GOTT.TopicTree(r.URL.Query().Get("prefix")))
+}
+
+// GET, PUT, DELETE /api/retained?topic=a/b&qos=1
+// PUT takes the raw payload as the request body.
+func (as *adminServer) handleRetained(w http.ResponseWriter, r *http.Request) {
+	topic := r.URL.Query().Get("topic")
+	if topic == "" {
+		writeError(w, http.StatusBadRequest, "missing topic")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		msg, err := GOTT.RetainedMessage(topic)
+		if err != nil {
+			writeError(w, errorStatus(err), err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, msg)
+	case http.MethodPut:
+		qos, payload, ok := readPublishRequest(w, r)
+		if !ok {
+			return
+		}
+
+		if err := GOTT.SetRetainedMessage(topic, payload, qos); err != nil {
+			writeError(w, errorStatus(err), err.Error())
+			return
+		}
+		GOTT.logger.Info("admin set retained message", zap.String("topic", topic))
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if err := GOTT.ClearRetainedMessage(topic); err != nil {
+			writeError(w, errorStatus(err), err.Error())
+			return
+		}
+		GOTT.logger.Info("admin cleared retained message", zap.String("topic", topic))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodDelete)
+	}
+}
+
+// POST /api/publish?topic=a/b&qos=1&retain=true
+// Takes the raw payload as the request body.
+func (as *adminServer) handlePublish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	topic := r.URL.Query().Get("topic")
+	if topic == "" {
+		writeError(w, http.StatusBadRequest, "missing topic")
+		return
+	}
+
+	qos, payload, ok := readPublishRequest(w, r)
+	if !ok {
+		return
+	}
+	retain := r.URL.Query().Get("retain") == "true"
+
+	if err := GOTT.PublishMessage(topic, payload, qos, retain); err != nil {
+		writeError(w, errorStatus(err), err.Error())
+		return
+	}
+	GOTT.logger.Info("admin published message", zap.String("topic", topic))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readPublishRequest reads the qos query parameter and the payload from the request body.
+// It writes the error response and returns false if either is invalid.
+func readPublishRequest(w http.ResponseWriter, r *http.Request) (byte, []byte, bool) {
+	var qos int
+	if q := r.URL.Query().Get("qos"); q != "" {
+		var err error
+		if qos, err = strconv.Atoi(q); err != nil || qos < 0 || qos > 2 {
+			writeError(w, http.StatusBadRequest, ErrInvalidQoS.Error())
+			return 0, nil, false
+		}
+	}
+
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxAdminPayloadSize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return 0, nil, false
+	}
+	return byte(qos), payload, true
+}
+
+// GET /api/trace?client=id&topic=a/%23&duration=5m
+// Streams the traced packets as JSON lines until the duration elapses or the request is canceled.
+func (as *adminServer) handleTrace(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+
+	duration := defaultTraceTime
+	if d := r.URL.Query().Get("duration"); d != "" {
+		var err error
+		if duration, err = time.ParseDuration(d); err != nil || duration <= 0 || duration > maxTraceTime {
+			writeError(w, http.StatusBadRequest, "invalid duration, must be between 0 and "+maxTraceTime.String())
+			return
+		}
+	}
+
+	clientID, filter := r.URL.Query().Get("client"), r.URL.Query().Get("topic")
+	trace, err := GOTT.StartTrace(clientID, filter)
+	if err != nil {
+		writeError(w, errorStatus(err), err.Error())
+		return
+	}
+	defer func() {
+		GOTT.StopTrace(trace)
+		GOTT.logger.Info("admin trace ended", zap.Int64("dropped", trace.Dropped()))
+	}()
+
+	GOTT.logger.Info("admin started trace", zap.String("client", clientID), zap.String("topic", filter), zap.Duration("duration", duration))
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	for {
+		select {
+		case p := <-trace.Packets():
+			line, err := js.Marshal(p)
+			if err != nil {
+				continue
+			}
+			if _, err = w.Write(append(line, '\n')); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-timer.C:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// GET, POST /api/plugins
+// POST loads a plugin from the plugins directory, it takes {"Name": "file.so", "Config": {...}} as the request body.
+func (as *adminServer) handlePlugins(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, GOTT.Plugins())
+	case http.MethodPost:
+		var req struct {
+			Name   string
+			Config map[string]interface{}
+		}
+		if !readJSONRequest(w, r, &req) {
+			return
+		}
+		if err := GOTT.LoadPlugin(req.Name, pluginConfigMap(req.Config)); err != nil {
+			writeError(w, errorStatus(err), err.Error())
+			return
+		}
+		GOTT.logger.Info("admin loaded plugin", zap.String("name", req.Name))
+		writeJSON(w, http.StatusCreated, GOTT.Plugins())
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+// POST /api/plugins/{name}/enable, POST /api/plugins/{name}/disable, PUT /api/plugins/{name}/config
+// PUT takes the new config map as the request body.
+func (as *adminServer) handlePlugin(w http.ResponseWriter, r *http.Request) {
+	param := pathParam(r, adminAPIPrefix+"plugins/")
+	i := strings.LastIndexByte(param, '/')
+	if i <= 0 {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	name, action := param[:i], param[i+1:]
+
+	var err error
+	switch action {
+	case "enable", "disable":
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, http.MethodPost)
+			return
+		}
+		if action == "enable" {
+			err = GOTT.EnablePlugin(name)
+		} else {
+			err = GOTT.DisablePlugin(name)
+		}
+	case "config":
+		if r.Method != http.MethodPut {
+			writeMethodNotAllowed(w, http.MethodPut)
+			return
+		}
+		var conf map[string]interface{}
+		if !readJSONRequest(w, r, &conf) {
+			return
+		}
+		err = GOTT.ReconfigurePlugin(name, pluginConfigMap(conf))
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	if err != nil {
+		writeError(w, errorStatus(err), err.Error())
+		return
+	}
+	GOTT.logger.Info("admin changed plugin", zap.String("name", name), zap.String("action", action))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminJSON decodes the numbers of request bodies into interface{} values as json.Number rather than float64,
+// see pluginConfigValue.
+var adminJSON = js.Config{EscapeHTML: true, UseNumber: true}.Froze()
+
+// readJSONRequest decodes the JSON request body into v.
+// It writes the error response and returns false if the body is invalid.
+func readJSONRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxAdminPayloadSize))
+	if err == nil {
+		err = adminJSON.Unmarshal(body, v)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+	return true
+}
+
+// pluginConfigMap converts a JSON object to the map type plugins get their config from the config file as.
+func pluginConfigMap(m map[string]interface{}) map[interface{}]interface{} {
+	if m == nil {
+		return nil
+	}
+	conf := make(map[interface{}]interface{}, len(m))
+	for k, v := range m {
+		conf[k] = pluginConfigValue(v)
+	}
+	return conf
+}
+
+// pluginConfigValue converts a JSON value to the type the YAML config file gives: integral numbers are ints,
+// other numbers float64.
+func pluginConfigValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil && int64(int(i)) == i {
+			return int(i)
+		} else if err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		return pluginConfigMap(v)
+	case []interface{}:
+		for i := range v {
+			v[i] = pluginConfigValue(v[i])
+		}
+	}
+	return v
+}
+
+// GET /api/stats
+func (as *adminServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	writeJSON(w, http.StatusOK, GOTT.Stats())
+}
+
+// GET /api/store
+func (as *adminServer) handleStore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	writeJSON(w, http.StatusOK, GOTT.StoreStats())
+}
+
+// GET /api/store/verify, POST /api/store/repair
+func (as *adminServer) handleStoreVerify(w http.ResponseWriter, r *http.Request) {
+	repair := r.URL.Path == adminAPIPrefix+"store/repair"
+	if repair && r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	} else if !repair && r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	report, err := GOTT.VerifyStore(repair)
+	if err != nil {
+		writeError(w, errorStatus(err), err.Error())
+		return
+	}
+	if repair {
+		GOTT.logger.Info("admin repaired session store", zap.Int("deleted", report.Repaired))
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// GET /api/backup?format={binary|json}&plaintext={true|false}
+func (as *adminServer) handleBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	plaintext := r.URL.Query().Get("plaintext") == "true"
+	ext := "snapshot"
+	switch format {
+	case SnapshotBinary, "":
+		w.Header().Set("Content-Type", "application/octet-stream")
+	case SnapshotJSON:
+		if _, encrypted := GOTT.SessionStore.SessionStore.(*encryptedStore); encrypted && !plaintext {
+			writeError(w, http.StatusBadRequest, ErrSnapshotPlaintext.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		ext = "json"
+	default:
+		writeError(w, http.StatusBadRequest, ErrSnapshotFormat.Error())
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"gott-%s.%s\"", time.Now().UTC().Format("20060102T150405Z"), ext))
+
+	// the status is sent with the first bytes, a failure past them can only cut the snapshot short,
+	// which restoring it detects
+	info, err := GOTT.Backup(w, format, plaintext)
+	if err != nil {
+		log.Println("admin backup failed:", err)
+		GOTT.logger.Error("admin backup", zap.Error(err))
+		return
+	}
+	GOTT.logger.Info("admin backup", zap.String("format", info.Format), zap.Int("keys", info.Keys), zap.Bool("sealed", info.Sealed))
+}
+
+// POST /api/store/gc
+func (as *adminServer) handleStoreGC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+	if err := GOTT.MaintainStore(); err != nil {
+		writeError(w, errorStatus(err), err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, GOTT.StoreStats())
+}
@@ -1,72 +1,97 @@
 package gott
 
-import "sync"
+import (
+	"sync"
+	"sync/atomic"
+)
 
+// atomicBool is a bool that is safe to load and store concurrently without locking.
 type atomicBool struct {
-	val   bool
-	mutex sync.Mutex
+	val int32
+}
+
+func newAtomicBool(val bool) atomicBool {
+	var ab atomicBool
+	ab.Store(val)
+	return ab
 }
 
 func (ab *atomicBool) Load() bool {
-	ab.mutex.Lock()
-	defer ab.mutex.Unlock()
-	return ab.val
+	return atomic.LoadInt32(&ab.val) == 1
 }
 
 func (ab *atomicBool) Store(val bool) {
-	ab.mutex.Lock()
-	defer ab.mutex.Unlock()
-	ab.val = val
+	var i int32
+	if val {
+		i = 1
+	}
+	atomic.StoreInt32(&ab.val, i)
 }
 
+// subscriptionList is a copy-on-write list of subscriptions. Writers are serialized and replace
+// the whole slice so readers, like the publish fan-out, never take a lock.
 type subscriptionList struct {
-	subs  []*subscription
+	subs  atomic.Value // []*subscription
 	mutex sync.Mutex
 }
 
-func (s *subscriptionList) delete(index int) {
-	var newSubs []*subscription
-	newSubs = append(newSubs, s.subs[:index]...)
-	if index != len(s.subs)-1 {
-		newSubs = append(newSubs, s.subs[index+1:]...)
-	}
-	s.subs = newSubs
+func (s *subscriptionList) load() []*subscription {
+	subs, _ := s.subs.Load().([]*subscription)
+	return subs
 }
 
 func (s *subscriptionList) Len() int {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-	return len(s.subs)
+	return len(s.load())
 }
 
-func (s *subscriptionList) Add(sub *subscription) {
+// Set adds a subscription or replaces the subscription of the same session.
+func (s *subscriptionList) Set(sub *subscription) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	s.subs = append(s.subs, sub)
-}
 
-func (s *subscriptionList) Delete(index int) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-	s.delete(index)
+	old := s.load()
+	subs := make([]*subscription, len(old), len(old)+1)
+	copy(subs, old)
+
+	for i, existing := range subs {
+		if existing.Session.ID == sub.Session.ID {
+			subs[i] = sub
+			s.subs.Store(subs)
+			return
+		}
+	}
+	s.subs.Store(append(subs, sub))
 }
 
 func (s *subscriptionList) Range(iterator func(i int, sub *subscription) bool) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-	for i, sub := range s.subs {
+	for i, sub := range s.load() {
 		if next := iterator(i, sub); !next {
 			break
 		}
 	}
 }
 
+// RangeDelete iterates over a snapshot of the list, subscriptions passed to delete are removed once the iteration ends.
 func (s *subscriptionList) RangeDelete(iterator func(i int, sub *subscription, delete func(index int)) bool) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	for i, sub := range s.subs {
-		if next := iterator(i, sub, s.delete); !next {
+
+	old := s.load()
+	deleted := make(map[int]bool)
+	for i, sub := range old {
+		if next := iterator(i, sub, func(index int) { deleted[index] = true }); !next {
 			break
 		}
 	}
+	if len(deleted) == 0 {
+		return
+	}
+
+	subs := make([]*subscription, 0, len(old)-len(deleted))
+	for i, sub := range old {
+		if !deleted[i] {
+			subs = append(subs, sub)
+		}
+	}
+	s.subs.Store(subs)
 }
@@ -11,7 +11,6 @@ import (
 	"net"
 	"os"
 	"os/signal"
-	"sort"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -32,25 +31,60 @@ type Broker struct {
 	listener           net.Listener
 	tlsListener        net.Listener
 	wsServer           *webSocketsServer
-	clients            map[string]*Client
-	mutex              sync.RWMutex
+	metricsServer      *metricsServer
+	adminServer        *adminServer
+	traces             traceRegistry
+	clients            *clientRegistry
+	takeovers          *takeoverLimiter
 	config             Config
-	plugins            []gottPlugin
+	plugins            []*gottPlugin
+	enabledPlugins     []*gottPlugin
+	loadingPlugins     map[string]bool // being opened and bootstrapped by LoadPlugin
+	pluginsMutex       sync.RWMutex
 	logger             *zap.Logger
 	TopicFilterStorage *topicStorage
-	MessageStore       *messageStore
+	RetainedStore      *retainedStore
 	SessionStore       *sessionStore
+	startedAt          time.Time
 }
 
 // NewBroker initializes a new object of type Broker. You can either use the returned pointer or the global GOTT var.
 // Returns a pointer of type Broker which is also assigned to the global GOTT var and an error.
-// It creates/opens an on-disk session store.
+// It creates/opens the session store selected in the config.
 func NewBroker() (*Broker, error) {
+	if _, err := newBroker(nil); err != nil {
+		return nil, err
+	}
+	c := GOTT.config
+
+	if c.WebSockets.WSS.Enabled() || c.WebSockets.Listen != "" {
+		GOTT.wsServer = newWebSocketsServer(c)
+	}
+
+	if c.Metrics.Listen != "" {
+		GOTT.metricsServer = newMetricsServer(c)
+	}
+
+	if c.Admin.Enabled() || c.Admin.Socket != "" {
+		GOTT.adminServer = newAdminServer(c)
+	}
+	if c.Admin.Listen != "" && !c.Admin.Enabled() {
+		log.Println("Admin API listener is disabled: no token or username is set")
+	}
+
+	return GOTT, nil
+}
+
+// newBroker initializes the global Broker with its config, logger, session store and plugins without any listeners.
+// configure, if not nil, can override the loaded config before anything is initialized.
+func newBroker(configure func(c *Config)) (*Broker, error) {
 	GOTT = &Broker{
-		clients:            map[string]*Client{},
+		clients:            newClientRegistry(),
+		takeovers:          newTakeoverLimiter(),
 		config:             defaultConfig(),
-		TopicFilterStorage: &topicStorage{},
-		MessageStore:       newMessageStore(),
+		TopicFilterStorage: newTopicStorage(),
+		RetainedStore:      newRetainedStore(),
+		startedAt:          time.Now(),
 	}
 
 	c, err := newConfig()
@@ -59,19 +93,29 @@ func NewBroker() (*Broker, error) {
 		return nil, err
 	}
 
+	if configure != nil {
+		configure(&c)
+	}
+
 	GOTT.config = c
 	GOTT.logger = NewLogger(GOTT.config.Logging)
 
-	ss, err := loadSessionStore()
+	ss, err := loadSessionStore(c.Sessions.Store, GOTT.logger)
 	if err != nil {
 		return nil, err
 	}
 	GOTT.SessionStore = ss
 
-	GOTT.bootstrapPlugins()
+	if err := GOTT.restoreSubscriptions(); err != nil {
+		return nil, err
+	}
 
-	if c.WebSockets.WSS.Enabled() || c.WebSockets.Listen != "" {
-		GOTT.wsServer = newWebSocketsServer(c)
+	if err := GOTT.restoreRetained(); err != nil {
+		return nil, err
+	}
+
+	if err := GOTT.bootstrapPlugins(); err != nil {
+		return nil, err
 	}
 
 	return GOTT, nil
@@ -100,7 +144,7 @@ func (b *Broker) Listen() error {
 				if err != nil {
 					//log.Printf("Couldn't accept connection: %v\n", err)
 				} else {
-					go b.handleConnection(conn)
+					go b.handleConnection(conn, TransportTCP, b.config.Listen)
 				}
 			}
 		}(b)
@@ -113,7 +157,7 @@ func (b *Broker) Listen() error {
 			return fmt.Errorf("couldn't load cert or key file: %v", err)
 		}
 
-		config := tls.Config{Certificates: []tls.Certificate{cert}}
+		config := tls.Config{Certificates: []tls.Certificate{cert}, ClientAuth: clientAuthType(b.config.Tls.ClientAuth)}
 
 		tl, err := tls.Listen("tcp", b.config.Tls.Listen, &config)
 		if err != nil {
@@ -133,7 +177,7 @@ func (b *Broker) Listen() error {
 				if err != nil {
 					log.Printf("Couldn't accept connection: %v\n", err)
 				} else {
-					go b.handleConnection(conn)
+					go b.handleConnection(conn, TransportTLS, b.config.Tls.Listen)
 				}
 			}
 		}(b)
@@ -154,6 +198,35 @@ func (b *Broker) Listen() error {
 		listening = true
 	}
 
+	if b.metricsServer != nil {
+		go b.metricsServer.Listen()
+		log.Println("Started metrics server on " + b.config.Metrics.Listen)
+		b.logger.Info("Started metrics server on " + b.config.Metrics.Listen)
+	}
+
+	if b.adminServer != nil {
+		if b.config.Admin.Enabled() {
+			go b.adminServer.Listen()
+			log.Println("Started admin API on " + b.config.Admin.Listen)
+			b.logger.Info("Started admin API on " + b.config.Admin.Listen)
+		}
+		if b.config.Admin.Socket != "" {
+			go b.adminServer.ListenUnix()
+			log.Println("Started admin API on unix socket " + b.config.Admin.Socket)
+			b.logger.Info("Started admin API on unix socket " + b.config.Admin.Socket)
+		}
+	}
+
+	if b.config.SysInterval > 0 {
+		go b.publishSysTopics(time.Duration(b.config.SysInterval) * time.Second)
+	}
+
+	if b.config.Sessions.Expiry > 0 && b.config.Sessions.SweepInterval > 0 {
+		go b.sweepSessions(time.Duration(b.config.Sessions.Expiry)*time.Second, time.Duration(b.config.Sessions.SweepInterval)*time.Second)
+	}
+
+	go b.maintainSessionStore(time.Duration(b.config.Sessions.Store.GCInterval)*time.Second, time.Duration(b.config.Sessions.Store.CompactInterval)*time.Second)
+
 	if !listening {
 		return errors.New("no listeners started. Non-TLS, TLS and WebSockets listeners are disabled")
 	}
@@ -166,28 +239,10 @@ func (b *Broker) Listen() error {
 	return nil
 }
 
-func (b *Broker) addClient(client *Client) {
-	b.mutex.RLock()
-	if c, ok := b.clients[client.ClientID]; ok {
-		// disconnect existing client
-		log.Println("disconnecting existing client with id:", c.ClientID)
-		c.closeConnection()
-	}
-	b.mutex.RUnlock()
-
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
-	b.clients[client.ClientID] = client
-}
+func (b *Broker) handleConnection(conn net.Conn, transport, listener string) {
+	info := newConnInfo(conn, transport, listener)
 
-func (b *Broker) removeClient(clientID string) {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
-	delete(b.clients, clientID)
-}
-
-func (b *Broker) handleConnection(conn net.Conn) {
-	if !b.invokeOnSocketOpen(conn) {
+	if !b.invokeOnSocketOpen(conn, info) {
 		_ = conn.Close()
 		return
 	}
@@ -196,7 +251,8 @@ func (b *Broker) handleConnection(conn net.Conn) {
 
 	c := &Client{
 		connection: conn,
-		connected:  atomicBool{val: true},
+		connected:  newAtomicBool(true),
+		connInfo:   info,
 	}
 	go c.listen()
 }
@@ -207,39 +263,19 @@ func (b *Broker) Subscribe(client *Client, filter []byte, qos byte) bool {
 		return false
 	}
 
-	segs := gob.Split(filter, topicDelim)
-
-	segsLen := len(segs)
-	if segsLen == 0 {
-		return false
-	}
-
-	topLevel := segs[0]
-	tl := b.TopicFilterStorage.find(topLevel)
-	if tl == nil {
-		tl = &topicLevel{Bytes: topLevel, Subscriptions: &subscriptionList{}}
-		b.TopicFilterStorage.addTopLevel(tl)
+	b.TopicFilterStorage.subscribe(client, filter, qos)
+	if !client.Session.clean {
+		_ = b.SessionStore.setSubscription(client.ClientID, filter, qos)
 	}
 
-	if segsLen == 1 {
-		tl.createOrUpdateSubscription(client, qos)
-	} else {
-		tl.parseChildren(client, segs[1:], qos)
-	}
-
-	if topicNames := b.TopicFilterStorage.reverseMatch(filter); topicNames != nil {
-		sort.SliceStable(topicNames, func(i, j int) bool { // spec REQUIRES topics to be "Ordered" by default
-			return topicNames[i].RetainedMessage.Timestamp.Before(topicNames[j].RetainedMessage.Timestamp)
+	// spec REQUIRES topics to be "Ordered" by default, match sorts them in the order they were received
+	for _, msg := range b.RetainedStore.match(filter) {
+		b.PublishRetained(msg, &subscription{
+			Session: client.Session,
+			QoS:     qos,
 		})
 
-		for _, topic := range topicNames {
-			b.PublishRetained(topic.RetainedMessage, &subscription{
-				Session: client.Session,
-				QoS:     qos,
-			})
-
-			GOTT.invokeOnPublish(client.ClientID, client.Username, topic.RetainedMessage.Topic, topic.RetainedMessage.Payload, 0, topic.RetainedMessage.QoS, true)
-		}
+		GOTT.invokeOnPublish(client.ConnInfo(), msg.Topic, msg.Payload, 0, msg.QoS, true)
 	}
 
 	return true
@@ -251,61 +287,106 @@ func (b *Broker) Unsubscribe(client *Client, filter []byte) bool {
 		return false
 	}
 
-	segs := gob.Split(filter, topicDelim)
-
-	segsLen := len(segs)
-	if segsLen == 0 {
+	if !b.TopicFilterStorage.unsubscribe(client, filter) {
 		return false
 	}
-
-	if tl := b.TopicFilterStorage.find(segs[0]); tl != nil {
-		if segsLen == 1 {
-			return tl.DeleteSubscription(client, true)
-		}
-
-		return tl.traverseDelete(client, segs[1:])
+	if !client.Session.clean {
+		_ = b.SessionStore.deleteSubscription(client.ClientID, filter)
 	}
-
-	return false
+	return true
 }
 
 // UnsubscribeAll is used to remove all subscriptions of a client.
 // Currently used when the Client disconnects.
 func (b *Broker) UnsubscribeAll(client *Client) {
-	b.TopicFilterStorage.mutex.Lock()
-	defer b.TopicFilterStorage.mutex.Unlock()
-	for _, tl := range b.TopicFilterStorage.Filters {
-		tl.DeleteSubscription(client, client.gracefulDisconnect)
-		tl.traverseDeleteAll(client)
+	b.TopicFilterStorage.unsubscribeAll(client)
+
+	// the subscriptions of persistent sessions are only kept on non graceful disconnections,
+	// unless a new client took the session over
+	if !client.Session.clean && client.gracefulDisconnect && b.getClient(client.ClientID) == nil {
+		_ = b.SessionStore.deleteSubscriptions(client.ClientID)
 	}
 }
 
-// Retain stores a msg in a specific topic as a retained message.
+// restoreSubscriptions adds the saved subscriptions of persistent sessions back to the Topic Tree
+// so messages published before their clients reconnect are queued.
+func (b *Broker) restoreSubscriptions() error {
+	sessions := map[string]*session{}
+	failed := map[string]bool{}
+	restored := 0
+	err := b.SessionStore.forEachSubscription(func(id string, filter []byte, qos byte) {
+		s := sessions[id]
+		if s == nil {
+			if failed[id] {
+				return
+			}
+			s = newStoredSession(id)
+			if err := b.SessionStore.get(id, s); err == errCorruptSessionRecord {
+				failed[id] = true
+				b.SessionStore.flagCorrupt(id, err)
+				return
+			} else if err != nil {
+				failed[id] = true
+				log.Println("error loading the session of a saved subscription:", id, err)
+				b.logger.Error("restore subscriptions", zap.String("id", id), zap.Error(err))
+				return
+			}
+			sessions[id] = s
+		}
+
+		b.TopicFilterStorage.subscribeSession(s, filter, qos)
+		restored++
+	})
+	if restored > 0 {
+		log.Printf("restored %d subscriptions of %d persistent sessions", restored, len(sessions))
+	}
+	return err
+}
+
+// Retain stores a msg in a specific topic as a retained message and saves it to the session store.
+// $SYS topics describe the running broker and aren't saved.
 func (b *Broker) Retain(msg *message, topic []byte) {
-	if msg != nil && !validTopicName(msg.Topic) {
+	if msg != nil && !validTopicName(msg.Topic) || !validTopicName(topic) {
 		return
 	}
 
-	segs := gob.Split(topic, topicDelim)
-
-	segsLen := len(segs)
-	if segsLen == 0 {
+	b.RetainedStore.set(topic, msg)
+	if gob.HasPrefix(topic, sysTopicPrefix) {
 		return
 	}
 
-	topLevel := segs[0]
-	tl := b.TopicFilterStorage.find(topLevel)
-	if tl == nil {
-		tl = &topicLevel{Bytes: topLevel, Subscriptions: &subscriptionList{}}
-		b.TopicFilterStorage.addTopLevel(tl)
+	var err error
+	if msg == nil {
+		err = b.SessionStore.Delete(retainedKey(topic))
+	} else {
+		err = b.SessionStore.Set(retainedKey(topic), encodeRetainedMessage(msg))
 	}
-
-	if segsLen == 1 && !gob.Equal(tl.Bytes, topicSingleLevelWildcard) {
-		tl.retain(msg)
-		return
+	if err != nil {
+		log.Println("error saving retained message:", err)
+		b.logger.Error("retain", zap.ByteString("topic", topic), zap.Error(err))
 	}
+}
 
-	tl.parseChildrenRetain(msg, segs[1:])
+// restoreRetained loads the retained messages saved in the session store.
+func (b *Broker) restoreRetained() error {
+	restored := 0
+	err := b.SessionStore.Iterate(sessionKindPrefix(sessionKeyRetained), func(key string, val []byte) error {
+		_, topic, _, _ := parseSessionKey(key)
+		msg, err := decodeRetainedMessage(topic, val)
+		if err != nil || !validTopicName(msg.Topic) {
+			log.Println("error loading retained message:", topic, err)
+			b.logger.Error("restore retained", zap.String("topic", topic), zap.Error(err))
+			return nil
+		}
+
+		b.RetainedStore.set(msg.Topic, msg)
+		restored++
+		return nil
+	})
+	if restored > 0 {
+		log.Printf("restored %d retained messages", restored)
+	}
+	return err
 }
 
 // Publish sends out a payload to all clients with subscriptions on a provided topic given the passed publish flags.
@@ -318,6 +399,8 @@ func (b *Broker) Publish(topic, payload []byte, flags publishFlags) bool {
 	matches := b.TopicFilterStorage.match(topic)
 	//log.Println(string(topic), "matches", matches)
 
+	atomic.AddInt64(&metrics.publishes, 1)
+
 	if flags.Retain {
 		if len(payload) != 0 {
 			b.Retain(&message{
@@ -331,34 +414,45 @@ func (b *Broker) Publish(topic, payload []byte, flags publishFlags) bool {
 		}
 	}
 
+	fanout := &publishFanout{topic: topic, payload: payload}
+
 	for _, match := range matches {
 		match.Subscriptions.Range(func(i int, sub *subscription) bool {
 			qos := byte(math.Min(float64(sub.QoS), float64(flags.QoS)))
-			// dup is zero according to [MQTT-3.3.1.-1] and [MQTT-3.3.1-3]
-			packet, packetID := makePublishPacket(topic, payload, 0, qos, 0)
-
-			var msg *clientMessage
-
-			if qos != 0 {
-				msg = &clientMessage{
-					Topic:   topic,
-					Payload: payload,
-					QoS:     qos,
-					Retain:  0,
-					client:  sub.Session.client,
-					Status:  StatusUnacknowledged,
+
+			client := sub.Session.client
+			connected := client != nil && client.connected.Load()
+			if connected && !sub.Session.clean {
+				// held back until the client was sent the messages queued before it connected
+				if held, ok := sub.Session.hold(topic, payload, qos); held {
+					if ok {
+						atomic.AddInt64(&metrics.publishDeliveries, 1)
+					}
+					return true
 				}
 			}
 
-			if sub.Session.client != nil && sub.Session.client.connected.Load() {
-				sub.Session.client.emit(packet)
+			if connected {
+				var packetID uint16
+				var msg *clientMessage
 				if qos != 0 {
-					b.MessageStore.store(packetID, msg)
-					go Retry(packetID, msg)
+					packetID = sub.Session.nextPacketID()
+					msg = &clientMessage{
+						Topic:   topic,
+						Payload: payload,
+						QoS:     qos,
+						Retain:  0,
+						client:  client,
+						Status:  StatusUnacknowledged,
+					}
+					sub.Session.track(packetID, msg)
 				}
-			} else if !sub.Session.clean {
-				if qos != 0 {
-					sub.Session.storeMessage(packetID, msg)
+
+				client.emit(fanout.packet(qos, packetID)...)
+				atomic.AddInt64(&metrics.publishDeliveries, 1)
+			} else if !sub.Session.clean && (qos != 0 || b.config.Sessions.Queue.QoS0) {
+				if sub.Session.enqueue(topic, payload, qos) {
+					atomic.AddInt64(&metrics.publishDeliveries, 1)
 				}
 			}
 			return true
@@ -376,7 +470,11 @@ func (b *Broker) PublishRetained(msg *message, sub *subscription) {
 
 	if sub.Session.client != nil && sub.Session.client.connected.Load() {
 		qosOut := byte(math.Min(float64(sub.QoS), float64(msg.QoS)))
-		packet, packetID := makePublishPacket(msg.Topic, msg.Payload, 0, qosOut, 1)
+		var packetID uint16
+		if qosOut != 0 {
+			packetID = sub.Session.nextPacketID()
+		}
+		packet := makePublishPacketWithID(packetID, msg.Topic, msg.Payload, 0, qosOut, 1)
 		if qosOut != 0 {
 			msg := &clientMessage{
 				Topic:   msg.Topic,
@@ -386,9 +484,7 @@ func (b *Broker) PublishRetained(msg *message, sub *subscription) {
 				client:  sub.Session.client,
 				Status:  StatusUnacknowledged,
 			}
-			b.MessageStore.store(packetID, msg)
-
-			go Retry(packetID, msg)
+			sub.Session.track(packetID, msg)
 		}
 		sub.Session.client.emit(packet)
 	}
@@ -401,7 +497,6 @@ func (b *Broker) PublishToClient(client *Client, packetID uint16, cm *clientMess
 		if cm.QoS != 0 {
 			cm.client = client
 			cm.Retain = 0
-			b.MessageStore.store(packetID, cm)
 
 			if cm.Status == StatusUnacknowledged {
 				client.emit(packet)
@@ -412,6 +507,26 @@ func (b *Broker) PublishToClient(client *Client, packetID uint16, cm *clientMess
 	}
 }
 
+// resume resends an inflight message of a persistent session to its reconnected client as per [MQTT-4.4.0-1]:
+// PUBLISH packets that weren't acknowledged with the DUP flag set, PUBREL packets for the ones that were received.
+func (b *Broker) resume(client *Client, packetID uint16, cm *clientMessage) {
+	if !client.connected.Load() {
+		return
+	}
+	cm.client = client
+
+	switch atomic.LoadInt32(&cm.Status) {
+	case StatusUnacknowledged:
+		client.emit(makePublishPacketWithID(packetID, cm.Topic, cm.Payload, 1, cm.QoS, cm.Retain))
+	case StatusPubrecReceived:
+		packetIDBytes := make([]byte, 2)
+		binary.BigEndian.PutUint16(packetIDBytes, packetID)
+		client.emit(makePubRelPacket(packetIDBytes))
+	}
+
+	go Retry(packetID, cm)
+}
+
 // Retry will check for a msg's status and resend it if it hasn't been acknowledged within 20 seconds.
 func Retry(packetID uint16, msg *clientMessage) {
 	defer Recover(nil)
@@ -429,6 +544,7 @@ func Retry(packetID uint16, msg *clientMessage) {
 		time.Sleep(time.Second * 15)
 
 		if msg.client.connected.Load() {
+			atomic.AddInt64(&metrics.retries, 1)
 			switch msg.Status {
 			case StatusUnacknowledged:
 				msg.client.emit(makePublishPacketWithID(packetID, msg.Topic, msg.Payload, 1, msg.QoS, msg.Retain))
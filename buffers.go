@@ -0,0 +1,31 @@
+package gott
+
+import "sync"
+
+// maxPooledBufferSize is the capacity of the largest buffer kept by bufferPool, bigger packets are rare
+// and their buffers are left to the GC.
+const maxPooledBufferSize = 64 * 1024
+
+// bufferPool holds the buffers packets are read into when their contents aren't kept after being handled.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new([]byte)
+	},
+}
+
+// getBuffer returns a pooled buffer of length n, it must be handed back with putBuffer once it's no longer used.
+func getBuffer(n int) *[]byte {
+	buf := bufferPool.Get().(*[]byte)
+	if cap(*buf) < n {
+		*buf = make([]byte, n)
+	}
+	*buf = (*buf)[:n]
+	return buf
+}
+
+func putBuffer(buf *[]byte) {
+	if cap(*buf) > maxPooledBufferSize {
+		return
+	}
+	bufferPool.Put(buf)
+}
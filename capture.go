@@ -0,0 +1,225 @@
+package gott
+
+import (
+	"bufio"
+	gob "bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	js "github.com/json-iterator/go"
+	"go.uber.org/zap"
+)
+
+// Capture file formats.
+const (
+	CaptureFormatBinary = "binary"
+	CaptureFormatJSONL  = "jsonl"
+)
+
+// Directions of a captured frame.
+const (
+	CaptureInbound  = "in"
+	CaptureOutbound = "out"
+)
+
+const (
+	captureVersion     = 1
+	maxCaptureLineSize = 2 * maxAdminPayloadSize // fits a base64 encoded maximum size frame
+)
+
+var (
+	captureMagic          = []byte("GCAP")
+	errInvalidCaptureFile = errors.New("invalid capture file")
+)
+
+// CaptureRecord is a raw MQTT frame sent or received on a captured connection.
+//
+// In the binary format a capture file starts with the "GCAP" magic and a version byte followed by the records,
+// each encoded as a direction byte (0 inbound, 1 outbound), the time as big endian int64 unix nanoseconds,
+// the frame length as big endian uint32 and the frame.
+// In the jsonl format every line is a CaptureRecord with the frame base64 encoded.
+type CaptureRecord struct {
+	Time      time.Time
+	Direction string // CaptureInbound or CaptureOutbound
+	Frame     []byte
+}
+
+// packetCapture writes the frames of a single connection to a capture file.
+type packetCapture struct {
+	mutex  sync.Mutex
+	file   *os.File
+	w      *bufio.Writer
+	format string
+}
+
+func newPacketCapture(dir, format string, info ConnInfo) (*packetCapture, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	ext := "gcap"
+	if format == CaptureFormatJSONL {
+		ext = "jsonl"
+	}
+	remote := "unknown"
+	if info.RemoteAddr != nil {
+		remote = strings.NewReplacer(":", "_", "/", "_", "[", "", "]", "").Replace(info.RemoteAddr.String())
+	}
+	name := fmt.Sprintf("%s-%s-%s.%s", time.Now().Format("20060102T150405.000000000"), info.Transport, remote, ext)
+
+	file, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	pc := &packetCapture{file: file, w: bufio.NewWriter(file), format: format}
+	if format != CaptureFormatJSONL {
+		_, _ = pc.w.Write(captureMagic)
+		_ = pc.w.WriteByte(captureVersion)
+	}
+	return pc, nil
+}
+
+// write appends a frame made of parts to the capture. Writes after close are ignored.
+func (pc *packetCapture) write(direction string, parts ...[]byte) {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	if pc.w == nil {
+		return
+	}
+
+	now := time.Now()
+	var err error
+
+	if pc.format == CaptureFormatJSONL {
+		var line []byte
+		line, err = js.Marshal(CaptureRecord{Time: now, Direction: direction, Frame: gob.Join(parts, nil)})
+		if err == nil {
+			_, err = pc.w.Write(append(line, '\n'))
+		}
+	} else {
+		size := 0
+		for _, p := range parts {
+			size += len(p)
+		}
+
+		header := make([]byte, 13)
+		if direction == CaptureOutbound {
+			header[0] = 1
+		}
+		binary.BigEndian.PutUint64(header[1:], uint64(now.UnixNano()))
+		binary.BigEndian.PutUint32(header[9:], uint32(size))
+
+		_, err = pc.w.Write(header)
+		for _, p := range parts {
+			if err == nil {
+				_, err = pc.w.Write(p)
+			}
+		}
+	}
+
+	if err != nil {
+		log.Println("error writing capture", err)
+	}
+}
+
+func (pc *packetCapture) close() {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	if pc.w == nil {
+		return
+	}
+	if err := pc.w.Flush(); err != nil {
+		log.Println("error writing capture", err)
+	}
+	_ = pc.file.Close()
+	pc.w = nil
+}
+
+func (c *Client) startCapture() {
+	cnf := GOTT.config.Capture
+	pc, err := newPacketCapture(cnf.Dir, cnf.Format, c.connInfo)
+	if err != nil {
+		log.Println("error creating capture file", err)
+		GOTT.logger.Error("error creating capture file", zap.Error(err))
+		return
+	}
+	c.capture = pc
+}
+
+// ReadCapture reads all the records of a capture file in either format.
+func ReadCapture(r io.Reader) ([]CaptureRecord, error) {
+	br := bufio.NewReader(r)
+
+	magic, err := br.Peek(len(captureMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !gob.Equal(magic, captureMagic) {
+		return readJSONLCapture(br)
+	}
+
+	if _, err = br.Discard(len(captureMagic)); err != nil {
+		return nil, err
+	}
+	if version, err := br.ReadByte(); err != nil || version != captureVersion {
+		return nil, errInvalidCaptureFile
+	}
+
+	var records []CaptureRecord
+	header := make([]byte, 13)
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			if err == io.EOF {
+				return records, nil
+			}
+			return records, errInvalidCaptureFile
+		}
+
+		rec := CaptureRecord{
+			Time:      time.Unix(0, int64(binary.BigEndian.Uint64(header[1:]))),
+			Direction: CaptureInbound,
+			Frame:     make([]byte, binary.BigEndian.Uint32(header[9:])),
+		}
+		if header[0] == 1 {
+			rec.Direction = CaptureOutbound
+		}
+		if _, err := io.ReadFull(br, rec.Frame); err != nil {
+			return records, errInvalidCaptureFile
+		}
+		records = append(records, rec)
+	}
+}
+
+func readJSONLCapture(r io.Reader) ([]CaptureRecord, error) {
+	var records []CaptureRecord
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxCaptureLineSize)
+	for scanner.Scan() {
+		line := gob.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var rec CaptureRecord
+		if err := js.Unmarshal(line, &rec); err != nil {
+			return records, errInvalidCaptureFile
+		}
+		if rec.Direction != CaptureInbound && rec.Direction != CaptureOutbound {
+			return records, errInvalidCaptureFile
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
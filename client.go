@@ -11,6 +11,7 @@ import (
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -31,8 +32,17 @@ type Client struct {
 	lastPacketReceivedOn time.Time
 	gracefulDisconnect   bool
 	reader               *bufio.Reader
+	pending              []byte // body of the current packet when read ahead for tracing or capture
+	pendingBuf           *[]byte
+	fixedHeader          [5]byte                   // first byte and remaining length of the packet being read
+	scratch              [ConnectVarHeaderLen]byte // fixed size parts of the packet being read, like packet identifiers
+	capture              *packetCapture
 	wsReader             io.Reader
-	wsMutex              sync.Mutex
+	writeMutex           sync.Mutex // serializes the packets written to the connection
+	connInfo             ConnInfo
+	connectedAt          time.Time
+	disconnectReason     string
+	mutex                sync.Mutex
 	ClientID             string
 	WillMessage          *message
 	Username, Password   string
@@ -47,6 +57,9 @@ func (c *Client) isWebSocket() bool {
 // read will read len(p) bytes from the Client's socket.
 // Web Sockets have a different implementation because it shouldn't assume that the frames are aligned.
 func (c *Client) read(p []byte) (int, error) {
+	if c.pending != nil {
+		return c.readPending(p), nil
+	}
 	if c.isWebSocket() {
 		var n int
 		var err error
@@ -71,8 +84,8 @@ func (c *Client) read(p []byte) (int, error) {
 }
 
 func (c *Client) readByte() (byte, error) {
-	if c.isWebSocket() {
-		b := make([]byte, 1)
+	if c.pending != nil || c.isWebSocket() {
+		b := c.scratch[:1]
 		n, err := c.read(b)
 		if n == 0 {
 			return 0, io.EOF
@@ -83,6 +96,14 @@ func (c *Client) readByte() (byte, error) {
 }
 
 func (c *Client) readFull(p []byte) (int, error) {
+	if c.pending != nil {
+		n := c.readPending(p)
+		if n < len(p) {
+			m, err := c.readFull(p[n:])
+			return n + m, err
+		}
+		return n, nil
+	}
 	if c.isWebSocket() {
 		return c.read(p)
 	}
@@ -117,44 +138,57 @@ func (c *Client) listen() {
 		c.reader = bufio.NewReader(c.connection)
 	}
 
+	if GOTT.config.Capture.Enabled {
+		c.startCapture()
+	}
+
 loop:
 	for {
 		if !c.connected.Load() {
 			break
 		}
 
+		if c.keepAliveSecs > 0 {
+			// disconnect if no packet is received within 1.5 times the keep alive as per [MQTT-3.1.2-24]
+			c.setReadDeadline(time.Now().Add(time.Duration(c.keepAliveSecs) * time.Second * 3 / 2))
+		}
+
 		if c.isWebSocket() {
 			err := c.wsNextReader()
 			if err != nil {
+				c.setDisconnectReason(readErrorReason(err))
 				break
 			}
 		}
 
-		fixedHeader := make([]byte, 2)
+		fixedHeader := c.fixedHeader[:2]
 
 		_, err := c.read(fixedHeader)
 		if err != nil {
 			if err != io.EOF {
 				log.Println("fixedHeader read error", err)
 			}
+			c.setDisconnectReason(readErrorReason(err))
 			break
 		}
 
-		lastByte := fixedHeader[1]
-		remLenEncoded := []byte{lastByte}
-
-		for lastByte >= 128 {
-			lastByte, err = c.readByte()
+		for fixedHeader[len(fixedHeader)-1] >= 128 {
+			if len(fixedHeader) == len(c.fixedHeader) {
+				log.Println("malformed packet: remaining length is longer than 4 bytes")
+				GOTT.logger.Error("malformed", zap.String("reason", "rem len parsing"))
+				break loop
+			}
+			lastByte, err := c.readByte()
 			if err != nil {
 				//log.Println("read error", err)
 				GOTT.logger.Error("malformed", zap.String("reason", "rem len parsing"), zap.Error(err))
 				break loop
 			}
-			remLenEncoded = append(remLenEncoded, lastByte)
+			fixedHeader = append(fixedHeader, lastByte)
 		}
 
 		packetType, flagsBits := parseFixedHeaderFirstByte(fixedHeader[0])
-		remLen, err := bytes.Decode(remLenEncoded)
+		remLen, err := bytes.Decode(fixedHeader[1:])
 		if err != nil {
 			log.Println("malformed packet", err)
 			GOTT.logger.Error("malformed", zap.String("reason", "rem len decoding"))
@@ -163,6 +197,16 @@ loop:
 
 		c.lastPacketReceivedOn = time.Now()
 
+		metrics.packetReceived(packetType, len(fixedHeader)+remLen)
+
+		if GOTT.traces.isActive() || c.capture != nil {
+			if err = c.readAhead(fixedHeader, remLen); err != nil {
+				log.Println("error reading packet", err)
+				c.setDisconnectReason(readErrorReason(err))
+				break loop
+			}
+		}
+
 		if c.ClientID == "" {
 			switch packetType {
 			case TypePublish, TypePubAck, TypePubRec, TypePubRel, TypePubComp, TypeSubscribe, TypeUnsubscribe, TypePingReq, TypeDisconnect:
@@ -180,7 +224,7 @@ loop:
 				break loop
 			}
 
-			varHeader := make([]byte, ConnectVarHeaderLen)
+			varHeader := c.scratch[:ConnectVarHeaderLen]
 			if _, err = c.readFull(varHeader); err != nil {
 				log.Println("error reading var header", err)
 				GOTT.logger.Error("malformed", zap.String("reason", "connect error: reading var header"),
@@ -219,6 +263,10 @@ loop:
 
 			c.keepAliveSecs = int(binary.BigEndian.Uint16(varHeader[8:]))
 
+			c.connInfo.ProtocolVersion = varHeader[6]
+			c.connInfo.KeepAlive = c.keepAliveSecs
+			c.connInfo.CleanSession = connFlags.CleanSession
+
 			// payload parsing
 			payload := make([]byte, payloadLen)
 			if _, err = c.readFull(payload); err != nil {
@@ -330,7 +378,14 @@ loop:
 			}
 
 			// Invoke OnBeforeConnect handlers of all plugins before initializing sessions
-			if !GOTT.invokeOnBeforeConnect(c.ClientID, c.Username, c.Password) {
+			if !GOTT.invokeOnBeforeConnect(c.ConnInfo(), c.Password) {
+				c.setDisconnectReason(DisconnectRejected)
+				break loop
+			}
+
+			// the takeover policy is applied before touching the session, a rejected client must not clear it
+			if code := GOTT.addClient(c); code != ConnectAccepted {
+				c.emit(makeConnAckPacket(0, code))
 				break loop
 			}
 
@@ -342,9 +397,24 @@ loop:
 				_ = GOTT.SessionStore.delete(c.ClientID) // as per [MQTT-3.1.2-6]
 			} else if GOTT.SessionStore.exists(c.ClientID) {
 				sessionPresent = 1
-				if err := c.Session.load(); err != nil {
+				err := c.Session.load()
+				if err == errCorruptSessionRecord {
+					// keep the records that can still be decoded
+					GOTT.SessionStore.flagCorrupt(c.ClientID, err)
+					if _, err = GOTT.SessionStore.repairSession(c.ClientID); err == nil {
+						c.Session = newSession(c, false)
+						err = c.Session.load()
+					}
+				}
+				if err != nil {
 					// try to delete stored session in case it was malformed
 					_ = GOTT.SessionStore.delete(c.ClientID)
+				} else {
+					GOTT.TopicFilterStorage.reattach(c.Session)
+					if !c.Session.DisconnectedAt.IsZero() {
+						c.Session.DisconnectedAt = time.Time{}
+						_ = c.Session.put()
+					}
 				}
 
 				//log.Printf("session for id: %s, session: %#v", c.ClientID, c.Session)
@@ -357,16 +427,19 @@ loop:
 				}
 			}
 
-			// TODO: implement keep alive check and disconnect on timeout of (1.5 * keepalive) as per spec [3.1.2.10]
-
 			// connection succeeded
 			log.Println("client connected with id:", c.ClientID)
-			GOTT.addClient(c)
+			atomic.AddInt64(&metrics.connects, 1)
+			c.Session.MessageStore.attach(&metrics.inflight)
 			c.emit(makeConnAckPacket(sessionPresent, ConnectAccepted))
+			c.connectedAt = time.Now()
 
 			c.Session.replay() //
 
-			if !GOTT.invokeOnConnect(c.ClientID, c.Username, c.Password) {
+			GOTT.publishClientConnected(c)
+
+			if !GOTT.invokeOnConnect(c.ConnInfo(), c.Password) {
+				c.setDisconnectReason(DisconnectRejected)
 				break loop
 			}
 
@@ -423,36 +496,23 @@ loop:
 
 			payload := remBytes[varHeaderEnd:]
 
-			if publishFlags.QoS == 1 {
-				// return a PUBACK
-				c.emit(makePubAckPacket(packetIDBytes))
-			} else if publishFlags.QoS == 2 {
-				// return a PUBREC
-				if publishFlags.DUP == 1 {
-					if msg := c.Session.MessageStore.get(packetID); msg != nil {
-						c.emit(makePubRecPacket(packetIDBytes))
-						break // skip resending message
-					}
+			// a QoS 2 message is stored with its packet identifier, persisted for persistent sessions, and only
+			// published once its PUBREL is received, so a message received again before its PUBREL, or after
+			// a crash of the broker, is acknowledged without being published twice
+			if publishFlags.QoS == 2 {
+				if !c.Session.received(packetID) {
+					c.Session.receive(packetID, topic, payload, publishFlags.Retain)
 				}
-				c.Session.MessageStore.store(packetID, &clientMessage{
-					Topic:   topic,
-					Payload: payload,
-					QoS:     publishFlags.QoS,
-					Status:  StatusPubrecReceived,
-				})
 				c.emit(makePubRecPacket(packetIDBytes))
-			}
-
-			GOTT.invokeOnMessage(c.ClientID, c.Username, topic, payload, publishFlags.DUP, publishFlags.QoS, publishFlags.Retain)
-
-			if !GOTT.invokeOnBeforePublish(c.ClientID, c.Username, topic, payload, publishFlags.DUP, publishFlags.QoS, publishFlags.Retain) {
 				break
 			}
 
-			if GOTT.Publish(topic, payload, publishFlags) {
-				GOTT.invokeOnPublish(c.ClientID, c.Username, topic, payload, publishFlags.DUP, publishFlags.QoS, false)
+			c.publish(topic, payload, publishFlags)
 
-				GOTT.logger.Info("publish", zap.ByteString("topic", topic), zap.ByteString("payload", payload), zap.Int("qos", int(publishFlags.QoS)))
+			// the message is acknowledged once it's published, a crash in between makes the client send it
+			// again rather than lose it
+			if publishFlags.QoS == 1 {
+				c.emit(makePubAckPacket(packetIDBytes))
 			}
 		case TypePubAck:
 			if remLen != 2 {
@@ -461,21 +521,16 @@ loop:
 				break loop
 			}
 
-			remBytes := make([]byte, remLen)
-			if _, err := c.readFull(remBytes); err != nil {
+			packetIDBytes := c.scratch[:2]
+			if _, err := c.readFull(packetIDBytes); err != nil {
 				log.Println("error reading PUBACK packet", err)
 				GOTT.logger.Error("malformed", zap.String("reason", "reading PUBACK packet"),
 					zap.Error(err))
 				break loop
 			}
 
-			var packetID uint16
-			var packetIDBytes []byte
-
-			packetIDBytes = remBytes
-			packetID = binary.BigEndian.Uint16(packetIDBytes)
+			packetID := binary.BigEndian.Uint16(packetIDBytes)
 
-			GOTT.MessageStore.acknowledge(packetID, StatusPubackReceived, true)
 			c.Session.acknowledge(packetID, StatusPubackReceived, true)
 
 			GOTT.logger.Debug("PUBACK", zap.Uint16("packetID", packetID))
@@ -486,33 +541,28 @@ loop:
 				break loop
 			}
 
-			remBytes := make([]byte, remLen)
-			if _, err := c.readFull(remBytes); err != nil {
+			packetIDBytes := c.scratch[:2]
+			if _, err := c.readFull(packetIDBytes); err != nil {
 				log.Println("error reading PUBREC packet", err)
 				GOTT.logger.Error("malformed", zap.String("reason", "reading PUBREC packet"),
 					zap.Error(err))
 				break loop
 			}
 
-			var packetID uint16
-			var packetIDBytes []byte
-
-			packetIDBytes = remBytes
-			packetID = binary.BigEndian.Uint16(packetIDBytes)
+			packetID := binary.BigEndian.Uint16(packetIDBytes)
 
-			GOTT.MessageStore.acknowledge(packetID, StatusPubrecReceived, false)
 			c.Session.acknowledge(packetID, StatusPubrecReceived, false)
 			c.emit(makePubRelPacket(packetIDBytes))
 
 			GOTT.logger.Debug("PUBREC", zap.Uint16("packetID", packetID))
 		case TypePubRel:
-			if flagsBits != "0010" { // as per [MQTT-3.6.1-1]
+			if flagsBits != 0x02 { // as per [MQTT-3.6.1-1]
 				log.Println("malformed PUBREL packet: flags bits != 0010")
 				GOTT.logger.Error("malformed", zap.String("reason", "PUBREL packet: flags bits != 0010"))
 				break loop
 			}
 
-			packetIDBytes := make([]byte, PubrelRemLen)
+			packetIDBytes := c.scratch[:PubrelRemLen]
 			if _, err = c.readFull(packetIDBytes); err != nil {
 				log.Println("error reading var header", err)
 				GOTT.logger.Error("malformed", zap.String("reason", "PUBREL packet: reading var header"), zap.Error(err))
@@ -521,7 +571,12 @@ loop:
 
 			packetID := binary.BigEndian.Uint16(packetIDBytes)
 
-			c.Session.MessageStore.acknowledge(packetID, StatusPubrelReceived, true)
+			// the packet identifier is only released once the message is published, a crash in between
+			// makes the client send the PUBREL again rather than lose it
+			if cm := c.Session.Inbound.get(packetID); cm != nil && cm.Status == StatusUnacknowledged {
+				c.publish(cm.Topic, cm.Payload, publishFlags{QoS: 2, Retain: cm.Retain == 1, PacketID: packetID})
+			}
+			c.Session.release(packetID)
 			c.emit(makePubCompPacket(packetIDBytes))
 
 			GOTT.logger.Debug("PUBREL", zap.Uint16("packetID", packetID))
@@ -532,25 +587,20 @@ loop:
 				break loop
 			}
 
-			remBytes := make([]byte, remLen)
-			if _, err := c.readFull(remBytes); err != nil {
+			packetIDBytes := c.scratch[:2]
+			if _, err := c.readFull(packetIDBytes); err != nil {
 				log.Println("error reading PUBCOMP packet", err)
 				GOTT.logger.Error("malformed", zap.String("reason", "reading PUBCOMP packet"), zap.Error(err))
 				break loop
 			}
 
-			var packetID uint16
-			var packetIDBytes []byte
-
-			packetIDBytes = remBytes
-			packetID = binary.BigEndian.Uint16(packetIDBytes)
+			packetID := binary.BigEndian.Uint16(packetIDBytes)
 
-			GOTT.MessageStore.acknowledge(packetID, StatusPubcompReceived, true)
 			c.Session.acknowledge(packetID, StatusPubcompReceived, true)
 
 			GOTT.logger.Debug("PUBCOMP", zap.Uint16("packetID", packetID))
 		case TypeSubscribe:
-			if flagsBits != "0010" { // as per [MQTT-3.8.1-1]
+			if flagsBits != 0x02 { // as per [MQTT-3.8.1-1]
 				log.Println("malformed SUBSCRIBE packet: flags bits != 0010")
 				GOTT.logger.Error("malformed", zap.String("reason", "SUBSCRIBE packet: flags bits != 0010"))
 				break loop
@@ -562,7 +612,9 @@ loop:
 				break loop
 			}
 
-			remBytes := make([]byte, remLen)
+			// the filters are copied out of the buffer, which is reused once the packet is handled
+			remBuf := getBuffer(remLen)
+			remBytes := *remBuf
 			if _, err := c.readFull(remBytes); err != nil {
 				log.Println("error reading SUBSCRIBE packet", err)
 				GOTT.logger.Error("malformed", zap.String("reason", "reading SUBSCRIBE packet"), zap.Error(err))
@@ -589,20 +641,21 @@ loop:
 			// NOTE: If a Server receives a SUBSCRIBE packet that contains multiple Topic Filters it MUST handle that packet as if it had received a sequence of multiple SUBSCRIBE packets, except that it combines their responses into a single SUBACK response [MQTT-3.8.4-4].
 
 			for _, filter := range filterList {
-				if !GOTT.invokeOnBeforeSubscribe(c.ClientID, c.Username, filter.Filter, filter.QoS) {
+				if !GOTT.invokeOnBeforeSubscribe(c.ConnInfo(), filter.Filter, filter.QoS) {
 					continue
 				}
 
 				if GOTT.Subscribe(c, filter.Filter, filter.QoS) {
-					GOTT.invokeOnSubscribe(c.ClientID, c.Username, filter.Filter, filter.QoS)
+					GOTT.invokeOnSubscribe(c.ConnInfo(), filter.Filter, filter.QoS)
 
 					GOTT.logger.Info("subscribe", zap.String("clientID", c.ClientID), zap.ByteString("filter", filter.Filter), zap.Int("qos", int(filter.QoS)))
 				}
 			}
 
 			c.emit(makeSubAckPacket(packetIDBytes, filterList))
+			putBuffer(remBuf)
 		case TypeUnsubscribe:
-			if flagsBits != "0010" { // as per [MQTT-3.10.1-1]
+			if flagsBits != 0x02 { // as per [MQTT-3.10.1-1]
 				log.Println("malformed UNSUBSCRIBE packet: flags bits != 0010")
 				GOTT.logger.Error("malformed", zap.String("reason", "UNSUBSCRIBE packet: flags bits != 0010"))
 				break loop
@@ -612,7 +665,9 @@ loop:
 				break loop
 			}
 
-			remBytes := make([]byte, remLen)
+			// the filters are copied out of the buffer, which is reused once the packet is handled
+			remBuf := getBuffer(remLen)
+			remBytes := *remBuf
 			if _, err := c.readFull(remBytes); err != nil {
 				log.Println("error reading UNSUBSCRIBE packet", err)
 				GOTT.logger.Error("malformed", zap.String("reason", "reading UNSUBSCRIBE packet"), zap.Error(err))
@@ -635,23 +690,25 @@ loop:
 			}
 
 			for _, filter := range filterList {
-				if !GOTT.invokeOnBeforeUnsubscribe(c.ClientID, c.Username, filter) {
+				if !GOTT.invokeOnBeforeUnsubscribe(c.ConnInfo(), filter) {
 					continue
 				}
 
 				if GOTT.Unsubscribe(c, filter) {
-					GOTT.invokeOnUnsubscribe(c.ClientID, c.Username, filter)
+					GOTT.invokeOnUnsubscribe(c.ConnInfo(), filter)
 
 					GOTT.logger.Info("unsubscribe", zap.String("clientID", c.ClientID), zap.ByteString("filter", filter))
 				}
 			}
 
 			c.emit(makeUnSubAckPacket(packetIDBytes))
+			putBuffer(remBuf)
 		case TypePingReq:
 			c.emit(makePingRespPacket())
 		case TypeDisconnect:
 			c.WillMessage = nil // as per [MQTT-3.1.2-10]
 			c.gracefulDisconnect = true
+			c.setDisconnectReason(DisconnectGraceful)
 			break loop
 		default:
 			log.Println("UNKNOWN PACKET TYPE", packetType)
@@ -665,43 +722,103 @@ loop:
 	c.disconnect()
 }
 
+// publish hands a message received from the client to the plugins and publishes it to the subscribers.
+func (c *Client) publish(topic, payload []byte, flags publishFlags) {
+	if isSysTopic(topic) {
+		// clients are not allowed to publish to the $SYS tree, the message is acknowledged and dropped
+		GOTT.logger.Info("dropped publish to $SYS", zap.String("clientID", c.ClientID), zap.ByteString("topic", topic))
+		return
+	}
+
+	GOTT.invokeOnMessage(c.ConnInfo(), topic, payload, flags.DUP, flags.QoS, flags.Retain)
+
+	if !GOTT.invokeOnBeforePublish(c.ConnInfo(), topic, payload, flags.DUP, flags.QoS, flags.Retain) {
+		return
+	}
+
+	if GOTT.Publish(topic, payload, flags) {
+		GOTT.invokeOnPublish(c.ConnInfo(), topic, payload, flags.DUP, flags.QoS, false)
+
+		GOTT.logger.Info("publish", zap.ByteString("topic", topic), zap.ByteString("payload", payload), zap.Int("qos", int(flags.QoS)))
+	}
+}
+
 func (c *Client) disconnect() {
 	if GOTT == nil || c.ClientID == "" {
 		c.closeConnection()
 		return
 	}
 
-	connected := c.connected.Load()
+	// any break out of the listen loop without a reason is caused by a malformed or unexpected packet
+	c.setDisconnectReason(DisconnectProtocolError)
+
+	// clients rejected before their session was set up never subscribed and their will is not published
+	accepted := c.Session != nil
 
 	c.closeConnection()
-	GOTT.removeClient(c.ClientID)
+	GOTT.removeClient(c)
 
 	log.Printf("client id %s was disconnected", c.ClientID)
 
-	GOTT.UnsubscribeAll(c)
+	if accepted {
+		c.Session.MessageStore.detach()
+		GOTT.UnsubscribeAll(c)
 
-	if c.WillMessage != nil {
-		if GOTT.invokeOnBeforePublish(c.ClientID, c.Username, c.WillMessage.Topic, c.WillMessage.Payload, 0, c.WillMessage.QoS, c.WillMessage.Retain) {
+		// start the expiry of a persistent session, unless a new client took it over
+		if !c.Session.clean && GOTT.getClient(c.ClientID) == nil {
+			c.Session.DisconnectedAt = time.Now()
+			_ = c.Session.put()
+		}
+	}
+
+	if accepted && c.WillMessage != nil && !isSysTopic(c.WillMessage.Topic) {
+		if GOTT.invokeOnBeforePublish(c.ConnInfo(), c.WillMessage.Topic, c.WillMessage.Payload, 0, c.WillMessage.QoS, c.WillMessage.Retain) {
 			if GOTT.Publish(c.WillMessage.Topic, c.WillMessage.Payload, publishFlags{
 				Retain: c.WillMessage.Retain,
 				QoS:    c.WillMessage.QoS,
 			}) {
-				GOTT.invokeOnPublish(c.ClientID, c.Username, c.WillMessage.Topic, c.WillMessage.Payload, 0, c.WillMessage.QoS, false)
+				GOTT.invokeOnPublish(c.ConnInfo(), c.WillMessage.Topic, c.WillMessage.Payload, 0, c.WillMessage.QoS, false)
 			}
 		}
 	}
 
-	if connected {
-		GOTT.invokeOnDisconnect(c.ClientID, c.Username, c.gracefulDisconnect)
-		GOTT.logger.Info("client disconnected", zap.String("id", c.ClientID), zap.Bool("graceful", c.gracefulDisconnect))
+	if !c.connectedAt.IsZero() {
+		GOTT.publishClientDisconnected(c, c.DisconnectReason())
+	}
+
+	info := c.ConnInfo()
+	info.DisconnectReason = c.DisconnectReason()
+
+	atomic.AddInt64(&metrics.disconnects, 1)
+	GOTT.invokeOnDisconnect(info, c.gracefulDisconnect)
+	GOTT.logger.Info("client disconnected", zap.String("id", c.ClientID), zap.Bool("graceful", c.gracefulDisconnect),
+		zap.String("reason", info.DisconnectReason))
+}
+
+func (c *Client) setReadDeadline(t time.Time) {
+	if c.isWebSocket() {
+		_ = c.wsConnection.SetReadDeadline(t)
+		return
+	}
+	_ = c.connection.SetReadDeadline(t)
+}
+
+// readErrorReason maps an error returned while waiting for the next packet to a disconnect reason.
+func readErrorReason(err error) string {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return DisconnectKeepAliveTimeout
 	}
+	return DisconnectConnectionLost
 }
 
 func (c *Client) closeConnection() {
 	c.connected.Store(false)
+	if c.capture != nil {
+		c.capture.close()
+	}
 	if c.isWebSocket() {
-		c.wsMutex.Lock()
-		defer c.wsMutex.Unlock()
+		c.writeMutex.Lock()
+		defer c.writeMutex.Unlock()
 		c.wsConnection.WriteMessage(websocket.CloseMessage, []byte{})
 		c.wsConnection.Close()
 		return
@@ -709,16 +826,51 @@ func (c *Client) closeConnection() {
 	_ = c.connection.Close()
 }
 
-func (c *Client) emit(packet []byte) {
+// emit sends a packet made of parts, like the shared header and payload of a publish fan-out,
+// without joining them.
+func (c *Client) emit(parts ...[]byte) {
+	if len(parts) == 0 || len(parts[0]) == 0 {
+		return
+	}
+
+	size := 0
+	for _, p := range parts {
+		size += len(p)
+	}
+	metrics.packetSent(parts[0][0]>>4, size)
+	if GOTT.traces.isActive() {
+		GOTT.traceOutbound(c, parts...)
+	}
+	if c.capture != nil {
+		c.capture.write(CaptureOutbound, parts...)
+	}
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	var err error
 	if c.isWebSocket() {
-		c.wsMutex.Lock()
-		defer c.wsMutex.Unlock()
-		if err := c.wsConnection.WriteMessage(websocket.BinaryMessage, packet); err != nil {
-			log.Println("error sending packet", err, packet)
+		var w io.WriteCloser
+		if w, err = c.wsConnection.NextWriter(websocket.BinaryMessage); err == nil {
+			for _, p := range parts {
+				if _, err = w.Write(p); err != nil {
+					break
+				}
+			}
+			if closeErr := w.Close(); err == nil {
+				err = closeErr
+			}
 		}
-		return
+	} else if len(parts) == 1 {
+		_, err = c.connection.Write(parts[0])
+	} else {
+		// a single writev on TCP connections, the mutex keeps the parts together on the others.
+		// WriteTo clears the buffers it consumes so it gets a copy of parts.
+		buffers := make(net.Buffers, len(parts))
+		copy(buffers, parts)
+		_, err = buffers.WriteTo(c.connection)
 	}
-	if _, err := c.connection.Write(packet); err != nil {
-		log.Println("error sending packet", err, packet)
+	if err != nil {
+		log.Println("error sending packet", err, parts[0])
 	}
 }
@@ -0,0 +1,93 @@
+package gott
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var pipeClients int64
+
+// newPipeBroker sets the global Broker up with the default config, a memory session store and no listeners.
+func newPipeBroker(b *testing.B) *Broker {
+	log.SetOutput(ioutil.Discard) // every connection is logged
+
+	config := defaultConfig()
+	config.Sessions.Store.Backend = SessionStoreMemory
+	ss, err := loadSessionStore(config.Sessions.Store, zap.NewNop())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	GOTT = &Broker{
+		clients:            newClientRegistry(),
+		takeovers:          newTakeoverLimiter(),
+		config:             config,
+		logger:             zap.NewNop(),
+		SessionStore:       ss,
+		TopicFilterStorage: newTopicStorage(),
+		RetainedStore:      newRetainedStore(),
+		startedAt:          time.Now(),
+	}
+	return GOTT
+}
+
+// connectPipe connects a clean session client to the broker over a net.Pipe.
+// Everything the broker sends after the CONNACK is read and dropped until the connection is closed.
+func connectPipe(b *testing.B, broker *Broker) net.Conn {
+	id := "bench-" + strconv.FormatInt(atomic.AddInt64(&pipeClients, 1), 10)
+	conn, server := net.Pipe()
+	broker.handleConnection(server, TransportTCP, "bench")
+
+	connect := []byte{0x10, byte(12 + len(id)), 0, 4, 'M', 'Q', 'T', 'T', 4, 0x02, 0, 60, 0, byte(len(id))}
+	if _, err := conn.Write(append(connect, id...)); err != nil {
+		b.Fatal(err)
+	}
+	connack := make([]byte, 4)
+	if _, err := conn.Read(connack); err != nil || connack[0] != 0x20 || connack[3] != 0 {
+		b.Fatalf("unexpected CONNACK % x: %v", connack, err)
+	}
+
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	return conn
+}
+
+// BenchmarkReadPath measures the packets handled by the read path of a client without publishing anything.
+func BenchmarkReadPath(b *testing.B) {
+	broker := newPipeBroker(b)
+
+	for _, bench := range []struct {
+		name   string
+		packet []byte
+	}{
+		{"PUBREL", []byte{0x62, 2, 0, 1}}, // of a packet ID that was never received, answered with a PUBCOMP
+		{"PINGREQ", []byte{0xC0, 0}},
+		{"SUBSCRIBE", append([]byte{0x82, 21, 0, 1, 0, 16}, "devices/+/status\x01"...)},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			conn := connectPipe(b, broker)
+			defer conn.Close()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := conn.Write(bench.packet); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
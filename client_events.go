@@ -0,0 +1,103 @@
+package gott
+
+import (
+	"time"
+
+	js "github.com/json-iterator/go"
+	"go.uber.org/zap"
+)
+
+// Reasons a client was disconnected for.
+const (
+	DisconnectGraceful         = "graceful"
+	DisconnectConnectionLost   = "connection_lost"
+	DisconnectKeepAliveTimeout = "keepalive_timeout"
+	DisconnectTakeover         = "takeover"
+	DisconnectTakeoverRejected = "takeover_rejected" // the client ID is in use and the takeover policy didn't allow replacing it
+	DisconnectTakeoverLoop     = "takeover_loop"     // the client ID is blocked after being taken over too often
+	DisconnectProtocolError    = "protocol_error"
+	DisconnectRejected         = "rejected"
+	DisconnectKicked           = "kicked"
+)
+
+type clientEvent struct {
+	ClientID        string    `json:"client_id"`
+	Username        string    `json:"username"`
+	RemoteAddr      string    `json:"remote_addr"`
+	Transport       string    `json:"transport"`
+	ProtocolVersion byte      `json:"protocol_version"`
+	CleanSession    bool      `json:"clean_session"`
+	KeepAlive       int       `json:"keep_alive"`
+	Reason          string    `json:"reason,omitempty"`
+	Timestamp       time.Time `json:"timestamp"`
+}
+
+func newClientEvent(info ConnInfo, reason string) clientEvent {
+	e := clientEvent{
+		ClientID:        info.ClientID,
+		Username:        info.Username,
+		Transport:       info.Transport,
+		ProtocolVersion: info.ProtocolVersion,
+		CleanSession:    info.CleanSession,
+		KeepAlive:       info.KeepAlive,
+		Reason:          reason,
+		Timestamp:       time.Now(),
+	}
+	if info.RemoteAddr != nil {
+		e.RemoteAddr = info.RemoteAddr.String()
+	}
+	return e
+}
+
+// publishClientConnected publishes the connected event of a client and its online state if enabled.
+func (b *Broker) publishClientConnected(c *Client) {
+	if !b.config.ClientEvents.Enabled {
+		return
+	}
+
+	b.publishClientEvent(c.ClientID, "connected", newClientEvent(c.ConnInfo(), ""))
+	if b.config.ClientEvents.StateTopic {
+		b.Publish([]byte("$SYS/clients/"+c.ClientID+"/state"), []byte("online"), publishFlags{Retain: true})
+	}
+}
+
+// publishClientDisconnected publishes the disconnected event of a client and its offline state if enabled.
+// The offline state is skipped on takeovers since the new connection of the same client ID is already online.
+func (b *Broker) publishClientDisconnected(c *Client, reason string) {
+	if !b.config.ClientEvents.Enabled {
+		return
+	}
+
+	b.publishClientEvent(c.ClientID, "disconnected", newClientEvent(c.ConnInfo(), reason))
+	if b.config.ClientEvents.StateTopic && reason != DisconnectTakeover {
+		b.Publish([]byte("$SYS/clients/"+c.ClientID+"/state"), []byte("offline"), publishFlags{Retain: true})
+	}
+}
+
+func (b *Broker) publishClientEvent(clientID, event string, e clientEvent) {
+	payload, err := js.Marshal(e)
+	if err != nil {
+		b.logger.Error("client event marshaling", zap.String("id", clientID), zap.Error(err))
+		return
+	}
+
+	// client IDs containing wildcards make an invalid topic name, Publish rejects those
+	b.Publish([]byte("$SYS/clients/"+clientID+"/"+event), payload, publishFlags{})
+}
+
+// setDisconnectReason records why the client is being disconnected.
+// Only the first reason is kept, later ones are usually consequences of the first (e.g. a read error after a takeover).
+func (c *Client) setDisconnectReason(reason string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.disconnectReason == "" {
+		c.disconnectReason = reason
+	}
+}
+
+// DisconnectReason returns the reason the client was disconnected for or an empty string if it is still connected.
+func (c *Client) DisconnectReason() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.disconnectReason
+}
@@ -0,0 +1,108 @@
+package gott
+
+import "sync"
+
+// clientRegistryShards is the number of independently locked maps connected clients are spread over.
+const clientRegistryShards = 64
+
+// clientRegistry holds the connected clients by client ID. It's sharded by a hash of the ID
+// so connects and disconnects of different clients rarely contend on the same lock.
+type clientRegistry struct {
+	shards [clientRegistryShards]clientRegistryShard
+}
+
+type clientRegistryShard struct {
+	clients map[string]*Client
+	mutex   sync.RWMutex
+}
+
+func newClientRegistry() *clientRegistry {
+	r := &clientRegistry{}
+	for i := range r.shards {
+		r.shards[i].clients = map[string]*Client{}
+	}
+	return r
+}
+
+func (r *clientRegistry) shard(clientID string) *clientRegistryShard {
+	// FNV-1a
+	h := uint32(2166136261)
+	for i := 0; i < len(clientID); i++ {
+		h ^= uint32(clientID[i])
+		h *= 16777619
+	}
+	return &r.shards[h%clientRegistryShards]
+}
+
+func (r *clientRegistry) get(clientID string) *Client {
+	s := r.shard(clientID)
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.clients[clientID]
+}
+
+// swap registers a client and returns the client it replaced, if any. allow decides, under the lock,
+// whether an existing client is replaced, c isn't registered otherwise.
+// The replaced client is marked as disconnected before the lock is released so nothing is delivered
+// to it once the new one is registered.
+func (r *clientRegistry) swap(c *Client, allow func(old, c *Client) bool) (old *Client, ok bool) {
+	s := r.shard(c.ClientID)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if old = s.clients[c.ClientID]; old != nil {
+		if !allow(old, c) {
+			return old, false
+		}
+		old.connected.Store(false)
+	}
+	s.clients[c.ClientID] = c
+	return old, true
+}
+
+// remove unregisters a client unless it was already replaced by a newer connection with the same ID.
+func (r *clientRegistry) remove(c *Client) bool {
+	s := r.shard(c.ClientID)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.clients[c.ClientID] != c {
+		return false
+	}
+	delete(s.clients, c.ClientID)
+	return true
+}
+
+// ifAbsent calls fn with the shard of clientID locked if no client with that ID is registered, so a client
+// connecting meanwhile is only registered once fn returns. fn must not use the registry.
+func (r *clientRegistry) ifAbsent(clientID string, fn func()) {
+	s := r.shard(clientID)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.clients[clientID] == nil {
+		fn()
+	}
+}
+
+// forEach calls fn for every registered client, one shard at a time. fn must not modify the registry.
+func (r *clientRegistry) forEach(fn func(c *Client)) {
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.mutex.RLock()
+		for _, c := range s.clients {
+			fn(c)
+		}
+		s.mutex.RUnlock()
+	}
+}
+
+func (r *clientRegistry) len() (n int) {
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.mutex.RLock()
+		n += len(s.clients)
+		s.mutex.RUnlock()
+	}
+	return
+}
@@ -1,6 +1,7 @@
 package gott
 
 import (
+	"crypto/tls"
 	"io/ioutil"
 	"log"
 
@@ -12,6 +13,7 @@ import (
 
 type tlsConfig struct {
 	Listen, Cert, Key string
+	ClientAuth        string `yaml:"client_auth"`
 }
 
 func (t tlsConfig) Enabled() bool {
@@ -20,12 +22,26 @@ func (t tlsConfig) Enabled() bool {
 
 type wssConfig struct {
 	Listen, Cert, Key string
+	ClientAuth        string `yaml:"client_auth"`
 }
 
 func (t wssConfig) Enabled() bool {
 	return t.Listen != "" && t.Cert != "" && t.Key != ""
 }
 
+// clientAuthType maps the client_auth config values to a tls.ClientAuthType.
+// Certificates are not verified by the broker, that is left to the plugins through ConnInfo.
+func clientAuthType(clientAuth string) tls.ClientAuthType {
+	switch clientAuth {
+	case "request":
+		return tls.RequestClientCert
+	case "require":
+		return tls.RequireAnyClientCert
+	default:
+		return tls.NoClientCert
+	}
+}
+
 type loggingConfig struct {
 	LogLevel          string `yaml:"log_level"`
 	Filename          string
@@ -44,12 +60,90 @@ type webSocketsConfig struct {
 	WSS               wssConfig `yaml:"wss"`
 }
 
+type metricsConfig struct {
+	Listen string
+	Path   string
+}
+
+type clientEventsConfig struct {
+	Enabled    bool
+	StateTopic bool `yaml:"state_topic"`
+}
+
+type takeoverConfig struct {
+	Policy        string
+	LoopThreshold int `yaml:"loop_threshold"`
+	LoopWindow    int `yaml:"loop_window"`
+	LoopBlock     int `yaml:"loop_block"`
+}
+
+type queueConfig struct {
+	MaxMessages int `yaml:"max_messages"`
+	MaxBytes    int `yaml:"max_bytes"`
+	MaxAge      int `yaml:"max_age"`
+	Overflow    string
+	QoS0        bool `yaml:"qos0"`
+}
+
+type storeEncryptionConfig struct {
+	KeyFile string `yaml:"key_file"`
+	KeyEnv  string `yaml:"key_env"`
+}
+
+// Enabled requires a key file or the name of an environment variable holding the keys.
+func (e storeEncryptionConfig) Enabled() bool {
+	return e.KeyFile != "" || e.KeyEnv != ""
+}
+
+type sessionStoreConfig struct {
+	Backend         string
+	Path            string
+	Sync            bool
+	GCInterval      int `yaml:"gc_interval"`
+	CompactInterval int `yaml:"compact_interval"`
+	Encryption      storeEncryptionConfig
+}
+
+type sessionsConfig struct {
+	Expiry        int
+	SweepInterval int `yaml:"sweep_interval"`
+	Queue         queueConfig
+	Store         sessionStoreConfig
+}
+
+type captureConfig struct {
+	Enabled bool
+	Dir     string
+	Format  string
+}
+
+type adminConfig struct {
+	Listen    string
+	Socket    string
+	Dashboard bool
+	Token     string
+	Username  string
+	Password  string
+}
+
+// Enabled requires a listen address and at least one way to authenticate.
+func (a adminConfig) Enabled() bool {
+	return a.Listen != "" && (a.Token != "" || a.Username != "")
+}
+
 // Config holds the parsed config file
 type Config struct {
 	ConfigPath   string
 	Listen       string
 	Tls          tlsConfig
 	WebSockets   webSocketsConfig `yaml:"websockets"`
+	Metrics      metricsConfig
+	SysInterval  int                `yaml:"sys_interval"`
+	ClientEvents clientEventsConfig `yaml:"client_events"`
+	Takeover     takeoverConfig
+	Sessions     sessionsConfig
+	Admin        adminConfig
+	Capture      captureConfig
 	Logging      loggingConfig
 	Plugins      []interface{}
 	pluginNames  []string
@@ -64,6 +158,37 @@ func defaultConfig() Config {
 			Listen: "",
 			Path:   "/ws",
 		},
+		Metrics: metricsConfig{
+			Listen: "",
+			Path:   "/metrics",
+		},
+		SysInterval: 10,
+		Takeover: takeoverConfig{
+			Policy:        TakeoverPolicyTakeover,
+			LoopThreshold: 10,
+			LoopWindow:    60,
+			LoopBlock:     60,
+		},
+		Admin: adminConfig{
+			Dashboard: true,
+		},
+		Sessions: sessionsConfig{
+			SweepInterval: 60,
+			Queue: queueConfig{
+				MaxMessages: 1000,
+				Overflow:    QueueOverflowDropOldest,
+			},
+			Store: sessionStoreConfig{
+				Backend:         SessionStoreBadger,
+				Path:            ".sessions.store",
+				GCInterval:      300,
+				CompactInterval: 86400,
+			},
+		},
+		Capture: captureConfig{
+			Dir:    "captures",
+			Format: CaptureFormatBinary,
+		},
 		Logging: loggingConfig{
 			LogLevel:          "error",
 			Filename:          "gott.log",
@@ -0,0 +1,55 @@
+package gott
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+)
+
+// Transports a client can connect over.
+const (
+	TransportTCP = "tcp"
+	TransportTLS = "tls"
+	TransportWS  = "ws"
+	TransportWSS = "wss"
+)
+
+// ConnInfo describes a client's connection. It is built when the socket is opened
+// and completed when the CONNECT packet is accepted, then passed to the *Info plugin hooks.
+type ConnInfo struct {
+	ClientID, Username    string
+	RemoteAddr, LocalAddr net.Addr
+	Listener              string // the configured listen address that accepted the connection
+	Transport             string // one of TransportTCP, TransportTLS, TransportWS and TransportWSS
+	PeerCertificates      []*x509.Certificate
+	ProtocolVersion       byte
+	KeepAlive             int // seconds
+	CleanSession          bool
+	DisconnectReason      string // only set for the disconnect hooks, one of the Disconnect* reasons
+}
+
+func newConnInfo(conn net.Conn, transport, listener string) ConnInfo {
+	info := ConnInfo{
+		RemoteAddr: conn.RemoteAddr(),
+		LocalAddr:  conn.LocalAddr(),
+		Listener:   listener,
+		Transport:  transport,
+	}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		// the handshake is lazy, force it here to have the peer certificates available to the hooks
+		if err := tlsConn.Handshake(); err == nil {
+			info.PeerCertificates = tlsConn.ConnectionState().PeerCertificates
+		}
+	}
+
+	return info
+}
+
+// ConnInfo returns the connection info of the Client.
+func (c *Client) ConnInfo() ConnInfo {
+	info := c.connInfo
+	info.ClientID = c.ClientID
+	info.Username = c.Username
+	return info
+}
@@ -4,6 +4,9 @@ const (
 	mqttv311 = 4
 )
 
+// Version is the broker's version as published on $SYS/broker/version.
+const Version = "gott 1.0.0-beta"
+
 // Packet types.
 const (
 	TypeReserved = iota
@@ -67,11 +70,15 @@ listen: ":1883"
     # TLS, in the format hostname_or_ip:port, default is ":8883".
   # tls.cert: Absolute path to the certificate file.
   # tls.key: Absolute path to the key file.
+  # tls.client_auth: Whether to ask clients for a certificate, "none", "request" or "require".
+    # Certificates are not verified by the broker, they are passed to plugins to decide upon,
+    # default is "none".
 # Disabled by default.
 tls:
   listen: ":8883"
   cert: ""
   key: ""
+  client_auth: "none"
 
 # To disable MQTT over non-TLS WebSockets set 'listen' to an empty string.
 # To allow all Origins leave 'origins' empty.
@@ -79,6 +86,7 @@ tls:
 # will be rejected.
 # 'wss' holds the configuration to enable WebSockets over TLS,
   # To disable, leave any of the child properties empty.
+  # 'client_auth' behaves the same as tls.client_auth.
   # Disabled by default.
 websockets:
   listen: ":8083"
@@ -87,11 +95,132 @@ websockets:
     listen: ":8084"
     cert: ""
     key: ""
+    client_auth: "none"
   reject_empty_origin: false
   origins:
     # - https://website.com
     # - http://localhost:8000
 
+# metrics property enables an HTTP endpoint serving the broker's metrics
+# in the OpenMetrics (Prometheus) text format.
+  # metrics.listen: The address to serve the metrics on, in the format hostname_or_ip:port.
+    # Leave empty to disable, disabled by default.
+  # metrics.path: The HTTP path of the metrics endpoint, default is "/metrics".
+metrics:
+  listen: ""
+  path: "/metrics"
+
+# sys_interval property is the interval in seconds between publishing the broker's statistics
+# as retained messages under the $SYS topic tree.
+# Set to 0 to disable, default is 10.
+sys_interval: 10
+
+# client_events property enables publishing JSON events on $SYS/clients/<client id>/connected
+# and $SYS/clients/<client id>/disconnected whenever a client connects or disconnects.
+  # client_events.enabled: Set to true to enable the events, default is false.
+  # client_events.state_topic: Set to true to also publish a retained "online" or "offline"
+    # message on $SYS/clients/<client id>/state, default is false.
+client_events:
+  enabled: false
+  state_topic: false
+
+# takeover property decides what happens when a client connects with the ID of a connected client.
+  # takeover.policy: "takeover" disconnects the connected client, "reject" rejects the new connection
+    # with the identifier rejected return code and "same_username" allows the takeover only if both
+    # clients have the same username, default is "takeover".
+  # takeover.loop_threshold: Clients sharing an ID keep kicking each other. A client ID taken over this many
+    # times within loop_window seconds is rejected for loop_block seconds. Set to 0 to disable, default is 10.
+  # takeover.loop_window: In seconds, default is 60.
+  # takeover.loop_block: In seconds, default is 60.
+takeover:
+  policy: "takeover"
+  loop_threshold: 10
+  loop_window: 60
+  loop_block: 60
+
+# sessions property configures the persistent sessions of clients connecting with clean session set to 0.
+  # sessions.expiry: Seconds after the last disconnect of a client for its session to be deleted, along with
+    # its queued messages and subscriptions. Set to 0 to keep sessions forever, default is 0.
+  # sessions.sweep_interval: Seconds between two checks for expired sessions, default is 60.
+  # sessions.queue: Limits of the queue of messages published while a client is offline.
+    # sessions.queue.max_messages: Maximum number of queued messages, 0 is unlimited, default is 1000.
+    # sessions.queue.max_bytes: Maximum size of the topics and payloads of the queued messages, 0 is unlimited, default is 0.
+    # sessions.queue.max_age: Seconds after which a queued message is dropped, 0 keeps them until delivered, default is 0.
+    # sessions.queue.overflow: What to do with a message that exceeds the limits, "drop_oldest" drops the oldest
+      # queued messages to make room, "drop_newest" drops the most recently queued ones and "reject" drops
+      # the new message, default is "drop_oldest".
+    # sessions.queue.qos0: Also queue QoS 0 messages, default is false.
+  # sessions.store: Where persistent sessions and retained messages are saved.
+    # sessions.store.backend: "badger" for a badger database, "log" for an append-only log file loaded
+      # in memory on start, lighter than badger for small deployments, or "memory" to keep sessions in
+      # memory only, they are lost when the broker exits. Default is "badger".
+    # sessions.store.path: Directory of the badger database or of the log file, default is ".sessions.store".
+      # Both are locked while the broker has them open, a second broker on the same directory fails to start.
+    # sessions.store.sync: Waits for every write to reach the disk (fsync) before going on. Without it a crash
+      # of the machine, not only of the broker, can lose the last writes. Default is false.
+    # sessions.store.gc_interval: Reclaims the disk space of deleted and overwritten sessions every gc_interval
+      # seconds, 0 disables it. Default is 300 (5 minutes). Not used by the memory backend.
+    # sessions.store.compact_interval: Rewrites the store in its most compact form every compact_interval
+      # seconds, 0 disables it. Default is 86400 (1 day). Not used by the memory backend.
+    # sessions.store.encryption: Encrypts the saved sessions and retained messages with AES-256-GCM.
+      # Client IDs, topic filters and retained topic names, which the records are looked up by, stay in plaintext.
+      # sessions.store.encryption.key_file: Path of a file holding the keys.
+      # sessions.store.encryption.key_env: Name of an environment variable holding the keys, instead of key_file.
+      # Keys are 32 random bytes, hex or base64 encoded (e.g. "openssl rand -hex 32"), separated by new lines,
+      # spaces or commas. The first key encrypts, the next ones are previous keys only used to decrypt.
+      # To rotate keys, add a new key first and restart the broker: the store is copied with its records encrypted
+      # with it on start and the previous files are deleted, after which the previous keys can be removed.
+      # Existing plaintext stores are encrypted the same way.
+      # Empty by default, the store isn't encrypted.
+sessions:
+  expiry: 0
+  sweep_interval: 60
+  queue:
+    max_messages: 1000
+    max_bytes: 0
+    max_age: 0
+    overflow: "drop_oldest"
+    qos0: false
+  store:
+    backend: "badger"
+    path: ".sessions.store"
+    sync: false
+    gc_interval: 300
+    compact_interval: 86400
+    encryption:
+      key_file: ""
+      key_env: ""
+
+# admin property enables the HTTP admin API on a separate listener.
+  # admin.listen: The address to serve the API on, in the format hostname_or_ip:port.
+    # Leave empty to disable, disabled by default.
+  # admin.token: A token to authenticate requests sent with the "Authorization: Bearer <token>" header.
+  # admin.username and admin.password: Credentials to authenticate requests using HTTP basic auth.
+  # At least a token or a username must be set for the API to start.
+  # admin.socket: Path of a Unix socket to also serve the API on, used by gottctl.
+    # Requests over the socket are not authenticated, access is restricted to the
+    # broker's user by the socket's file permissions. Leave empty to disable.
+  # admin.dashboard: Serves a web dashboard under /dashboard/ on the admin listeners, default is true.
+    # Log in with the username and password, or with any username and the token as password.
+admin:
+  listen: ""
+  socket: ""
+  dashboard: true
+  token: ""
+  username: ""
+  password: ""
+
+# capture property records the raw MQTT frames sent and received on every connection
+# to a file per connection, to be fed back into a broker with "gott replay <file>".
+# Captures contain the clients' credentials and payloads, enable only while debugging.
+  # capture.enabled: Enables capturing, default is false.
+  # capture.dir: The directory to write the capture files to, default is "captures".
+  # capture.format: "binary" for a compact binary format or "jsonl" for JSON lines, default is "binary".
+capture:
+  enabled: false
+  dir: "captures"
+  format: "binary"
+
 # logging property adjusts how the logger should behave.
   # logging.log_level: Defines the minimum level to which the broker should log messages,
     # available levels are "debug", "info", "error" and "fatal",
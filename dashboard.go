@@ -0,0 +1,57 @@
+package gott
+
+import (
+	"net/http"
+)
+
+const dashboardPrefix = "/dashboard/"
+
+// dashboardConfig tells the dashboard where to connect to for the live message viewer.
+type dashboardConfig struct {
+	Version         string
+	WebSocketListen string
+	WebSocketPath   string
+	WSSListen       string
+}
+
+// GET /
+func (as *adminServer) handleRoot(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	http.Redirect(w, r, dashboardPrefix, http.StatusFound)
+}
+
+// GET /dashboard/
+func (as *adminServer) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != dashboardPrefix {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = w.Write([]byte(dashboardHTML))
+}
+
+// GET /dashboard/config
+func (as *adminServer) handleDashboardConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	cnf := dashboardConfig{
+		Version:         Version,
+		WebSocketListen: as.config.WebSockets.Listen,
+		WebSocketPath:   as.config.WebSockets.Path,
+	}
+	if as.config.WebSockets.WSS.Enabled() {
+		cnf.WSSListen = as.config.WebSockets.WSS.Listen
+	}
+	writeJSON(w, http.StatusOK, cnf)
+}
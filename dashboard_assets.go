@@ -0,0 +1,442 @@
+package gott
+
+// dashboardHTML is the single page web dashboard served on the admin listeners.
+// It only uses the admin API and the broker's WebSocket listener, no external assets are loaded.
+const dashboardHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>GOTT Dashboard</title>
+<style>
+  * { box-sizing: border-box; }
+  body { margin: 0; font: 14px/1.4 -apple-system, "Segoe UI", Roboto, sans-serif; background: #f4f5f7; color: #222; }
+  header { background: #1f2933; color: #fff; padding: 12px 24px; display: flex; justify-content: space-between; align-items: center; }
+  header h1 { margin: 0; font-size: 18px; }
+  main { padding: 16px 24px; display: grid; gap: 16px; grid-template-columns: 1fr 1fr; }
+  section { background: #fff; border-radius: 6px; padding: 16px; box-shadow: 0 1px 2px rgba(0,0,0,.1); overflow: auto; }
+  section.wide { grid-column: 1 / 3; }
+  h2 { margin: 0 0 12px; font-size: 15px; }
+  .cards { display: grid; grid-template-columns: repeat(auto-fill, minmax(150px, 1fr)); gap: 12px; }
+  .card { background: #f4f5f7; border-radius: 4px; padding: 10px; }
+  .card .label { font-size: 12px; color: #616e7c; }
+  .card .value { font-size: 20px; font-weight: 600; }
+  table { width: 100%; border-collapse: collapse; }
+  th, td { text-align: left; padding: 6px 8px; border-bottom: 1px solid #e4e7eb; white-space: nowrap; }
+  th { font-size: 12px; color: #616e7c; }
+  td.payload { font-family: monospace; white-space: pre-wrap; word-break: break-all; }
+  input, select, textarea, button { font: inherit; padding: 5px 8px; border: 1px solid #cbd2d9; border-radius: 4px; }
+  button { background: #2680c2; color: #fff; border-color: #2680c2; cursor: pointer; }
+  button.danger { background: #d64545; border-color: #d64545; }
+  form.row, div.row { display: flex; gap: 8px; align-items: center; margin-bottom: 12px; flex-wrap: wrap; }
+  textarea { width: 100%; min-height: 80px; font-family: monospace; }
+  details { margin-left: 16px; }
+  summary { cursor: pointer; }
+  .muted { color: #9aa5b1; }
+  .tag { display: inline-block; background: #e4e7eb; border-radius: 3px; padding: 0 4px; margin-right: 4px; font-size: 12px; }
+  .status { font-size: 12px; }
+  .error { color: #d64545; }
+</style>
+</head>
+<body>
+<header>
+  <h1>GOTT Dashboard</h1>
+  <span id="version" class="status"></span>
+</header>
+<main>
+  <section class="wide">
+    <h2>Overview</h2>
+    <div class="cards" id="cards"></div>
+  </section>
+
+  <section class="wide">
+    <h2>Connected clients</h2>
+    <div class="row"><input id="client-search" placeholder="Search client ID, username or address" size="40"></div>
+    <table>
+      <thead><tr><th>Client ID</th><th>Username</th><th>Remote address</th><th>Transport</th><th>Keep alive</th><th>Clean</th><th>Connected at</th><th>Subscriptions</th><th></th></tr></thead>
+      <tbody id="clients"></tbody>
+    </table>
+  </section>
+
+  <section>
+    <h2>Topic tree</h2>
+    <form class="row" id="tree-form"><input id="tree-prefix" placeholder="Prefix"><button>Refresh</button></form>
+    <div id="tree"></div>
+  </section>
+
+  <section>
+    <h2>Publish</h2>
+    <form id="publish-form">
+      <div class="row">
+        <input id="publish-topic" placeholder="Topic" required size="30">
+        <select id="publish-qos"><option value="0">QoS 0</option><option value="1">QoS 1</option><option value="2">QoS 2</option></select>
+        <label><input type="checkbox" id="publish-retain"> Retain</label>
+      </div>
+      <textarea id="publish-payload" placeholder="Payload"></textarea>
+      <div class="row"><button>Publish</button><span id="publish-status" class="status"></span></div>
+    </form>
+  </section>
+
+  <section class="wide">
+    <h2>Live messages</h2>
+    <form class="row" id="live-form">
+      <input id="live-filter" value="#" placeholder="Topic filter">
+      <input id="live-username" placeholder="Username">
+      <input id="live-password" type="password" placeholder="Password">
+      <button id="live-toggle">Connect</button>
+      <span id="live-status" class="status muted">Disconnected</span>
+    </form>
+    <table>
+      <thead><tr><th>Time</th><th>Topic</th><th>QoS</th><th>Retain</th><th>Payload</th></tr></thead>
+      <tbody id="live"></tbody>
+    </table>
+  </section>
+</main>
+
+<script>
+(function () {
+  "use strict";
+
+  var POLL_INTERVAL = 2000;
+  var MAX_LIVE_ROWS = 200;
+  var config = {};
+  var lastStats = null;
+  var clients = [];
+
+  function $(id) { return document.getElementById(id); }
+
+  function el(tag, attrs, children) {
+    var e = document.createElement(tag);
+    for (var k in attrs || {}) {
+      if (k === "text") { e.textContent = attrs[k]; } else { e.setAttribute(k, attrs[k]); }
+    }
+    (children || []).forEach(function (c) { e.appendChild(c); });
+    return e;
+  }
+
+  function api(method, path, body) {
+    return fetch(path, { method: method, body: body, credentials: "same-origin", headers: { "X-Requested-With": "XMLHttpRequest" } }).then(function (resp) {
+      if (resp.status === 204) { return null; }
+      return resp.json().then(function (data) {
+        if (!resp.ok) { throw new Error(data.error || resp.statusText); }
+        return data;
+      });
+    });
+  }
+
+  function decodePayload(b64) {
+    if (!b64) { return ""; }
+    var bin = atob(b64);
+    var bytes = new Uint8Array(bin.length);
+    for (var i = 0; i < bin.length; i++) { bytes[i] = bin.charCodeAt(i); }
+    return new TextDecoder().decode(bytes);
+  }
+
+  function preview(s) { return s.length > 200 ? s.slice(0, 200) + "…" : s; }
+
+  function formatBytes(n) {
+    var units = ["B", "KB", "MB", "GB", "TB"];
+    var i = 0;
+    while (n >= 1024 && i < units.length - 1) { n /= 1024; i++; }
+    return n.toFixed(i ? 1 : 0) + " " + units[i];
+  }
+
+  function formatDuration(s) {
+    var d = Math.floor(s / 86400), h = Math.floor(s % 86400 / 3600), m = Math.floor(s % 3600 / 60);
+    return (d ? d + "d " : "") + (h ? h + "h " : "") + m + "m " + (s % 60) + "s";
+  }
+
+  // Overview
+
+  function refreshStats() {
+    api("GET", "/api/stats").then(function (stats) {
+      var now = Date.now();
+      var rate = function (key) {
+        if (!lastStats) { return 0; }
+        return Math.max(0, (stats[key] - lastStats.stats[key]) / ((now - lastStats.time) / 1000));
+      };
+      var transports = Object.keys(stats.ClientsByTransport || {}).map(function (t) {
+        return t + " " + stats.ClientsByTransport[t];
+      }).join(", ");
+
+      var cards = [
+        ["Clients connected", stats.ClientsConnected, transports],
+        ["Messages in /s", rate("PublishReceived").toFixed(1)],
+        ["Messages out /s", rate("PublishSent").toFixed(1)],
+        ["Bytes in /s", formatBytes(rate("BytesReceived"))],
+        ["Bytes out /s", formatBytes(rate("BytesSent"))],
+        ["Sessions", stats.Sessions],
+        ["Subscriptions", stats.Subscriptions],
+        ["Retained messages", stats.RetainedMessages],
+        ["Inflight messages", stats.InflightMessages],
+        ["Uptime", formatDuration(stats.Uptime)]
+      ];
+      var container = $("cards");
+      container.textContent = "";
+      cards.forEach(function (c) {
+        var card = el("div", { "class": "card" }, [
+          el("div", { "class": "label", text: c[0] }),
+          el("div", { "class": "value", text: String(c[1]) })
+        ]);
+        if (c[2]) { card.appendChild(el("div", { "class": "label", text: c[2] })); }
+        container.appendChild(card);
+      });
+      lastStats = { stats: stats, time: now };
+    }).catch(function () {});
+  }
+
+  // Clients
+
+  function refreshClients() {
+    api("GET", "/api/clients").then(function (data) {
+      clients = data || [];
+      renderClients();
+    }).catch(function () {});
+  }
+
+  function renderClients() {
+    var q = $("client-search").value.toLowerCase();
+    var body = $("clients");
+    body.textContent = "";
+    clients.filter(function (c) {
+      return !q || [c.ClientID, c.Username, c.RemoteAddr].join(" ").toLowerCase().indexOf(q) !== -1;
+    }).forEach(function (c) {
+      var kick = el("button", { "class": "danger", text: "Kick" });
+      kick.onclick = function () {
+        if (!confirm("Disconnect " + c.ClientID + "?")) { return; }
+        api("DELETE", "/api/clients/" + encodeURIComponent(c.ClientID)).then(refreshClients, function (err) { alert(err.message); });
+      };
+      var subs = el("td");
+      (c.Subscriptions || []).forEach(function (s) {
+        subs.appendChild(el("span", { "class": "tag", text: s.Filter + " q" + s.QoS }));
+      });
+      body.appendChild(el("tr", {}, [
+        el("td", { text: c.ClientID }),
+        el("td", { text: c.Username }),
+        el("td", { text: c.RemoteAddr }),
+        el("td", { text: c.Transport }),
+        el("td", { text: c.KeepAlive + "s" }),
+        el("td", { text: c.CleanSession ? "yes" : "no" }),
+        el("td", { text: new Date(c.ConnectedAt).toLocaleString() }),
+        subs,
+        el("td", {}, [kick])
+      ]));
+    });
+  }
+
+  // Topic tree
+
+  function refreshTree() {
+    var prefix = $("tree-prefix").value;
+    api("GET", "/api/topics?prefix=" + encodeURIComponent(prefix)).then(function (levels) {
+      var root = { children: {} };
+      (levels || []).forEach(function (l) {
+        var node = root;
+        l.Path.split("/").forEach(function (seg) {
+          node.children[seg] = node.children[seg] || { name: seg, children: {} };
+          node = node.children[seg];
+        });
+        node.level = l;
+      });
+      var tree = $("tree");
+      tree.textContent = "";
+      renderTree(tree, root);
+      if (!levels || !levels.length) { tree.appendChild(el("div", { "class": "muted", text: "No topics" })); }
+    }).catch(function (err) { $("tree").textContent = err.message; });
+  }
+
+  function renderTree(parent, node) {
+    Object.keys(node.children).sort().forEach(function (name) {
+      var child = node.children[name];
+      var summary = el("summary", { text: name === "" ? "(empty)" : name });
+      var l = child.level;
+      if (l && l.Subscriptions.length) { summary.appendChild(el("span", { "class": "tag", text: l.Subscriptions.length + " subs" })); }
+      if (l && l.Retained) { summary.appendChild(el("span", { "class": "tag", text: "retained" })); }
+      var details = el("details", {}, [summary]);
+      if (l) {
+        l.Subscriptions.forEach(function (s) {
+          details.appendChild(el("div", { "class": "muted", text: s.ClientID + " (QoS " + s.QoS + ")" }));
+        });
+        if (l.Retained) {
+          details.appendChild(el("div", { "class": "payload", text: "retained QoS " + l.Retained.QoS + ": " + preview(decodePayload(l.Retained.Payload)) }));
+        }
+      }
+      renderTree(details, child);
+      parent.appendChild(details);
+    });
+  }
+
+  // Publish
+
+  function publish(e) {
+    e.preventDefault();
+    var params = "topic=" + encodeURIComponent($("publish-topic").value) +
+      "&qos=" + $("publish-qos").value +
+      "&retain=" + $("publish-retain").checked;
+    api("POST", "/api/publish?" + params, $("publish-payload").value).then(function () {
+      $("publish-status").textContent = "Published at " + new Date().toLocaleTimeString();
+      $("publish-status").className = "status muted";
+    }, function (err) {
+      $("publish-status").textContent = err.message;
+      $("publish-status").className = "status error";
+    });
+  }
+
+  // Live messages, a minimal MQTT 3.1.1 client over the broker's WebSocket listener.
+
+  var live = null;
+
+  function utf8(s) {
+    var b = new TextEncoder().encode(s);
+    return [b.length >> 8, b.length & 0xFF].concat(Array.prototype.slice.call(b));
+  }
+
+  function packet(header, body) {
+    var len = body.length, rl = [];
+    do {
+      var digit = len % 128;
+      len = Math.floor(len / 128);
+      rl.push(len > 0 ? digit | 0x80 : digit);
+    } while (len > 0);
+    return new Uint8Array([header].concat(rl, body));
+  }
+
+  function connectPacket(username, password) {
+    var flags = 0x02;
+    var payload = utf8("gott-dashboard-" + Math.random().toString(36).slice(2, 10));
+    if (username) { flags |= 0x80; payload = payload.concat(utf8(username)); }
+    if (password) { flags |= 0x40; payload = payload.concat(utf8(password)); }
+    return packet(0x10, utf8("MQTT").concat([4, flags, 0, 60], payload));
+  }
+
+  function liveURL() {
+    var secure = location.protocol === "https:" && config.WSSListen;
+    var listen = secure ? config.WSSListen : config.WebSocketListen;
+    var port = listen.slice(listen.lastIndexOf(":") + 1);
+    return (secure ? "wss://" : "ws://") + location.hostname + ":" + port + config.WebSocketPath;
+  }
+
+  function setLiveStatus(text, error) {
+    $("live-status").textContent = text;
+    $("live-status").className = "status " + (error ? "error" : "muted");
+  }
+
+  function toggleLive(e) {
+    e.preventDefault();
+    if (live) {
+      live.close();
+      return;
+    }
+    if (!config.WebSocketListen) {
+      setLiveStatus("The WebSocket listener is disabled", true);
+      return;
+    }
+
+    var ws = new WebSocket(liveURL(), "mqtt");
+    var buf = new Uint8Array(0);
+    var ping;
+    ws.binaryType = "arraybuffer";
+    live = ws;
+    $("live-toggle").textContent = "Disconnect";
+    setLiveStatus("Connecting…");
+
+    ws.onopen = function () {
+      ws.send(connectPacket($("live-username").value, $("live-password").value));
+    };
+    ws.onmessage = function (msg) {
+      var data = new Uint8Array(msg.data);
+      var merged = new Uint8Array(buf.length + data.length);
+      merged.set(buf);
+      merged.set(data, buf.length);
+      buf = merged;
+
+      for (;;) {
+        var mul = 1, len = 0, i = 1, b;
+        do {
+          if (i >= buf.length) { return; }
+          b = buf[i++];
+          len += (b & 0x7F) * mul;
+          mul *= 128;
+        } while (b & 0x80);
+        if (buf.length < i + len) { return; }
+        handlePacket(ws, buf[0], buf.subarray(i, i + len));
+        buf = buf.slice(i + len);
+      }
+    };
+    ws.onclose = function () {
+      clearInterval(ping);
+      if (live === ws) { live = null; }
+      $("live-toggle").textContent = "Connect";
+      if ($("live-status").className.indexOf("error") === -1) { setLiveStatus("Disconnected"); }
+    };
+    ws.onerror = function () { setLiveStatus("Connection failed", true); };
+
+    ping = setInterval(function () {
+      if (ws.readyState === WebSocket.OPEN) { ws.send(new Uint8Array([0xC0, 0])); }
+    }, 30000);
+  }
+
+  function handlePacket(ws, header, body) {
+    switch (header >> 4) {
+      case 2: // CONNACK
+        if (body[1] !== 0) {
+          setLiveStatus("Connection refused, return code " + body[1], true);
+          ws.close();
+          return;
+        }
+        ws.send(packet(0x82, [0, 1].concat(utf8($("live-filter").value), [0])));
+        setLiveStatus("Subscribed to " + $("live-filter").value);
+        break;
+      case 9: // SUBACK
+        if (body[2] === 0x80) {
+          setLiveStatus("Subscription refused", true);
+          ws.close();
+        }
+        break;
+      case 3: // PUBLISH
+        var topicLen = (body[0] << 8) | body[1];
+        var qos = (header >> 1) & 3;
+        var offset = 2 + topicLen + (qos ? 2 : 0);
+        addLiveMessage(
+          new TextDecoder().decode(body.subarray(2, 2 + topicLen)),
+          new TextDecoder().decode(body.subarray(offset)),
+          qos, header & 1
+        );
+        break;
+    }
+  }
+
+  function addLiveMessage(topic, payload, qos, retain) {
+    var body = $("live");
+    body.insertBefore(el("tr", {}, [
+      el("td", { text: new Date().toLocaleTimeString() }),
+      el("td", { text: topic }),
+      el("td", { text: String(qos) }),
+      el("td", { text: retain ? "yes" : "" }),
+      el("td", { "class": "payload", text: preview(payload) })
+    ]), body.firstChild);
+    while (body.children.length > MAX_LIVE_ROWS) { body.removeChild(body.lastChild); }
+  }
+
+  // Bootstrap
+
+  $("client-search").oninput = renderClients;
+  $("tree-form").onsubmit = function (e) { e.preventDefault(); refreshTree(); };
+  $("publish-form").onsubmit = publish;
+  $("live-form").onsubmit = toggleLive;
+
+  api("GET", "/dashboard/config").then(function (c) {
+    config = c;
+    $("version").textContent = c.Version;
+  });
+
+  refreshStats();
+  refreshClients();
+  refreshTree();
+  setInterval(refreshStats, POLL_INTERVAL);
+  setInterval(refreshClients, POLL_INTERVAL * 2);
+})();
+</script>
+</body>
+</html>
+`
@@ -46,45 +46,17 @@ func extractConnectFlags(b byte) (connectFlags, error) {
 
 var noopPublishFlags = publishFlags{}
 
-func extractPublishFlags(bits string) (publishFlags, error) {
-	var (
-		qos, dup byte
-		retain   bool
-	)
-
-	switch bits[1:3] {
-	case "00":
-		qos = 0
-	case "01":
-		qos = 1
-	case "10":
-		qos = 2
-	default:
-		return noopPublishFlags, errors.New("invalid flags in publish packet")
-	}
-
-	switch bits[3:] {
-	case "0":
-		retain = false
-	case "1":
-		retain = true
-	default:
-		return noopPublishFlags, errors.New("invalid flags in publish packet")
-	}
-
-	switch bits[0:1] {
-	case "0":
-		dup = 0
-	case "1":
-		dup = 1
-	default:
+// extractPublishFlags extracts the flags of a PUBLISH packet from the low nibble of its first byte.
+func extractPublishFlags(flags byte) (publishFlags, error) {
+	qos := flags >> 1 & 0x03
+	if qos > 2 { // as per [MQTT-3.3.1-4]
 		return noopPublishFlags, errors.New("invalid flags in publish packet")
 	}
 
 	return publishFlags{
-		DUP:    dup,
+		DUP:    flags >> 3 & 0x01,
 		QoS:    qos,
-		Retain: retain,
+		Retain: flags&0x01 != 0,
 	}, nil
 }
 
@@ -97,7 +69,8 @@ func extractSubTopicFilters(payload []byte) ([]filter, error) {
 		lenBytesEnd := parsedBytes + 2
 		topicLen := int(binary.BigEndian.Uint16(payload[parsedBytes:lenBytesEnd]))
 		topicNameEnd := lenBytesEnd + topicLen
-		topicFilter := payload[lenBytesEnd:topicNameEnd]
+		// copied out of the packet buffer, which is reused, as the Topic Tree and plugins keep the filters
+		topicFilter := append([]byte(nil), payload[lenBytesEnd:topicNameEnd]...)
 		qos := payload[topicNameEnd : topicNameEnd+1][0]
 
 		if qos < 0 && qos > 2 {
@@ -124,7 +97,7 @@ func extractUnSubTopicFilters(payload []byte) ([][]byte, error) {
 	for parsedBytes < payloadLen {
 		lenBytesEnd := parsedBytes + 2
 		topicLen := int(binary.BigEndian.Uint16(payload[parsedBytes:lenBytesEnd]))
-		topicFilter := payload[lenBytesEnd : lenBytesEnd+topicLen]
+		topicFilter := append([]byte(nil), payload[lenBytesEnd:lenBytesEnd+topicLen]...)
 
 		filterList = append(filterList, topicFilter)
 
@@ -138,7 +111,6 @@ func extractUnSubTopicFilters(payload []byte) ([][]byte, error) {
 	return filterList, nil
 }
 
-func parseFixedHeaderFirstByte(b byte) (byte, string) {
-	bs := bytes.ByteToBinaryString(b)
-	return b >> 4, bs[4:] // packet type and flags bits (eg. 1101)
+func parseFixedHeaderFirstByte(b byte) (byte, byte) {
+	return b >> 4, b & 0x0F // packet type and flags bits (eg. 1101)
 }
@@ -0,0 +1,735 @@
+// Command gottctl operates a running GOTT broker through its admin API.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `Usage: gottctl [flags] <command> [args]
+
+Commands:
+  clients list
+  clients kick <client id>
+  sessions list
+  sessions show <client id>
+  sessions delete <client id>
+  subs list [--client <client id>]
+  retained get --topic <topic>
+  retained set --topic <topic> [--qos <qos>] [--payload <payload>]  (reads stdin if --payload is omitted)
+  retained clear --topic <topic>
+  plugins list
+  plugins load <file> [--config <json>]
+  plugins enable <file>
+  plugins disable <file>
+  plugins config <file> [--config <json>]  (reads stdin if --config is omitted)
+  stats
+  store                   (session store size, records and corrupt sessions)
+  store verify
+  store repair
+  store gc
+  backup [--format binary|json] [--plaintext] [--output <file>]  (writes to stdout if --output is omitted)
+  trace [--client <client id>] [--topic <topic filter>] [--duration <duration>]
+
+Flags:
+`
+
+type ctl struct {
+	client   *http.Client
+	baseURL  string
+	token    string
+	user     string
+	password string
+	output   string
+	out      io.Writer
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+
+	addr := flag.String("addr", envOr("GOTT_ADMIN_ADDR", "http://localhost:8090"), "admin API address (env GOTT_ADMIN_ADDR)")
+	socket := flag.String("socket", os.Getenv("GOTT_ADMIN_SOCKET"), "admin API unix socket, takes precedence over -addr (env GOTT_ADMIN_SOCKET)")
+	token := flag.String("token", os.Getenv("GOTT_ADMIN_TOKEN"), "admin API token (env GOTT_ADMIN_TOKEN)")
+	user := flag.String("user", os.Getenv("GOTT_ADMIN_USER"), "admin API basic auth username (env GOTT_ADMIN_USER)")
+	password := flag.String("password", os.Getenv("GOTT_ADMIN_PASSWORD"), "admin API basic auth password (env GOTT_ADMIN_PASSWORD)")
+	output := flag.String("o", "table", "output format, table or json")
+	flag.Parse()
+
+	if *output != "table" && *output != "json" {
+		fail(fmt.Errorf("unknown output format %q", *output))
+	}
+
+	c := &ctl{
+		client:   &http.Client{Timeout: 30 * time.Second},
+		baseURL:  strings.TrimRight(*addr, "/"),
+		token:    *token,
+		user:     *user,
+		password: *password,
+		output:   *output,
+		out:      os.Stdout,
+	}
+
+	if *socket != "" {
+		c.baseURL = "http://unix"
+		c.client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", *socket)
+			},
+		}
+	}
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := c.run(args); err != nil {
+		fail(err)
+	}
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "gottctl:", err)
+	os.Exit(1)
+}
+
+var errUsage = errors.New("invalid command, run gottctl -h for usage")
+
+func (c *ctl) run(args []string) error {
+	switch args[0] {
+	case "trace":
+		return c.trace(args[1:])
+	case "backup":
+		return c.backup(args[1:])
+	}
+
+	if len(args) == 1 {
+		switch args[0] {
+		case "stats":
+			return c.stats()
+		case "store":
+			return c.store(http.MethodGet, "/api/store")
+		}
+		return errUsage
+	}
+
+	command, action := args[0], args[1]
+	switch command + " " + action {
+	case "clients list":
+		return c.clientsList()
+	case "clients kick":
+		id, err := argAt(args, 2)
+		if err != nil {
+			return err
+		}
+		return c.do(http.MethodDelete, "/api/clients/"+url.PathEscape(id), nil, nil)
+	case "sessions list":
+		return c.sessionsList()
+	case "sessions show":
+		id, err := argAt(args, 2)
+		if err != nil {
+			return err
+		}
+		return c.sessionsShow(id)
+	case "sessions delete":
+		id, err := argAt(args, 2)
+		if err != nil {
+			return err
+		}
+		return c.do(http.MethodDelete, "/api/sessions/"+url.PathEscape(id), nil, nil)
+	case "subs list":
+		fs := flag.NewFlagSet("subs list", flag.ExitOnError)
+		client := fs.String("client", "", "client id")
+		_ = fs.Parse(args[2:])
+		return c.subsList(*client)
+	case "retained get", "retained set", "retained clear":
+		return c.retained(action, args[2:])
+	case "plugins list":
+		return c.pluginsList()
+	case "plugins load", "plugins enable", "plugins disable", "plugins config":
+		return c.plugins(action, args[2:])
+	case "store gc":
+		return c.store(http.MethodPost, "/api/store/gc")
+	case "store verify":
+		return c.storeVerify(http.MethodGet, "/api/store/verify")
+	case "store repair":
+		return c.storeVerify(http.MethodPost, "/api/store/repair")
+	}
+
+	return errUsage
+}
+
+func argAt(args []string, i int) (string, error) {
+	if len(args) <= i || args[i] == "" {
+		return "", errUsage
+	}
+	return args[i], nil
+}
+
+// send sends a request to the admin API and returns the response if it succeeded.
+func (c *ctl) send(method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	} else if c.user != "" {
+		req.SetBasicAuth(c.user, c.password)
+	}
+	req.Header.Set("X-Requested-With", "gottctl")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var apiErr struct{ Error string }
+		if json.NewDecoder(resp.Body).Decode(&apiErr) == nil && apiErr.Error != "" {
+			return nil, fmt.Errorf("%s (%d)", apiErr.Error, resp.StatusCode)
+		}
+		return nil, fmt.Errorf("unexpected response status %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// do sends a request to the admin API and decodes the JSON response into out if not nil.
+// With the json output format the response is printed as is instead.
+func (c *ctl) do(method, path string, body io.Reader, out interface{}) error {
+	resp, err := c.send(method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+
+	if c.output == "json" {
+		var pretty bytes.Buffer
+		if err := json.Indent(&pretty, data, "", "  "); err != nil {
+			return err
+		}
+		fmt.Fprintln(c.out, pretty.String())
+		return nil
+	}
+
+	return json.Unmarshal(data, out)
+}
+
+func (c *ctl) table(header ...string) *tabwriter.Writer {
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	return w
+}
+
+func row(w io.Writer, cols ...interface{}) {
+	strs := make([]string, len(cols))
+	for i, col := range cols {
+		strs[i] = fmt.Sprint(col)
+	}
+	fmt.Fprintln(w, strings.Join(strs, "\t"))
+}
+
+// preview shortens a payload to keep tables readable.
+func preview(payload []byte) string {
+	const max = 40
+	s := strconv.Quote(string(payload))
+	if len(s) > max {
+		return s[:max-3] + "..."
+	}
+	return s
+}
+
+type subscriptionInfo struct {
+	ClientID string
+	Filter   string
+	QoS      byte
+}
+
+type clientInfo struct {
+	ClientID, Username  string
+	RemoteAddr          string
+	Transport           string
+	ProtocolVersion     byte
+	KeepAlive           int
+	CleanSession        bool
+	ConnectedAt         time.Time
+	Subscriptions       []subscriptionInfo
+	Listener, LocalAddr string
+}
+
+func (c *ctl) clientsList() error {
+	var clients []clientInfo
+	if err := c.do(http.MethodGet, "/api/clients", nil, &clients); err != nil || clients == nil {
+		return err
+	}
+
+	w := c.table("CLIENT ID", "USERNAME", "REMOTE ADDR", "TRANSPORT", "KEEP ALIVE", "CLEAN", "CONNECTED AT", "SUBS")
+	for _, cl := range clients {
+		row(w, cl.ClientID, cl.Username, cl.RemoteAddr, cl.Transport, cl.KeepAlive, cl.CleanSession, cl.ConnectedAt.Format(time.RFC3339), len(cl.Subscriptions))
+	}
+	return w.Flush()
+}
+
+type queuedMessage struct {
+	PacketID uint16
+	Topic    string
+	Payload  []byte
+	QoS      byte
+	Status   int32
+	QueuedAt *time.Time
+}
+
+type queueStats struct {
+	Messages int
+	Bytes    int
+	Dropped  int64
+}
+
+type sessionInfo struct {
+	ID             string
+	Connected      bool
+	QueuedMessages int
+	Queue          queueStats
+	ExpiresAt      *time.Time
+	Messages       []queuedMessage
+}
+
+func (s sessionInfo) expires() string {
+	if s.ExpiresAt == nil {
+		return "-"
+	}
+	return s.ExpiresAt.Local().Format(time.RFC3339)
+}
+
+func (c *ctl) sessionsList() error {
+	var sessions []sessionInfo
+	if err := c.do(http.MethodGet, "/api/sessions", nil, &sessions); err != nil || sessions == nil {
+		return err
+	}
+
+	w := c.table("CLIENT ID", "CONNECTED", "QUEUED", "DROPPED", "EXPIRES")
+	for _, s := range sessions {
+		row(w, s.ID, s.Connected, s.QueuedMessages, s.Queue.Dropped, s.expires())
+	}
+	return w.Flush()
+}
+
+func (c *ctl) sessionsShow(id string) error {
+	var s *sessionInfo
+	if err := c.do(http.MethodGet, "/api/sessions/"+url.PathEscape(id), nil, &s); err != nil || s == nil {
+		return err
+	}
+
+	fmt.Fprintf(c.out, "Client ID: %s\nConnected: %v\nQueued:    %d\nOffline:   %d messages, %d bytes, %d dropped\nExpires:   %s\n\n",
+		s.ID, s.Connected, s.QueuedMessages, s.Queue.Messages, s.Queue.Bytes, s.Queue.Dropped, s.expires())
+
+	w := c.table("PACKET ID", "TOPIC", "QOS", "STATUS", "PAYLOAD")
+	for _, m := range s.Messages {
+		if m.QueuedAt != nil {
+			row(w, "-", m.Topic, m.QoS, "queued", preview(m.Payload))
+			continue
+		}
+		row(w, m.PacketID, m.Topic, m.QoS, m.Status, preview(m.Payload))
+	}
+	return w.Flush()
+}
+
+type retainedMessage struct {
+	Topic     string
+	Payload   []byte
+	QoS       byte
+	Timestamp time.Time
+}
+
+type topicLevelInfo struct {
+	Path          string
+	Subscriptions []subscriptionInfo
+	Retained      *retainedMessage
+}
+
+func (c *ctl) subsList(clientID string) error {
+	var subs []subscriptionInfo
+
+	if clientID != "" {
+		if err := c.do(http.MethodGet, "/api/topics?client="+url.QueryEscape(clientID), nil, &subs); err != nil || subs == nil {
+			return err
+		}
+	} else {
+		var levels []topicLevelInfo
+		if err := c.do(http.MethodGet, "/api/topics", nil, &levels); err != nil || levels == nil {
+			return err
+		}
+		for _, l := range levels {
+			subs = append(subs, l.Subscriptions...)
+		}
+	}
+
+	w := c.table("CLIENT ID", "FILTER", "QOS")
+	for _, s := range subs {
+		row(w, s.ClientID, s.Filter, s.QoS)
+	}
+	return w.Flush()
+}
+
+func (c *ctl) retained(action string, args []string) error {
+	fs := flag.NewFlagSet("retained "+action, flag.ExitOnError)
+	topic := fs.String("topic", "", "topic name")
+	qos := fs.Int("qos", 0, "QoS of the retained message (set only)")
+	payload := fs.String("payload", "", "payload of the retained message, read from stdin if omitted (set only)")
+	_ = fs.Parse(args)
+
+	if *topic == "" {
+		return errors.New("--topic is required")
+	}
+	path := "/api/retained?topic=" + url.QueryEscape(*topic)
+
+	switch action {
+	case "get":
+		var msg *retainedMessage
+		if err := c.do(http.MethodGet, path, nil, &msg); err != nil || msg == nil {
+			return err
+		}
+		fmt.Fprintf(c.out, "Topic:     %s\nQoS:       %d\nTimestamp: %s\nPayload:   %s\n", msg.Topic, msg.QoS, msg.Timestamp.Format(time.RFC3339), msg.Payload)
+		return nil
+	case "set":
+		var body io.Reader = strings.NewReader(*payload)
+		if !flagPassed(fs, "payload") {
+			body = os.Stdin
+		}
+		return c.do(http.MethodPut, path+"&qos="+strconv.Itoa(*qos), body, nil)
+	default:
+		return c.do(http.MethodDelete, path, nil, nil)
+	}
+}
+
+func flagPassed(fs *flag.FlagSet, name string) (passed bool) {
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			passed = true
+		}
+	})
+	return
+}
+
+type pluginInfo struct {
+	File, Name, Version string
+	APIVersion          int
+	Hooks               []string
+	Enabled             bool
+}
+
+func (c *ctl) pluginsList() error {
+	var plugins []pluginInfo
+	if err := c.do(http.MethodGet, "/api/plugins", nil, &plugins); err != nil || plugins == nil {
+		return err
+	}
+
+	w := c.table("FILE", "NAME", "VERSION", "API", "ENABLED", "HOOKS")
+	for _, p := range plugins {
+		row(w, p.File, p.Name, p.Version, p.APIVersion, p.Enabled, strings.Join(p.Hooks, ","))
+	}
+	return w.Flush()
+}
+
+func (c *ctl) plugins(action string, args []string) error {
+	file, err := argAt(args, 0)
+	if err != nil {
+		return err
+	}
+	fs := flag.NewFlagSet("plugins "+action, flag.ExitOnError)
+	config := fs.String("config", "", "plugin config as a JSON object")
+	_ = fs.Parse(args[1:])
+
+	switch action {
+	case "load":
+		conf := json.RawMessage("null")
+		if *config != "" {
+			conf = json.RawMessage(*config)
+		}
+		body, err := json.Marshal(struct {
+			Name   string
+			Config json.RawMessage
+		}{file, conf})
+		if err != nil {
+			return err
+		}
+		return c.do(http.MethodPost, "/api/plugins", bytes.NewReader(body), nil)
+	case "config":
+		var body io.Reader = os.Stdin
+		if *config != "" {
+			body = strings.NewReader(*config)
+		}
+		return c.do(http.MethodPut, "/api/plugins/"+url.PathEscape(file)+"/config", body, nil)
+	default:
+		return c.do(http.MethodPost, "/api/plugins/"+url.PathEscape(file)+"/"+action, nil, nil)
+	}
+}
+
+func (c *ctl) stats() error {
+	var stats map[string]interface{}
+	if err := c.do(http.MethodGet, "/api/stats", nil, &stats); err != nil || stats == nil {
+		return err
+	}
+
+	w := c.table("STAT", "VALUE")
+	for _, key := range []string{
+		"Version", "Uptime", "ClientsConnected", "ClientsByTransport", "Sessions", "Subscriptions", "TopicLevels",
+		"RetainedMessages", "InflightMessages", "MessagesReceived", "MessagesSent", "PublishReceived", "PublishSent",
+		"BytesReceived", "BytesSent",
+	} {
+		row(w, key, stats[key])
+	}
+	return w.Flush()
+}
+
+type storeProblem struct {
+	ClientID string
+	Kind     string
+	Key      string
+	Error    string
+	Time     time.Time
+}
+
+type storeStats struct {
+	Backend                   string
+	Path                      string
+	DiskSize                  int64
+	Encrypted                 bool
+	KeyID                     string
+	Keys, Sessions            int
+	Inflight, Inbound, Queued int
+	Subscriptions, Retained   int
+	Corrupt                   []storeProblem
+	LastGC, LastCompaction    *time.Time
+	LastError                 string
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
+
+func (c *ctl) store(method, path string) error {
+	var stats *storeStats
+	if err := c.do(method, path, nil, &stats); err != nil || stats == nil {
+		return err
+	}
+
+	w := c.table("STAT", "VALUE")
+	row(w, "Backend", stats.Backend)
+	if stats.Path != "" {
+		row(w, "Path", stats.Path)
+	}
+	row(w, "DiskSize", stats.DiskSize)
+	row(w, "Encrypted", stats.Encrypted)
+	if stats.KeyID != "" {
+		row(w, "KeyID", stats.KeyID)
+	}
+	row(w, "Keys", stats.Keys)
+	row(w, "Sessions", stats.Sessions)
+	row(w, "Inflight", stats.Inflight)
+	row(w, "Inbound", stats.Inbound)
+	row(w, "Queued", stats.Queued)
+	row(w, "Subscriptions", stats.Subscriptions)
+	row(w, "Retained", stats.Retained)
+	row(w, "LastGC", formatTime(stats.LastGC))
+	row(w, "LastCompaction", formatTime(stats.LastCompaction))
+	if stats.LastError != "" {
+		row(w, "LastError", stats.LastError)
+	}
+	if err := w.Flush(); err != nil || len(stats.Corrupt) == 0 {
+		return err
+	}
+
+	fmt.Fprintln(c.out, "\nCorrupt sessions:")
+	w = c.table("CLIENT ID", "TIME", "ERROR")
+	for _, p := range stats.Corrupt {
+		row(w, p.ClientID, p.Time.Local().Format(time.RFC3339), p.Error)
+	}
+	return w.Flush()
+}
+
+func (c *ctl) storeVerify(method, path string) error {
+	var report *struct {
+		Keys, Sessions    int
+		Problems          []storeProblem
+		Repaired, Skipped int
+	}
+	if err := c.do(method, path, nil, &report); err != nil || report == nil {
+		return err
+	}
+
+	if len(report.Problems) > 0 {
+		w := c.table("CLIENT ID", "KIND", "KEY", "ERROR")
+		for _, p := range report.Problems {
+			row(w, p.ClientID, p.Kind, p.Key, p.Error)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(c.out, "%d keys, %d sessions, %d problems", report.Keys, report.Sessions, len(report.Problems))
+	if method == http.MethodPost {
+		fmt.Fprintf(c.out, ", %d records deleted, %d skipped for connected clients", report.Repaired, report.Skipped)
+	}
+	fmt.Fprintln(c.out)
+	return nil
+}
+
+// backup saves a snapshot taken by the broker to a file or stdout.
+func (c *ctl) backup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	format := fs.String("format", "binary", "snapshot format, binary or json")
+	output := fs.String("output", "", "file to write the snapshot to")
+	plaintext := fs.Bool("plaintext", false, "allow a JSON snapshot of an encrypted store, which is written decrypted")
+	_ = fs.Parse(args)
+
+	path := "/api/backup?format=" + url.QueryEscape(*format)
+	if *plaintext {
+		path += "&plaintext=true"
+	}
+	// large stores take longer than the default request timeout
+	c.client.Timeout = 0
+	resp, err := c.send(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if *output == "" {
+		_, err = io.Copy(c.out, resp.Body)
+		return err
+	}
+
+	f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, resp.Body); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(*output)
+	}
+	return err
+}
+
+type tracedPacket struct {
+	Time                time.Time
+	ClientID, Direction string
+	Type                string
+	Size                int
+	PacketID            uint16
+	Topic               string
+	Filters             []string
+	QoS                 byte
+	Retain, DUP         bool
+	PayloadSize         int
+	Payload             string
+	PayloadHex          bool
+}
+
+// trace prints the packets streamed by the broker until the trace ends or gottctl is interrupted.
+func (c *ctl) trace(args []string) error {
+	fs := flag.NewFlagSet("trace", flag.ExitOnError)
+	client := fs.String("client", "", "client id to trace")
+	topic := fs.String("topic", "", "topic filter to trace")
+	duration := fs.Duration("duration", time.Minute, "duration of the trace")
+	_ = fs.Parse(args)
+
+	query := url.Values{}
+	query.Set("client", *client)
+	query.Set("topic", *topic)
+	query.Set("duration", duration.String())
+
+	// the trace outlives the default request timeout
+	c.client.Timeout = 0
+	resp, err := c.send(http.MethodGet, "/api/trace?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if c.output == "json" {
+			fmt.Fprintln(c.out, scanner.Text())
+			continue
+		}
+
+		var p tracedPacket
+		if err := json.Unmarshal(scanner.Bytes(), &p); err != nil {
+			return err
+		}
+		fmt.Fprintln(c.out, formatTracedPacket(p))
+	}
+	return scanner.Err()
+}
+
+func formatTracedPacket(p tracedPacket) string {
+	arrow := "->"
+	if p.Direction == "out" {
+		arrow = "<-"
+	}
+
+	line := fmt.Sprintf("%s %s %s %-11s %5dB", p.Time.Format("15:04:05.000"), p.ClientID, arrow, p.Type, p.Size)
+	if p.PacketID != 0 {
+		line += fmt.Sprintf(" id=%d", p.PacketID)
+	}
+	if p.Type == "publish" {
+		line += fmt.Sprintf(" qos=%d retain=%v dup=%v topic=%q", p.QoS, p.Retain, p.DUP, p.Topic)
+		payload := strconv.Quote(p.Payload)
+		if p.PayloadHex {
+			payload = "hex:" + p.Payload
+		}
+		line += fmt.Sprintf(" payload(%dB)=%s", p.PayloadSize, payload)
+	}
+	if len(p.Filters) > 0 {
+		line += " filters=" + strings.Join(p.Filters, ",")
+	}
+	return line
+}
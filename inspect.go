@@ -0,0 +1,382 @@
+package gott
+
+import (
+	gob "bytes"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Errors returned by the inspection and management methods of the Broker.
+var (
+	ErrClientNotFound   = errors.New("client not found")
+	ErrSessionNotFound  = errors.New("session not found")
+	ErrSessionInUse     = errors.New("session is in use by a connected client")
+	ErrRetainedNotFound = errors.New("retained message not found")
+	ErrInvalidTopicName = errors.New("invalid topic name")
+	ErrInvalidQoS       = errors.New("invalid QoS")
+)
+
+// ClientInfo is a snapshot of a connected client.
+type ClientInfo struct {
+	ClientID, Username    string
+	RemoteAddr, LocalAddr string
+	Listener, Transport   string
+	ProtocolVersion       byte
+	KeepAlive             int
+	CleanSession          bool
+	ConnectedAt           time.Time
+	Subscriptions         []SubscriptionInfo
+}
+
+// SubscriptionInfo describes a single subscription in the Topic Tree.
+type SubscriptionInfo struct {
+	ClientID string
+	Filter   string
+	QoS      byte
+}
+
+// SessionInfo is a snapshot of a persistent session in the session store.
+type SessionInfo struct {
+	ID             string
+	Connected      bool
+	QueuedMessages int             // inflight and queued messages
+	Queue          QueueStats      // messages published while the client was offline
+	ExpiresAt      *time.Time      `json:",omitempty"` // set for disconnected clients when sessions expire
+	Messages       []QueuedMessage `json:",omitempty"`
+}
+
+// QueuedMessage is a message waiting in a session to be delivered or acknowledged.
+// Messages still in the offline queue have no packet identifier yet.
+type QueuedMessage struct {
+	PacketID uint16
+	Topic    string
+	Payload  []byte
+	QoS      byte
+	Status   int32
+	QueuedAt *time.Time `json:",omitempty"`
+}
+
+// RetainedMessage is a message retained on a topic.
+type RetainedMessage struct {
+	Topic     string
+	Payload   []byte
+	QoS       byte
+	Timestamp time.Time
+}
+
+// TopicLevelInfo describes a level of the Topic Tree.
+type TopicLevelInfo struct {
+	Path          string
+	Subscriptions []SubscriptionInfo
+	Retained      *RetainedMessage `json:",omitempty"`
+}
+
+func (b *Broker) getClient(clientID string) *Client {
+	return b.clients.get(clientID)
+}
+
+func (b *Broker) clientInfo(c *Client) ClientInfo {
+	conn := c.ConnInfo()
+	info := ClientInfo{
+		ClientID:        conn.ClientID,
+		Username:        conn.Username,
+		Listener:        conn.Listener,
+		Transport:       conn.Transport,
+		ProtocolVersion: conn.ProtocolVersion,
+		KeepAlive:       conn.KeepAlive,
+		CleanSession:    conn.CleanSession,
+		ConnectedAt:     c.connectedAt,
+		Subscriptions:   b.ClientSubscriptions(c.ClientID),
+	}
+	if conn.RemoteAddr != nil {
+		info.RemoteAddr = conn.RemoteAddr.String()
+	}
+	if conn.LocalAddr != nil {
+		info.LocalAddr = conn.LocalAddr.String()
+	}
+	return info
+}
+
+// Clients returns a snapshot of all the connected clients sorted by client ID.
+func (b *Broker) Clients() []ClientInfo {
+	clients := make([]*Client, 0, b.clients.len())
+	b.clients.forEach(func(c *Client) {
+		clients = append(clients, c)
+	})
+
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ClientID < clients[j].ClientID
+	})
+
+	infos := make([]ClientInfo, 0, len(clients))
+	for _, c := range clients {
+		infos = append(infos, b.clientInfo(c))
+	}
+	return infos
+}
+
+// Client returns a snapshot of a connected client.
+func (b *Broker) Client(clientID string) (ClientInfo, error) {
+	c := b.getClient(clientID)
+	if c == nil {
+		return ClientInfo{}, ErrClientNotFound
+	}
+	return b.clientInfo(c), nil
+}
+
+// DisconnectClient forcibly closes the connection of a connected client.
+// The Will Message of the client is published as in any non graceful disconnection.
+func (b *Broker) DisconnectClient(clientID string) error {
+	c := b.getClient(clientID)
+	if c == nil {
+		return ErrClientNotFound
+	}
+
+	c.setDisconnectReason(DisconnectKicked)
+	c.closeConnection()
+	return nil
+}
+
+// ClientSubscriptions returns the subscriptions of a client, connected or not, sorted by filter.
+func (b *Broker) ClientSubscriptions(clientID string) []SubscriptionInfo {
+	subs := make([]SubscriptionInfo, 0)
+	b.TopicFilterStorage.walk(func(tl *topicLevel) {
+		tl.Subscriptions.Range(func(i int, sub *subscription) bool {
+			if sub.Session.ID == clientID {
+				subs = append(subs, SubscriptionInfo{ClientID: clientID, Filter: tl.Path(), QoS: sub.QoS})
+				return false
+			}
+			return true
+		})
+	})
+
+	sort.Slice(subs, func(i, j int) bool {
+		return subs[i].Filter < subs[j].Filter
+	})
+	return subs
+}
+
+// TopicTree returns every level of the Topic Tree and every retained topic whose path starts with prefix, sorted by path.
+func (b *Broker) TopicTree(prefix string) []TopicLevelInfo {
+	infos := make(map[string]*TopicLevelInfo)
+	info := func(path string) *TopicLevelInfo {
+		if infos[path] == nil {
+			infos[path] = &TopicLevelInfo{Path: path, Subscriptions: make([]SubscriptionInfo, 0)}
+		}
+		return infos[path]
+	}
+
+	b.TopicFilterStorage.walk(func(tl *topicLevel) {
+		path := tl.Path()
+		if !strings.HasPrefix(path, prefix) {
+			return
+		}
+
+		level := info(path)
+		tl.Subscriptions.Range(func(i int, sub *subscription) bool {
+			level.Subscriptions = append(level.Subscriptions, SubscriptionInfo{ClientID: sub.Session.ID, Filter: path, QoS: sub.QoS})
+			return true
+		})
+	})
+
+	b.RetainedStore.forEach(func(msg *message) {
+		if topic := string(msg.Topic); strings.HasPrefix(topic, prefix) {
+			info(topic).Retained = newRetainedMessage(msg)
+		}
+	})
+
+	levels := make([]TopicLevelInfo, 0, len(infos))
+	for _, level := range infos {
+		levels = append(levels, *level)
+	}
+	sort.Slice(levels, func(i, j int) bool {
+		return levels[i].Path < levels[j].Path
+	})
+	return levels
+}
+
+func newRetainedMessage(msg *message) *RetainedMessage {
+	return &RetainedMessage{
+		Topic:     string(msg.Topic),
+		Payload:   msg.Payload,
+		QoS:       msg.QoS,
+		Timestamp: msg.Timestamp,
+	}
+}
+
+// RetainedMessage returns the message retained on a topic.
+func (b *Broker) RetainedMessage(topic string) (*RetainedMessage, error) {
+	msg := b.RetainedStore.get([]byte(topic))
+	if msg == nil {
+		return nil, ErrRetainedNotFound
+	}
+	return newRetainedMessage(msg), nil
+}
+
+// SetRetainedMessage retains a message on a topic without publishing it to the current subscribers.
+func (b *Broker) SetRetainedMessage(topic string, payload []byte, qos byte) error {
+	if !validTopicName([]byte(topic)) {
+		return ErrInvalidTopicName
+	}
+	if qos > 2 {
+		return ErrInvalidQoS
+	}
+	if len(payload) == 0 {
+		return b.ClearRetainedMessage(topic)
+	}
+
+	b.Retain(&message{
+		Topic:     []byte(topic),
+		Payload:   payload,
+		QoS:       qos,
+		Timestamp: time.Now(),
+	}, []byte(topic))
+	return nil
+}
+
+// ClearRetainedMessage removes the message retained on a topic.
+func (b *Broker) ClearRetainedMessage(topic string) error {
+	if _, err := b.RetainedMessage(topic); err != nil {
+		return err
+	}
+	b.Retain(nil, []byte(topic))
+	return nil
+}
+
+// PublishMessage publishes a message to the current subscribers of a topic as if a client had published it.
+// Topics reserved for the broker, starting with $, are rejected.
+func (b *Broker) PublishMessage(topic string, payload []byte, qos byte, retain bool) error {
+	if !validTopicName([]byte(topic)) || isReservedTopic([]byte(topic)) {
+		return ErrInvalidTopicName
+	}
+	if qos > 2 {
+		return ErrInvalidQoS
+	}
+
+	b.Publish([]byte(topic), payload, publishFlags{QoS: qos, Retain: retain})
+	return nil
+}
+
+// Sessions returns a snapshot of all the persistent sessions in the session store without their messages.
+func (b *Broker) Sessions() ([]SessionInfo, error) {
+	infos := make([]SessionInfo, 0)
+	err := b.SessionStore.forEach(func(id string, s *session) error {
+		info := b.sessionInfo(id, s)
+		info.Messages = nil
+		infos = append(infos, info)
+		return nil
+	})
+	return infos, err
+}
+
+// Session returns a snapshot of a persistent session including its queued messages.
+func (b *Broker) Session(id string) (SessionInfo, error) {
+	if !b.SessionStore.exists(id) {
+		return SessionInfo{}, ErrSessionNotFound
+	}
+
+	s := newStoredSession(id)
+	if err := b.SessionStore.get(id, s); err != nil {
+		return SessionInfo{}, err
+	}
+	return b.sessionInfo(id, s), nil
+}
+
+func (b *Broker) sessionInfo(id string, s *session) SessionInfo {
+	info := SessionInfo{
+		ID:        id,
+		Connected: b.getClient(id) != nil,
+		Messages:  make([]QueuedMessage, 0),
+	}
+
+	if s.MessageStore != nil {
+		s.MessageStore.RangeSorted(func(packetID uint16, cm *clientMessage) bool {
+			info.Messages = append(info.Messages, QueuedMessage{
+				PacketID: packetID,
+				Topic:    string(cm.Topic),
+				Payload:  cm.Payload,
+				QoS:      cm.QoS,
+				Status:   cm.Status,
+			})
+			return true
+		})
+	}
+
+	if s.Queue != nil {
+		var entries []*queueEntry
+		info.Queue, entries = s.Queue.snapshot()
+		for _, e := range entries {
+			queuedAt := e.QueuedAt
+			info.Messages = append(info.Messages, QueuedMessage{
+				Topic:    string(e.Topic),
+				Payload:  e.Payload,
+				QoS:      e.QoS,
+				QueuedAt: &queuedAt,
+			})
+		}
+	}
+	info.QueuedMessages = len(info.Messages)
+
+	if expiry := b.config.Sessions.Expiry; expiry > 0 && !info.Connected && !s.DisconnectedAt.IsZero() {
+		expiresAt := s.DisconnectedAt.Add(time.Duration(expiry) * time.Second)
+		info.ExpiresAt = &expiresAt
+	}
+
+	return info
+}
+
+// DeleteSession removes a persistent session with its queued messages and its subscriptions.
+// Sessions of connected clients can't be deleted, disconnect the client first.
+func (b *Broker) DeleteSession(id string) error {
+	err := ErrSessionInUse
+	// with the registry shard locked so the client can't connect and load the session while it's deleted
+	b.clients.ifAbsent(id, func() {
+		if !b.SessionStore.exists(id) {
+			err = ErrSessionNotFound
+			return
+		}
+		b.TopicFilterStorage.deleteSessionSubscriptions(id)
+		err = b.SessionStore.delete(id)
+	})
+	return err
+}
+
+// level returns the Topic Level that exactly matches a topic name or filter.
+func (ts *topicStorage) level(topic []byte) *topicLevel {
+	tl := ts.root
+	for _, seg := range gob.Split(topic, topicDelim) {
+		if tl = tl.child(seg); tl == nil {
+			return nil
+		}
+	}
+	return tl
+}
+
+// walk calls fn for every level of the Topic Tree, parents before children.
+func (ts *topicStorage) walk(fn func(tl *topicLevel)) {
+	for _, c := range ts.root.loadChildren() {
+		c.walk(fn)
+	}
+}
+
+// deleteSessionSubscriptions removes all the subscriptions of a session from the Topic Tree.
+func (ts *topicStorage) deleteSessionSubscriptions(id string) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	for _, tl := range ts.subscribed[id] {
+		n := tl.Subscriptions.Len()
+		tl.Subscriptions.RangeDelete(func(i int, sub *subscription, delete func(int)) bool {
+			if sub.Session.ID == id {
+				delete(i)
+				return false
+			}
+			return true
+		})
+		ts.counted(tl, n)
+		ts.prune(tl)
+	}
+	ts.unindexAll(id)
+}
@@ -1,11 +1,32 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"gott"
 	"log"
+	"os"
+	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		replay(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "store" {
+		store(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "backup" {
+		backup(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		restore(os.Args[2:])
+		return
+	}
+
 	broker, err := gott.NewBroker()
 	if err != nil {
 		panic(err)
@@ -15,3 +36,123 @@ func main() {
 		log.Fatalln(err)
 	}
 }
+
+// replay feeds a capture file into a new broker and exits with status 1 if the responses differ.
+func replay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 2*time.Second, "how long to wait for each expected response")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gott replay [-timeout 2s] <capture file>")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	result, err := gott.ReplayCapture(fs.Arg(0), os.Stdout, *timeout)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	fmt.Printf("sent %d frames: %d responses matched, %d mismatched, %d missing, %d extra\n",
+		result.Inbound, result.Matched, result.Mismatched, result.Missing, result.Extra)
+	if result.Differences() > 0 {
+		os.Exit(1)
+	}
+}
+
+// store verifies or repairs the session store while the broker isn't running,
+// and exits with status 1 if problems are left.
+func store(args []string) {
+	if len(args) != 1 || (args[0] != "verify" && args[0] != "repair") {
+		fmt.Fprintln(os.Stderr, "Usage: gott store verify|repair")
+		os.Exit(2)
+	}
+
+	report, err := gott.CheckSessionStore(args[0] == "repair")
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	for _, p := range report.Problems {
+		fmt.Printf("%s\t%s\t%s\t%s\n", p.ClientID, p.Kind, p.Key, p.Error)
+	}
+	fmt.Printf("%d keys, %d sessions, %d problems, %d records deleted\n",
+		report.Keys, report.Sessions, len(report.Problems), report.Repaired)
+	if len(report.Problems) > report.Repaired {
+		os.Exit(1)
+	}
+}
+
+// backup writes a snapshot of the session store and the retained messages while the broker isn't running.
+func backup(args []string) {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	format := fs.String("format", gott.SnapshotBinary, "snapshot format, binary or json")
+	output := fs.String("o", "", "file to write the snapshot to, stdout if empty")
+	plaintext := fs.Bool("plaintext", false, "allow a JSON snapshot of an encrypted store, which is written decrypted")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gott backup [-format binary|json] [-plaintext] [-o <file>]")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	out := os.Stdout
+	if *output != "" {
+		f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		out = f
+	}
+
+	info, err := gott.BackupSessionStore(out, *format, *plaintext)
+	if err == nil && out != os.Stdout {
+		if err = out.Sync(); err == nil {
+			err = out.Close()
+		}
+	}
+	if err != nil {
+		if out != os.Stdout {
+			_ = os.Remove(*output)
+		}
+		log.Fatalln(err)
+	}
+
+	fmt.Fprintf(os.Stderr, "wrote a %s snapshot of %d keys: %d sessions and %d retained messages, %d corrupt records skipped\n",
+		info.Format, info.Keys, info.Sessions, info.Retained, info.Skipped)
+}
+
+// restore replaces the session store and the retained messages with a snapshot while the broker isn't running.
+func restore(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	force := fs.Bool("force", false, "replace the content of a session store that isn't empty")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gott restore [-force] <snapshot file>")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer f.Close()
+
+	info, err := gott.RestoreSessionStore(f, *force)
+	if err == gott.ErrStoreNotEmpty {
+		log.Fatalln(err, "- run with -force to replace it")
+	} else if err != nil {
+		log.Fatalln(err)
+	}
+
+	fmt.Printf("restored a %s snapshot taken %s: %d sessions and %d retained messages\n",
+		info.Format, info.Created.Local().Format(time.RFC3339), info.Sessions, info.Retained)
+}
@@ -0,0 +1,269 @@
+package gott
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Overflow policies of the offline queues, applied when a message doesn't fit within the limits.
+const (
+	QueueOverflowDropOldest = "drop_oldest" // the oldest queued messages are dropped to make room
+	QueueOverflowDropNewest = "drop_newest" // the most recently queued messages are dropped to make room
+	QueueOverflowReject     = "reject"      // the new message is dropped
+)
+
+// queueEntry is a message published while a persistent session's client was offline.
+// It gets a packet identifier once it's sent, which keeps the order independent of identifiers wrapping around.
+type queueEntry struct {
+	Topic, Payload []byte
+	QoS            byte
+	QueuedAt       time.Time
+	seq            uint64 // position in the queue of the session, part of the key it's stored under
+}
+
+func (e *queueEntry) size() int {
+	return len(e.Topic) + len(e.Payload)
+}
+
+// messageQueue is the ordered, bounded queue of messages of an offline persistent session.
+type messageQueue struct {
+	Messages []*queueEntry
+	Dropped  int64 // messages dropped because of the limits, including expired ones
+	bytes    int
+	next     uint64 // seq of the next queued message
+	// the session of the connected client once it was sent the queued messages, the messages published
+	// to it are held in the queue until then so they're sent after the CONNACK and in order
+	live  *session
+	gauge *[2]int64 // counts the messages and whether there are any while set
+	mutex sync.Mutex
+}
+
+// QueueStats describes the offline queue of a session.
+type QueueStats struct {
+	Messages int
+	Bytes    int
+	Dropped  int64
+	OldestAt *time.Time `json:",omitempty"`
+}
+
+func newMessageQueue() *messageQueue {
+	return &messageQueue{}
+}
+
+// push appends a message to the queue within the configured limits and assigns its seq.
+// Returns the queued messages that were dropped to make room or expired, and false if e was dropped.
+// write, if set, is called with the results before the lock is released, so the changes of the queue
+// are written to the store in the order they're made.
+func (q *messageQueue) push(e *queueEntry, cnf queueConfig, write func(dropped []*queueEntry, ok bool)) (dropped []*queueEntry, ok bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	n := len(q.Messages)
+	dropped, ok = q.pushLocked(e, cnf)
+	q.count(n, len(q.Messages))
+	if write != nil {
+		write(dropped, ok)
+	}
+	return dropped, ok
+}
+
+// hold is push for a message published to the connected client of the session. It's only queued until the
+// client was sent the queued messages, held is false once it was and the message must be sent directly.
+func (q *messageQueue) hold(e *queueEntry, cnf queueConfig, write func(dropped []*queueEntry, ok bool)) (dropped []*queueEntry, ok, held bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.live != nil {
+		return nil, false, false
+	}
+	n := len(q.Messages)
+	dropped, ok = q.pushLocked(e, cnf)
+	q.count(n, len(q.Messages))
+	if write != nil {
+		write(dropped, ok)
+	}
+	return dropped, ok, true
+}
+
+// pushLocked is push with the lock held.
+func (q *messageQueue) pushLocked(e *queueEntry, cnf queueConfig) (dropped []*queueEntry, ok bool) {
+	dropped = q.expire(cnf, e.QueuedAt)
+
+	// a message bigger than the whole queue never fits
+	if cnf.MaxBytes > 0 && e.size() > cnf.MaxBytes {
+		q.Dropped++
+		return dropped, false
+	}
+
+	for q.full(e, cnf) {
+		var d *queueEntry
+		switch cnf.Overflow {
+		case QueueOverflowDropOldest:
+			d = q.Messages[0]
+			q.Messages[0] = nil
+			q.Messages = q.Messages[1:]
+		case QueueOverflowDropNewest:
+			last := len(q.Messages) - 1
+			d = q.Messages[last]
+			q.Messages[last] = nil
+			q.Messages = q.Messages[:last]
+		default:
+			q.Dropped++
+			return dropped, false
+		}
+		q.bytes -= d.size()
+		q.Dropped++
+		dropped = append(dropped, d)
+	}
+
+	e.seq = q.next
+	q.next++
+	q.Messages = append(q.Messages, e)
+	q.bytes += e.size()
+	return dropped, true
+}
+
+// full checks whether e can't be added without exceeding the limits.
+func (q *messageQueue) full(e *queueEntry, cnf queueConfig) bool {
+	if len(q.Messages) == 0 {
+		return false
+	}
+	return (cnf.MaxMessages > 0 && len(q.Messages) >= cnf.MaxMessages) ||
+		(cnf.MaxBytes > 0 && q.bytes+e.size() > cnf.MaxBytes)
+}
+
+// expire drops and returns the messages queued for longer than the configured max age.
+// The caller must hold the lock.
+func (q *messageQueue) expire(cnf queueConfig, now time.Time) (expired []*queueEntry) {
+	if cnf.MaxAge <= 0 {
+		return nil
+	}
+	maxAge := time.Duration(cnf.MaxAge) * time.Second
+
+	n := 0
+	for n < len(q.Messages) && now.Sub(q.Messages[n].QueuedAt) > maxAge {
+		q.bytes -= q.Messages[n].size()
+		n++
+	}
+	expired = append(expired, q.Messages[:n]...)
+	q.Messages = q.Messages[n:]
+	q.Dropped += int64(n)
+	return
+}
+
+// drain empties the queue and returns its messages, oldest first, and the ones that expired.
+// write, if set, is called with them before the lock is released, as for push.
+func (q *messageQueue) drain(cnf queueConfig, now time.Time, write func(entries, expired []*queueEntry)) (entries, expired []*queueEntry) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.count(len(q.Messages), 0)
+	expired = q.expire(cnf, now)
+	entries = q.Messages
+	q.Messages, q.bytes = nil, 0
+	if write != nil {
+		write(entries, expired)
+	}
+	return
+}
+
+// count updates the gauge once the queue went from n to m messages. The caller must hold the lock.
+func (q *messageQueue) count(n, m int) {
+	if q.gauge == nil {
+		return
+	}
+	atomic.AddInt64(&q.gauge[0], int64(m-n))
+	if n == 0 && m > 0 {
+		atomic.AddInt64(&q.gauge[1], 1)
+	} else if n > 0 && m == 0 {
+		atomic.AddInt64(&q.gauge[1], -1)
+	}
+}
+
+// attachGauge counts the messages in gauge until detachGauge is called, once the queue was loaded.
+func (q *messageQueue) attachGauge(gauge *[2]int64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.gauge = gauge
+	q.count(0, len(q.Messages))
+}
+
+func (q *messageQueue) detachGauge() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.count(len(q.Messages), 0)
+	q.gauge = nil
+}
+
+// deliver marks the queue as sent to the connected client of s if it's empty.
+// Returns false if messages were queued since it was drained.
+func (q *messageQueue) deliver(s *session) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.Messages) > 0 {
+		return false
+	}
+	q.live = s
+	return true
+}
+
+// attach holds the messages published to the session in the queue again, for a client that just connected.
+func (q *messageQueue) attach() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.live = nil
+}
+
+// liveSession returns the session whose connected client was sent the queued messages, nil if there is none.
+func (q *messageQueue) liveSession() *session {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.live != nil && q.live.client != nil && q.live.client.connected.Load() {
+		return q.live
+	}
+	return nil
+}
+
+func (q *messageQueue) dropped() int64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.Dropped
+}
+
+func (q *messageQueue) len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.Messages)
+}
+
+// snapshot returns the queue's stats and a copy of its messages.
+func (q *messageQueue) snapshot() (QueueStats, []*queueEntry) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	stats := QueueStats{Messages: len(q.Messages), Bytes: q.bytes, Dropped: q.Dropped}
+	if len(q.Messages) > 0 {
+		oldest := q.Messages[0].QueuedAt
+		stats.OldestAt = &oldest
+	}
+	return stats, append([]*queueEntry(nil), q.Messages...)
+}
+
+// loaded recomputes what isn't persisted with the queue once its messages are loaded in order.
+func (q *messageQueue) loaded() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.bytes = 0
+	for _, e := range q.Messages {
+		q.bytes += e.size()
+	}
+	if n := len(q.Messages); n > 0 {
+		q.next = q.Messages[n-1].seq + 1
+	}
+}
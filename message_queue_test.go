@@ -0,0 +1,103 @@
+package gott
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMessageQueueHoldUntilDelivered(t *testing.T) {
+	q := newMessageQueue()
+	cnf := queueConfig{}
+	c := &Client{ClientID: "c", connected: newAtomicBool(true)}
+	s := newSession(c, false)
+
+	entry := func(payload string) *queueEntry {
+		return &queueEntry{Payload: []byte(payload), QoS: 1, QueuedAt: time.Now()}
+	}
+
+	if _, ok := q.push(entry("offline"), cnf, nil); !ok {
+		t.Fatal("push")
+	}
+	// messages published to the connected client are held until the queue is found empty
+	if _, ok, held := q.hold(entry("connecting"), cnf, nil); !ok || !held {
+		t.Fatal("not held while the queued messages are sent")
+	}
+	if q.deliver(s) {
+		t.Fatal("delivered with queued messages")
+	}
+	if entries, _ := q.drain(cnf, time.Now(), nil); len(entries) != 2 || string(entries[1].Payload) != "connecting" {
+		t.Fatalf("drained %d messages", len(entries))
+	}
+	if !q.deliver(s) || q.liveSession() != s {
+		t.Fatal("not delivered once empty")
+	}
+	if _, _, held := q.hold(entry("connected"), cnf, nil); held || q.len() != 0 {
+		t.Fatal("held once delivered")
+	}
+
+	c.connected.Store(false)
+	if q.liveSession() != nil {
+		t.Fatal("live session of a disconnected client")
+	}
+
+	q.attach()
+	if _, _, held := q.hold(entry("reconnecting"), cnf, nil); !held {
+		t.Fatal("not held after a client attached")
+	}
+}
+
+// TestMessageQueueWriteOrder checks a message pushed to the queue is written before a client draining it
+// can delete it, which would otherwise bring the deleted record back.
+func TestMessageQueueWriteOrder(t *testing.T) {
+	q := newMessageQueue()
+	writing, written := make(chan struct{}), make(chan struct{})
+	var writes []string
+
+	go q.push(&queueEntry{Payload: []byte("m"), QueuedAt: time.Now()}, queueConfig{}, func(dropped []*queueEntry, ok bool) {
+		close(writing)
+		<-written
+		writes = append(writes, "set")
+	})
+	<-writing
+
+	drained := make(chan []*queueEntry)
+	go func() {
+		entries, _ := q.drain(queueConfig{}, time.Now(), func(entries, expired []*queueEntry) {
+			writes = append(writes, "delete")
+		})
+		drained <- entries
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(written)
+
+	if entries := <-drained; len(entries) != 1 || len(writes) != 2 || writes[0] != "set" {
+		t.Fatalf("drained %d messages, writes %v", len(entries), writes)
+	}
+}
+
+func TestMessageQueueGauge(t *testing.T) {
+	q := newMessageQueue()
+	cnf := queueConfig{MaxMessages: 2}
+	var gauge [2]int64
+
+	q.push(&queueEntry{QueuedAt: time.Now()}, cnf, nil)
+	q.attachGauge(&gauge)
+	if gauge != [2]int64{1, 1} {
+		t.Fatalf("gauge %v once attached", gauge)
+	}
+	for i := 0; i < 3; i++ {
+		q.push(&queueEntry{QueuedAt: time.Now()}, cnf, nil)
+	}
+	if gauge != [2]int64{2, 1} {
+		t.Fatalf("gauge %v once full", gauge)
+	}
+	q.drain(cnf, time.Now(), nil)
+	if gauge != [2]int64{0, 0} {
+		t.Fatalf("gauge %v once drained", gauge)
+	}
+	q.push(&queueEntry{QueuedAt: time.Now()}, cnf, nil)
+	q.detachGauge()
+	if gauge != [2]int64{0, 0} {
+		t.Fatalf("gauge %v once detached", gauge)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type clientMessage struct {
@@ -11,6 +12,7 @@ type clientMessage struct {
 	Topic, Payload []byte
 	QoS, Retain    byte
 	Status         int32
+	StoredAt       int64 // unix nanoseconds, orders the messages independently of their packet identifiers
 }
 
 func (cm *clientMessage) Client() *Client {
@@ -20,6 +22,7 @@ func (cm *clientMessage) Client() *Client {
 type messageStore struct {
 	Messages map[uint16]*clientMessage
 	mutex    sync.RWMutex
+	gauge    *[3]int64 // counts the messages by QoS while set
 }
 
 func newMessageStore() *messageStore {
@@ -28,6 +31,7 @@ func newMessageStore() *messageStore {
 
 func (ms *messageStore) delete(packetID uint16) {
 	ms.mutex.Lock()
+	ms.count(ms.Messages[packetID], -1)
 	delete(ms.Messages, packetID)
 	ms.mutex.Unlock()
 }
@@ -36,9 +40,41 @@ func (ms *messageStore) store(packetID uint16, msg *clientMessage) {
 	ms.mutex.Lock()
 	defer ms.mutex.Unlock()
 
+	if msg.StoredAt == 0 {
+		msg.StoredAt = time.Now().UnixNano()
+	}
+	ms.count(ms.Messages[packetID], -1)
+	ms.count(msg, 1)
 	ms.Messages[packetID] = msg
 }
 
+func (ms *messageStore) count(cm *clientMessage, delta int64) {
+	if ms.gauge != nil && cm != nil && cm.QoS < 3 {
+		atomic.AddInt64(&ms.gauge[cm.QoS], delta)
+	}
+}
+
+// attach counts the messages in gauge until detach is called.
+func (ms *messageStore) attach(gauge *[3]int64) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	ms.gauge = gauge
+	for _, cm := range ms.Messages {
+		ms.count(cm, 1)
+	}
+}
+
+func (ms *messageStore) detach() {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	for _, cm := range ms.Messages {
+		ms.count(cm, -1)
+	}
+	ms.gauge = nil
+}
+
 func (ms *messageStore) acknowledge(packetID uint16, status int32, delete bool) {
 	if cm := ms.get(packetID); cm != nil {
 		atomic.StoreInt32(&cm.Status, status)
@@ -49,6 +85,12 @@ func (ms *messageStore) acknowledge(packetID uint16, status int32, delete bool)
 	}
 }
 
+func (ms *messageStore) len() int {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	return len(ms.Messages)
+}
+
 func (ms *messageStore) get(packetID uint16) *clientMessage {
 	ms.mutex.RLock()
 	defer ms.mutex.RUnlock()
@@ -71,7 +113,7 @@ func (ms *messageStore) Range(iterator func(packetID uint16, cm *clientMessage)
 	}
 }
 
-// RangeSorted iterates over the underlying message store after sorting by key.
+// RangeSorted iterates over the underlying message store in the order the messages were stored.
 func (ms *messageStore) RangeSorted(iterator func(packetID uint16, cm *clientMessage) bool) {
 	ms.mutex.RLock()
 	defer ms.mutex.RUnlock()
@@ -82,6 +124,10 @@ func (ms *messageStore) RangeSorted(iterator func(packetID uint16, cm *clientMes
 	}
 
 	sort.Slice(keys, func(i, j int) bool {
+		a, b := ms.Messages[keys[i]].StoredAt, ms.Messages[keys[j]].StoredAt
+		if a != b {
+			return a < b
+		}
 		return keys[i] < keys[j]
 	})
 
@@ -0,0 +1,34 @@
+package gott
+
+import (
+	"testing"
+)
+
+func TestSessionInflightIsolation(t *testing.T) {
+	var gauge [3]int64
+	a, b := newBenchClient("a"), newBenchClient("b")
+	a.Session.MessageStore.attach(&gauge)
+	b.Session.MessageStore.attach(&gauge)
+
+	// both clients were sent a message with the same packet identifier
+	a.Session.track(1, &clientMessage{Topic: []byte("t"), QoS: 1, client: a})
+	b.Session.track(1, &clientMessage{Topic: []byte("t"), QoS: 2, client: b})
+	if gauge[1] != 1 || gauge[2] != 1 {
+		t.Fatalf("inflight %v", gauge)
+	}
+
+	a.Session.acknowledge(1, StatusPubackReceived, true)
+	if cm := b.Session.MessageStore.get(1); cm == nil || cm.Status != StatusUnacknowledged {
+		t.Fatalf("the PUBACK of a acknowledged the message of b: %+v", cm)
+	}
+	if gauge[1] != 0 || gauge[2] != 1 {
+		t.Fatalf("inflight %v after the PUBACK", gauge)
+	}
+
+	// the messages of a disconnected client are no longer counted, acknowledged or not
+	b.Session.MessageStore.detach()
+	b.Session.acknowledge(1, StatusPubcompReceived, true)
+	if gauge != [3]int64{} {
+		t.Fatalf("inflight %v after the disconnection", gauge)
+	}
+}
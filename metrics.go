@@ -0,0 +1,215 @@
+package gott
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var metrics = &brokerMetrics{
+	sessionStoreLatency: map[string]*histogram{
+		"get":    newHistogram(sessionStoreLatencyBuckets),
+		"set":    newHistogram(sessionStoreLatencyBuckets),
+		"delete": newHistogram(sessionStoreLatencyBuckets),
+	},
+}
+
+var packetTypeNames = [16]string{
+	"reserved", "connect", "connack", "publish", "puback", "pubrec", "pubrel", "pubcomp",
+	"subscribe", "suback", "unsubscribe", "unsuback", "pingreq", "pingresp", "disconnect", "reserved15",
+}
+
+// in seconds
+var sessionStoreLatencyBuckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1}
+
+// brokerMetrics holds the broker's counters. All fields are updated atomically.
+// Gauges are counted as the broker's state changes too, so scrapes never walk the Topic Tree or the session store.
+type brokerMetrics struct {
+	connects, disconnects          int64
+	packetsReceived, bytesReceived [16]int64
+	packetsSent, bytesSent         [16]int64
+	publishes, publishDeliveries   int64
+	retries                        int64
+	inflight                       [3]int64 // outbound messages of connected clients waiting for acknowledgement, by QoS
+	queued                         [2]int64 // messages queued for the sessions in the Topic Tree and sessions with any
+	expiredSessions                int64
+	droppedMessages                int64
+	corruptSessions                int64
+	sessionStoreLatency            map[string]*histogram
+}
+
+func (m *brokerMetrics) packetReceived(packetType byte, size int) {
+	atomic.AddInt64(&m.packetsReceived[packetType&0x0F], 1)
+	atomic.AddInt64(&m.bytesReceived[packetType&0x0F], int64(size))
+}
+
+func (m *brokerMetrics) packetSent(packetType byte, size int) {
+	atomic.AddInt64(&m.packetsSent[packetType], 1)
+	atomic.AddInt64(&m.bytesSent[packetType], int64(size))
+}
+
+func (m *brokerMetrics) sessionStoreOp(op string, start time.Time) {
+	m.sessionStoreLatency[op].observe(time.Since(start).Seconds())
+}
+
+func sumCounters(counters *[16]int64) (sum int64) {
+	for i := range counters {
+		sum += atomic.LoadInt64(&counters[i])
+	}
+	return
+}
+
+// histogram is a fixed buckets histogram safe for concurrent use.
+type histogram struct {
+	buckets []float64
+	counts  []int64
+	count   int64
+	sumNano int64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]int64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range h.buckets {
+		if v <= b {
+			atomic.AddInt64(&h.counts[i], 1)
+		}
+	}
+	atomic.AddInt64(&h.count, 1)
+	atomic.AddInt64(&h.sumNano, int64(v*1e9))
+}
+
+type metricsServer struct {
+	config Config
+}
+
+func newMetricsServer(c Config) *metricsServer {
+	return &metricsServer{c}
+}
+
+func (ms *metricsServer) Listen() {
+	mux := http.NewServeMux()
+	mux.HandleFunc(ms.config.Metrics.Path, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		GOTT.writeMetrics(w)
+	})
+
+	err := http.ListenAndServe(ms.config.Metrics.Listen, mux)
+	if err != nil {
+		log.Fatal("ListenAndServe metrics: ", err)
+	}
+}
+
+// writeMetrics writes all the broker metrics in the OpenMetrics text format.
+func (b *Broker) writeMetrics(w http.ResponseWriter) {
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(out, "# TYPE %s %s\n# HELP %s %s\n", name, typ, name, help)
+	}
+
+	metric("gott_clients_connected", "gauge", "Connected clients by transport.")
+	clients := b.clientsByTransport()
+	for _, t := range []string{TransportTCP, TransportTLS, TransportWS, TransportWSS} {
+		fmt.Fprintf(out, "gott_clients_connected{transport=%q} %d\n", t, clients[t])
+	}
+
+	metric("gott_connects", "counter", "Accepted CONNECT packets.")
+	fmt.Fprintf(out, "gott_connects_total %d\n", atomic.LoadInt64(&metrics.connects))
+
+	metric("gott_disconnects", "counter", "Disconnected clients.")
+	fmt.Fprintf(out, "gott_disconnects_total %d\n", atomic.LoadInt64(&metrics.disconnects))
+
+	metric("gott_packets_received", "counter", "Received packets by type.")
+	writePacketCounters(out, "gott_packets_received_total", &metrics.packetsReceived)
+
+	metric("gott_bytes_received", "counter", "Received bytes by packet type.")
+	writePacketCounters(out, "gott_bytes_received_total", &metrics.bytesReceived)
+
+	metric("gott_packets_sent", "counter", "Sent packets by type.")
+	writePacketCounters(out, "gott_packets_sent_total", &metrics.packetsSent)
+
+	metric("gott_bytes_sent", "counter", "Sent bytes by packet type.")
+	writePacketCounters(out, "gott_bytes_sent_total", &metrics.bytesSent)
+
+	metric("gott_publishes", "counter", "Messages published through the broker.")
+	fmt.Fprintf(out, "gott_publishes_total %d\n", atomic.LoadInt64(&metrics.publishes))
+
+	metric("gott_publish_deliveries", "counter", "Messages delivered or queued to subscribers (publish fan-out).")
+	fmt.Fprintf(out, "gott_publish_deliveries_total %d\n", atomic.LoadInt64(&metrics.publishDeliveries))
+
+	metric("gott_retries", "counter", "Packets resent because they were not acknowledged in time.")
+	fmt.Fprintf(out, "gott_retries_total %d\n", atomic.LoadInt64(&metrics.retries))
+
+	metric("gott_sessions_expired", "counter", "Persistent sessions deleted after expiring.")
+	fmt.Fprintf(out, "gott_sessions_expired_total %d\n", atomic.LoadInt64(&metrics.expiredSessions))
+
+	metric("gott_queue_dropped", "counter", "Messages dropped by the offline queue limits of persistent sessions.")
+	fmt.Fprintf(out, "gott_queue_dropped_total %d\n", atomic.LoadInt64(&metrics.droppedMessages))
+
+	metric("gott_inflight_messages", "gauge", "Outbound QoS 1 and 2 messages waiting for acknowledgement.")
+	fmt.Fprintf(out, "gott_inflight_messages{qos=\"1\"} %d\n", atomic.LoadInt64(&metrics.inflight[1]))
+	fmt.Fprintf(out, "gott_inflight_messages{qos=\"2\"} %d\n", atomic.LoadInt64(&metrics.inflight[2]))
+
+	stats := b.TopicFilterStorage.stats()
+
+	metric("gott_topic_levels", "gauge", "Levels in the topic tree.")
+	fmt.Fprintf(out, "gott_topic_levels %d\n", stats.Levels)
+
+	metric("gott_subscriptions", "gauge", "Subscriptions in the topic tree.")
+	fmt.Fprintf(out, "gott_subscriptions %d\n", stats.Subscriptions)
+
+	metric("gott_retained_messages", "gauge", "Retained messages.")
+	fmt.Fprintf(out, "gott_retained_messages %d\n", b.RetainedStore.len())
+
+	metric("gott_session_queued_messages", "gauge", "Messages queued for persistent sessions while their clients are offline.")
+	fmt.Fprintf(out, "gott_session_queued_messages %d\n", atomic.LoadInt64(&metrics.queued[0]))
+
+	metric("gott_sessions_queued", "gauge", "Persistent sessions with queued messages.")
+	fmt.Fprintf(out, "gott_sessions_queued %d\n", atomic.LoadInt64(&metrics.queued[1]))
+
+	// the records of the store by kind are only counted by /api/store, which scans them
+	var diskSize int64
+	if ms, ok := b.SessionStore.maintained(); ok {
+		diskSize = ms.diskSize()
+	}
+	metric("gott_session_store_size_bytes", "gauge", "Disk space used by the session store.")
+	fmt.Fprintf(out, "gott_session_store_size_bytes %d\n", diskSize)
+
+	metric("gott_session_store_corrupt", "counter", "Sessions that failed to load because they're corrupt.")
+	fmt.Fprintf(out, "gott_session_store_corrupt_total %d\n", atomic.LoadInt64(&metrics.corruptSessions))
+
+	metric("gott_session_store_latency_seconds", "histogram", "Session store operations latency.")
+	for _, op := range []string{"get", "set", "delete"} {
+		h := metrics.sessionStoreLatency[op]
+		for i, bucket := range h.buckets {
+			fmt.Fprintf(out, "gott_session_store_latency_seconds_bucket{op=%q,le=\"%g\"} %d\n", op, bucket, atomic.LoadInt64(&h.counts[i]))
+		}
+		count := atomic.LoadInt64(&h.count)
+		fmt.Fprintf(out, "gott_session_store_latency_seconds_bucket{op=%q,le=\"+Inf\"} %d\n", op, count)
+		fmt.Fprintf(out, "gott_session_store_latency_seconds_sum{op=%q} %g\n", op, float64(atomic.LoadInt64(&h.sumNano))/1e9)
+		fmt.Fprintf(out, "gott_session_store_latency_seconds_count{op=%q} %d\n", op, count)
+	}
+
+	fmt.Fprint(out, "# EOF\n")
+}
+
+func writePacketCounters(out *bufio.Writer, name string, counters *[16]int64) {
+	for i := TypeConnect; i <= TypeDisconnect; i++ {
+		fmt.Fprintf(out, "%s{type=%q} %d\n", name, packetTypeNames[i], atomic.LoadInt64(&counters[i]))
+	}
+}
+
+func (b *Broker) clientsByTransport() map[string]int {
+	counts := map[string]int{}
+	b.clients.forEach(func(c *Client) {
+		counts[c.connInfo.Transport]++
+	})
+	return counts
+}
@@ -3,6 +3,7 @@ package gott
 import (
 	"encoding/binary"
 	"gott/bytes"
+	"net"
 )
 
 var packetSeq = &sequencer{UpperBoundBits: 16, Start: 1}
@@ -58,59 +59,73 @@ func makePingRespPacket() []byte {
 	return packet
 }
 
-func makePublishPacket(topic, payload []byte, dupFlag, qos, retainFlag byte) (packet []byte, packetID uint16) {
+// makePublishHeader encodes everything of a PUBLISH packet that precedes its payload.
+// For QoS 1 and 2 the last two bytes are the packet identifier, left zero to be patched per subscriber.
+func makePublishHeader(topic []byte, payloadLen int, dupFlag, qos, retainFlag byte) []byte {
 	if qos == 0 { // as per [MQTT-3.3.1-2]
 		dupFlag = 0
 	}
-	if topic == nil {
-		return
-	}
 
-	// 2nd byte... = remaining length (var header len + payload len)
-	fixedHeader := []byte{TypePublish<<4 + dupFlag<<3 + qos<<1 + retainFlag}
+	varHeaderLen := 2 + len(topic) // topic name + packet identifier
+	if qos > 0 {
+		varHeaderLen += 2
+	}
+	remLen := bytes.Encode(varHeaderLen + payloadLen)
 
-	varHeader := make([]byte, 2) // topic name + packet identifier
-	binary.BigEndian.PutUint16(varHeader, uint16(len(topic)))
-	varHeader = append(varHeader, topic...)
+	header := make([]byte, 0, 1+len(remLen)+varHeaderLen)
+	header = append(header, TypePublish<<4+dupFlag<<3+qos<<1+retainFlag)
+	header = append(header, remLen...)
+	header = append(header, byte(len(topic)>>8), byte(len(topic)))
+	header = append(header, topic...)
+	if qos > 0 {
+		header = append(header, 0, 0)
+	}
+	return header
+}
 
+func makePublishPacket(topic, payload []byte, dupFlag, qos, retainFlag byte) (packet []byte, packetID uint16) {
+	if topic == nil {
+		return
+	}
 	if qos > 0 {
-		varHeader = append(varHeader, 0, 0)
 		packetID = uint16(packetSeq.next())
-		binary.BigEndian.PutUint16(varHeader[len(varHeader)-2:], packetID)
 	}
-
-	packet = append(packet, fixedHeader...)
-	packet = append(packet, bytes.Encode(len(varHeader)+len(payload))...)
-	packet = append(packet, varHeader...)
-	packet = append(packet, payload...)
-
-	return
+	return makePublishPacketWithID(packetID, topic, payload, dupFlag, qos, retainFlag), packetID
 }
 
 func makePublishPacketWithID(packetID uint16, topic, payload []byte, dupFlag, qos, retainFlag byte) (packet []byte) {
-	if qos == 0 { // as per [MQTT-3.3.1-2]
-		dupFlag = 0
-	}
 	if topic == nil {
 		return
 	}
 
-	// 2nd byte... = remaining length (var header len + payload len)
-	fixedHeader := []byte{TypePublish<<4 + dupFlag<<3 + qos<<1 + retainFlag}
+	header := makePublishHeader(topic, len(payload), dupFlag, qos, retainFlag)
+	packet = make([]byte, len(header), len(header)+len(payload))
+	copy(packet, header)
+	if qos > 0 {
+		binary.BigEndian.PutUint16(packet[len(header)-2:], packetID)
+	}
+	return append(packet, payload...)
+}
 
-	varHeader := make([]byte, 2) // topic name + packet identifier
-	binary.BigEndian.PutUint16(varHeader, uint16(len(topic)))
-	varHeader = append(varHeader, topic...)
+// publishFanout encodes a PUBLISH packet once per QoS level while it's sent out to its subscribers.
+// The payload is never copied, it's written after the header by the Client's emit.
+type publishFanout struct {
+	topic, payload []byte
+	headers        [3][]byte
+}
 
-	if qos >= 1 {
-		varHeader = append(varHeader, 0, 0)
-		binary.BigEndian.PutUint16(varHeader[len(varHeader)-2:], packetID)
+// packet returns the header and payload of the packet for a subscriber's QoS.
+// QoS 0 headers are shared, QoS 1 and 2 headers are copied to patch in the packet identifier.
+func (pf *publishFanout) packet(qos byte, packetID uint16) net.Buffers {
+	// dup and retain are zero according to [MQTT-3.3.1-1], [MQTT-3.3.1-3] and [MQTT-3.3.1-9]
+	if pf.headers[qos] == nil {
+		pf.headers[qos] = makePublishHeader(pf.topic, len(pf.payload), 0, qos, 0)
 	}
 
-	packet = append(packet, fixedHeader...)
-	packet = append(packet, bytes.Encode(len(varHeader)+len(payload))...)
-	packet = append(packet, varHeader...)
-	packet = append(packet, payload...)
-
-	return
+	header := pf.headers[qos]
+	if qos > 0 {
+		header = append([]byte(nil), header...)
+		binary.BigEndian.PutUint16(header[len(header)-2:], packetID)
+	}
+	return net.Buffers{header, pf.payload}
 }
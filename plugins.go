@@ -1,19 +1,36 @@
 package gott
 
 import (
+	"fmt"
 	"gott/utils"
 	"log"
 	"net"
 	"os"
-	"path"
 	"plugin"
+)
 
-	"go.uber.org/zap"
+// Plugin API versions supported by the loader.
+// Version 2 added the hooks receiving ConnInfo.
+const (
+	PluginAPIVersion    = 2
+	minPluginAPIVersion = 1
 )
 
+// pluginHooks lists every hook symbol the loader looks up, in the order they are reported.
+var pluginHooks = []string{
+	"OnSocketOpen", "OnBeforeConnect", "OnConnect", "OnMessage", "OnBeforePublish", "OnPublish",
+	"OnBeforeSubscribe", "OnSubscribe", "OnBeforeUnsubscribe", "OnUnsubscribe", "OnDisconnect", "OnSessionExpired",
+	"OnSocketOpenInfo", "OnBeforeConnectInfo", "OnConnectInfo", "OnMessageInfo", "OnBeforePublishInfo", "OnPublishInfo",
+	"OnBeforeSubscribeInfo", "OnSubscribeInfo", "OnBeforeUnsubscribeInfo", "OnUnsubscribeInfo", "OnDisconnectInfo",
+	"Cleanup",
+}
+
 type gottPlugin struct {
 	name                string
 	plug                *plugin.Plugin
+	info                PluginInfo
+	enabled             atomicBool
+	reconfigure         func(conf map[interface{}]interface{}) error
 	onSocketOpen        func(conn net.Conn) bool
 	onBeforeConnect     func(clientID, username, password string) bool
 	onConnect           func(clientID, username, password string) bool
@@ -25,10 +42,35 @@ type gottPlugin struct {
 	onBeforeUnsubscribe func(clientID, username string, topic []byte) bool
 	onUnsubscribe       func(clientID, username string, topic []byte)
 	onDisconnect        func(clientID, username string, graceful bool)
+	onSessionExpired    func(clientID string)
 	cleanup             func()
+
+	// hooks receiving the full connection info, take precedence over the ones above if both are exported
+	onSocketOpenInfo        func(conn net.Conn, info ConnInfo) bool
+	onBeforeConnectInfo     func(info ConnInfo, password string) bool
+	onConnectInfo           func(info ConnInfo, password string) bool
+	onMessageInfo           func(info ConnInfo, topic, payload []byte, dup, qos byte, retain bool)
+	onBeforePublishInfo     func(info ConnInfo, topic, payload []byte, dup, qos byte, retain bool) bool
+	onPublishInfo           func(info ConnInfo, topic, payload []byte, dup, qos byte, retain bool)
+	onBeforeSubscribeInfo   func(info ConnInfo, topic []byte, qos byte) bool
+	onSubscribeInfo         func(info ConnInfo, topic []byte, qos byte)
+	onBeforeUnsubscribeInfo func(info ConnInfo, topic []byte) bool
+	onUnsubscribeInfo       func(info ConnInfo, topic []byte)
+	onDisconnectInfo        func(info ConnInfo, graceful bool)
 }
 
-func (b *Broker) bootstrapPlugins() {
+// PluginInfo describes a loaded plugin and the hooks it registered.
+type PluginInfo struct {
+	File          string
+	Name          string
+	Version       string
+	APIVersion    int
+	RequiredHooks []string
+	Hooks         []string
+	Enabled       bool
+}
+
+func (b *Broker) bootstrapPlugins() error {
 	if !utils.PathExists(pluginDir) {
 		log.Println("Plugins directory does not exist. Creating a new one.")
 		if err := os.Mkdir(pluginDir, 0775); err != nil {
@@ -36,130 +78,167 @@ func (b *Broker) bootstrapPlugins() {
 		}
 	}
 	for _, pstring := range b.config.pluginNames {
-		p, err := plugin.Open(path.Join(pluginDir, pstring))
-		if err != nil {
-			log.Printf("Skipping loading plugin %s: %v", pstring, err)
-			continue
+		if err := b.LoadPlugin(pstring, b.config.pluginConfig[pstring]); err != nil {
+			return err
 		}
+	}
 
-		pluginObj := gottPlugin{
-			name: pstring,
-			plug: p,
-		}
+	return nil
+}
 
-		if bootstrap, err := p.Lookup("Bootstrap"); err == nil {
-			if bootFunc, ok := bootstrap.(func()); ok {
-				bootFunc()
-			} else if bootFunc, ok := bootstrap.(func(map[interface{}]interface{})); ok {
-				bootFunc(b.config.pluginConfig[pstring])
-			}
-		}
+// loadPlugin validates the API version and the metadata of an opened plugin and resolves its hooks.
+// Any exported hook with an incompatible signature or a missing required hook is an error.
+func loadPlugin(file string, p *plugin.Plugin) (*gottPlugin, error) {
+	pluginObj := &gottPlugin{
+		name: file,
+		plug: p,
+		info: PluginInfo{File: file, Name: file},
+	}
 
-		h, err := p.Lookup("OnSocketOpen")
-		if err == nil {
-			f, ok := h.(func(conn net.Conn) bool)
-			b.logger.Debug("plugin loader OnSocketOpen", zap.String("name", pstring), zap.Bool("loaded", ok))
-			if ok {
-				pluginObj.onSocketOpen = f
-			}
+	if sym, err := p.Lookup("APIVersion"); err == nil {
+		switch v := sym.(type) {
+		case *int:
+			pluginObj.info.APIVersion = *v
+		case func() int:
+			pluginObj.info.APIVersion = v()
+		default:
+			return pluginObj, fmt.Errorf("plugin %s: APIVersion must be an int variable or a func() int", file)
 		}
 
-		h, err = p.Lookup("OnBeforeConnect")
-		if err == nil {
-			f, ok := h.(func(clientID, username, password string) bool)
-			b.logger.Debug("plugin loader OnBeforeConnect", zap.String("name", pstring), zap.Bool("loaded", ok))
-			if ok {
-				pluginObj.onBeforeConnect = f
-			}
-		}
-
-		if h, err = p.Lookup("OnConnect"); err == nil {
-			f, ok := h.(func(clientID, username, password string) bool)
-			b.logger.Debug("plugin loader OnConnect", zap.String("name", pstring), zap.Bool("loaded", ok))
-			if ok {
-				pluginObj.onConnect = f
-			}
+		if pluginObj.info.APIVersion < minPluginAPIVersion || pluginObj.info.APIVersion > PluginAPIVersion {
+			return pluginObj, fmt.Errorf("plugin %s: API version %d is not supported, supported versions are %d to %d",
+				file, pluginObj.info.APIVersion, minPluginAPIVersion, PluginAPIVersion)
 		}
+	}
 
-		if h, err = p.Lookup("OnMessage"); err == nil {
-			f, ok := h.(func(clientID, username string, topic, payload []byte, dup, qos byte, retain bool))
-			b.logger.Debug("plugin loader OnMessage", zap.String("name", pstring), zap.Bool("loaded", ok))
-			if ok {
-				pluginObj.onMessage = f
-			}
+	if sym, err := p.Lookup("PluginName"); err == nil {
+		if v, ok := sym.(*string); ok && *v != "" {
+			pluginObj.info.Name = *v
 		}
+	}
 
-		if h, err = p.Lookup("OnBeforePublish"); err == nil {
-			f, ok := h.(func(clientID, username string, topic, payload []byte, dup, qos byte, retain bool) bool)
-			b.logger.Debug("plugin loader OnBeforePublish", zap.String("name", pstring), zap.Bool("loaded", ok))
-			if ok {
-				pluginObj.onBeforePublish = f
-			}
+	if sym, err := p.Lookup("PluginVersion"); err == nil {
+		if v, ok := sym.(*string); ok {
+			pluginObj.info.Version = *v
 		}
+	}
 
-		if h, err = p.Lookup("OnPublish"); err == nil {
-			f, ok := h.(func(clientID, username string, topic, payload []byte, dup, qos byte, retain bool))
-			b.logger.Debug("plugin loader OnPublish", zap.String("name", pstring), zap.Bool("loaded", ok))
-			if ok {
-				pluginObj.onPublish = f
-			}
+	if sym, err := p.Lookup("RequiredHooks"); err == nil {
+		v, ok := sym.(*[]string)
+		if !ok {
+			return pluginObj, fmt.Errorf("plugin %s: RequiredHooks must be a []string variable", file)
 		}
+		pluginObj.info.RequiredHooks = *v
+	}
 
-		if h, err = p.Lookup("OnBeforeSubscribe"); err == nil {
-			f, ok := h.(func(clientID, username string, topic []byte, qos byte) bool)
-			b.logger.Debug("plugin loader OnBeforeSubscribe", zap.String("name", pstring), zap.Bool("loaded", ok))
-			if ok {
-				pluginObj.onBeforeSubscribe = f
-			}
+	for _, hook := range pluginHooks {
+		sym, err := p.Lookup(hook)
+		if err != nil {
+			continue
 		}
 
-		if h, err = p.Lookup("OnSubscribe"); err == nil {
-			f, ok := h.(func(clientID, username string, topic []byte, qos byte))
-			b.logger.Debug("plugin loader OnSubscribe", zap.String("name", pstring), zap.Bool("loaded", ok))
-			if ok {
-				pluginObj.onSubscribe = f
-			}
+		if !pluginObj.setHook(hook, sym) {
+			return pluginObj, fmt.Errorf("plugin %s: hook %s has an incompatible signature", file, hook)
 		}
+		pluginObj.info.Hooks = append(pluginObj.info.Hooks, hook)
+	}
 
-		if h, err = p.Lookup("OnBeforeUnsubscribe"); err == nil {
-			f, ok := h.(func(clientID, username string, topic []byte) bool)
-			b.logger.Debug("plugin loader OnBeforeUnsubscribe", zap.String("name", pstring), zap.Bool("loaded", ok))
-			if ok {
-				pluginObj.onBeforeUnsubscribe = f
+	if sym, err := p.Lookup("Reconfigure"); err == nil {
+		if f, ok := sym.(func(map[interface{}]interface{})); ok {
+			pluginObj.reconfigure = func(conf map[interface{}]interface{}) error {
+				f(conf)
+				return nil
 			}
+		} else if f, ok := sym.(func(map[interface{}]interface{}) error); ok {
+			pluginObj.reconfigure = f
+		} else {
+			return pluginObj, fmt.Errorf("plugin %s: Reconfigure has an incompatible signature", file)
 		}
+	}
 
-		if h, err = p.Lookup("OnUnsubscribe"); err == nil {
-			f, ok := h.(func(clientID, username string, topic []byte))
-			b.logger.Debug("plugin loader OnUnsubscribe", zap.String("name", pstring), zap.Bool("loaded", ok))
-			if ok {
-				pluginObj.onUnsubscribe = f
-			}
+	for _, hook := range pluginObj.info.RequiredHooks {
+		if !utils.StringInSlice(hook, pluginObj.info.Hooks) {
+			return pluginObj, fmt.Errorf("plugin %s: required hook %s is not exported", file, hook)
 		}
+	}
 
-		if h, err = p.Lookup("OnDisconnect"); err == nil {
-			f, ok := h.(func(clientID, username string, graceful bool))
-			b.logger.Debug("plugin loader OnDisconnect", zap.String("name", pstring), zap.Bool("loaded", ok))
-			if ok {
-				pluginObj.onDisconnect = f
-			}
-		}
+	return pluginObj, nil
+}
 
-		if h, err = p.Lookup("Cleanup"); err == nil {
-			f, ok := h.(func())
-			b.logger.Debug("plugin loader Cleanup", zap.String("name", pstring), zap.Bool("loaded", ok))
-			if ok {
-				pluginObj.cleanup = f
-			}
-		}
+// setHook assigns a looked up symbol to the matching hook.
+// Returns false if the symbol's type does not match the hook's signature.
+func (p *gottPlugin) setHook(hook string, sym plugin.Symbol) (ok bool) {
+	switch hook {
+	case "OnSocketOpen":
+		p.onSocketOpen, ok = sym.(func(conn net.Conn) bool)
+	case "OnBeforeConnect":
+		p.onBeforeConnect, ok = sym.(func(clientID, username, password string) bool)
+	case "OnConnect":
+		p.onConnect, ok = sym.(func(clientID, username, password string) bool)
+	case "OnMessage":
+		p.onMessage, ok = sym.(func(clientID, username string, topic, payload []byte, dup, qos byte, retain bool))
+	case "OnBeforePublish":
+		p.onBeforePublish, ok = sym.(func(clientID, username string, topic, payload []byte, dup, qos byte, retain bool) bool)
+	case "OnPublish":
+		p.onPublish, ok = sym.(func(clientID, username string, topic, payload []byte, dup, qos byte, retain bool))
+	case "OnBeforeSubscribe":
+		p.onBeforeSubscribe, ok = sym.(func(clientID, username string, topic []byte, qos byte) bool)
+	case "OnSubscribe":
+		p.onSubscribe, ok = sym.(func(clientID, username string, topic []byte, qos byte))
+	case "OnBeforeUnsubscribe":
+		p.onBeforeUnsubscribe, ok = sym.(func(clientID, username string, topic []byte) bool)
+	case "OnUnsubscribe":
+		p.onUnsubscribe, ok = sym.(func(clientID, username string, topic []byte))
+	case "OnDisconnect":
+		p.onDisconnect, ok = sym.(func(clientID, username string, graceful bool))
+	case "OnSessionExpired":
+		p.onSessionExpired, ok = sym.(func(clientID string))
+	case "OnSocketOpenInfo":
+		p.onSocketOpenInfo, ok = sym.(func(conn net.Conn, info ConnInfo) bool)
+	case "OnBeforeConnectInfo":
+		p.onBeforeConnectInfo, ok = sym.(func(info ConnInfo, password string) bool)
+	case "OnConnectInfo":
+		p.onConnectInfo, ok = sym.(func(info ConnInfo, password string) bool)
+	case "OnMessageInfo":
+		p.onMessageInfo, ok = sym.(func(info ConnInfo, topic, payload []byte, dup, qos byte, retain bool))
+	case "OnBeforePublishInfo":
+		p.onBeforePublishInfo, ok = sym.(func(info ConnInfo, topic, payload []byte, dup, qos byte, retain bool) bool)
+	case "OnPublishInfo":
+		p.onPublishInfo, ok = sym.(func(info ConnInfo, topic, payload []byte, dup, qos byte, retain bool))
+	case "OnBeforeSubscribeInfo":
+		p.onBeforeSubscribeInfo, ok = sym.(func(info ConnInfo, topic []byte, qos byte) bool)
+	case "OnSubscribeInfo":
+		p.onSubscribeInfo, ok = sym.(func(info ConnInfo, topic []byte, qos byte))
+	case "OnBeforeUnsubscribeInfo":
+		p.onBeforeUnsubscribeInfo, ok = sym.(func(info ConnInfo, topic []byte) bool)
+	case "OnUnsubscribeInfo":
+		p.onUnsubscribeInfo, ok = sym.(func(info ConnInfo, topic []byte))
+	case "OnDisconnectInfo":
+		p.onDisconnectInfo, ok = sym.(func(info ConnInfo, graceful bool))
+	case "Cleanup":
+		p.cleanup, ok = sym.(func())
+	}
+	return
+}
 
-		b.plugins = append(b.plugins, pluginObj)
+// Plugins returns the info of all loaded plugins in the order they were loaded.
+func (b *Broker) Plugins() []PluginInfo {
+	b.pluginsMutex.RLock()
+	defer b.pluginsMutex.RUnlock()
 
-		b.logger.Debug("plugin loaded", zap.String("name", pstring))
+	infos := make([]PluginInfo, 0, len(b.plugins))
+	for _, p := range b.plugins {
+		info := p.info
+		info.Enabled = p.enabled.Load()
+		infos = append(infos, info)
 	}
+	return infos
 }
 
 func (b *Broker) cleanupPlugins() {
+	b.pluginsMutex.RLock()
+	defer b.pluginsMutex.RUnlock()
+
 	for _, p := range b.plugins {
 		if p.cleanup != nil {
 			p.cleanup()
@@ -167,9 +246,13 @@ func (b *Broker) cleanupPlugins() {
 	}
 }
 
-func (b *Broker) invokeOnSocketOpen(conn net.Conn) bool {
-	for _, p := range b.plugins {
-		if p.onSocketOpen != nil {
+func (b *Broker) invokeOnSocketOpen(conn net.Conn, info ConnInfo) bool {
+	for _, p := range b.activePlugins() {
+		if p.onSocketOpenInfo != nil {
+			if !p.onSocketOpenInfo(conn, info) {
+				return false
+			}
+		} else if p.onSocketOpen != nil {
 			if !p.onSocketOpen(conn) {
 				return false
 			}
@@ -179,10 +262,14 @@ func (b *Broker) invokeOnSocketOpen(conn net.Conn) bool {
 	return true
 }
 
-func (b *Broker) invokeOnBeforeConnect(clientID, username, password string) bool {
-	for _, p := range b.plugins {
-		if p.onBeforeConnect != nil {
-			if !p.onBeforeConnect(clientID, username, password) {
+func (b *Broker) invokeOnBeforeConnect(info ConnInfo, password string) bool {
+	for _, p := range b.activePlugins() {
+		if p.onBeforeConnectInfo != nil {
+			if !p.onBeforeConnectInfo(info, password) {
+				return false
+			}
+		} else if p.onBeforeConnect != nil {
+			if !p.onBeforeConnect(info.ClientID, info.Username, password) {
 				return false
 			}
 		}
@@ -191,10 +278,14 @@ func (b *Broker) invokeOnBeforeConnect(clientID, username, password string) bool
 	return true
 }
 
-func (b *Broker) invokeOnConnect(clientID, username, password string) bool {
-	for _, p := range b.plugins {
-		if p.onConnect != nil {
-			if !p.onConnect(clientID, username, password) {
+func (b *Broker) invokeOnConnect(info ConnInfo, password string) bool {
+	for _, p := range b.activePlugins() {
+		if p.onConnectInfo != nil {
+			if !p.onConnectInfo(info, password) {
+				return false
+			}
+		} else if p.onConnect != nil {
+			if !p.onConnect(info.ClientID, info.Username, password) {
 				return false
 			}
 		}
@@ -203,18 +294,24 @@ func (b *Broker) invokeOnConnect(clientID, username, password string) bool {
 	return true
 }
 
-func (b *Broker) invokeOnMessage(clientID, username string, topic, payload []byte, dup, qos byte, retain bool) {
-	for _, p := range b.plugins {
-		if p.onMessage != nil {
-			p.onMessage(clientID, username, topic, payload, dup, qos, retain)
+func (b *Broker) invokeOnMessage(info ConnInfo, topic, payload []byte, dup, qos byte, retain bool) {
+	for _, p := range b.activePlugins() {
+		if p.onMessageInfo != nil {
+			p.onMessageInfo(info, topic, payload, dup, qos, retain)
+		} else if p.onMessage != nil {
+			p.onMessage(info.ClientID, info.Username, topic, payload, dup, qos, retain)
 		}
 	}
 }
 
-func (b *Broker) invokeOnBeforePublish(clientID, username string, topic, payload []byte, dup, qos byte, retain bool) bool {
-	for _, p := range b.plugins {
-		if p.onBeforePublish != nil {
-			if !p.onBeforePublish(clientID, username, topic, payload, dup, qos, retain) {
+func (b *Broker) invokeOnBeforePublish(info ConnInfo, topic, payload []byte, dup, qos byte, retain bool) bool {
+	for _, p := range b.activePlugins() {
+		if p.onBeforePublishInfo != nil {
+			if !p.onBeforePublishInfo(info, topic, payload, dup, qos, retain) {
+				return false
+			}
+		} else if p.onBeforePublish != nil {
+			if !p.onBeforePublish(info.ClientID, info.Username, topic, payload, dup, qos, retain) {
 				return false
 			}
 		}
@@ -223,18 +320,24 @@ func (b *Broker) invokeOnBeforePublish(clientID, username string, topic, payload
 	return true
 }
 
-func (b *Broker) invokeOnPublish(clientID, username string, topic, payload []byte, dup, qos byte, retain bool) {
-	for _, p := range b.plugins {
-		if p.onPublish != nil {
-			p.onPublish(clientID, username, topic, payload, dup, qos, retain)
+func (b *Broker) invokeOnPublish(info ConnInfo, topic, payload []byte, dup, qos byte, retain bool) {
+	for _, p := range b.activePlugins() {
+		if p.onPublishInfo != nil {
+			p.onPublishInfo(info, topic, payload, dup, qos, retain)
+		} else if p.onPublish != nil {
+			p.onPublish(info.ClientID, info.Username, topic, payload, dup, qos, retain)
 		}
 	}
 }
 
-func (b *Broker) invokeOnBeforeSubscribe(clientID, username string, topic []byte, qos byte) bool {
-	for _, p := range b.plugins {
-		if p.onBeforeSubscribe != nil {
-			if !p.onBeforeSubscribe(clientID, username, topic, qos) {
+func (b *Broker) invokeOnBeforeSubscribe(info ConnInfo, topic []byte, qos byte) bool {
+	for _, p := range b.activePlugins() {
+		if p.onBeforeSubscribeInfo != nil {
+			if !p.onBeforeSubscribeInfo(info, topic, qos) {
+				return false
+			}
+		} else if p.onBeforeSubscribe != nil {
+			if !p.onBeforeSubscribe(info.ClientID, info.Username, topic, qos) {
 				return false
 			}
 		}
@@ -243,18 +346,24 @@ func (b *Broker) invokeOnBeforeSubscribe(clientID, username string, topic []byte
 	return true
 }
 
-func (b *Broker) invokeOnSubscribe(clientID, username string, topic []byte, qos byte) {
-	for _, p := range b.plugins {
-		if p.onSubscribe != nil {
-			p.onSubscribe(clientID, username, topic, qos)
+func (b *Broker) invokeOnSubscribe(info ConnInfo, topic []byte, qos byte) {
+	for _, p := range b.activePlugins() {
+		if p.onSubscribeInfo != nil {
+			p.onSubscribeInfo(info, topic, qos)
+		} else if p.onSubscribe != nil {
+			p.onSubscribe(info.ClientID, info.Username, topic, qos)
 		}
 	}
 }
 
-func (b *Broker) invokeOnBeforeUnsubscribe(clientID, username string, topic []byte) bool {
-	for _, p := range b.plugins {
-		if p.onBeforeUnsubscribe != nil {
-			if !p.onBeforeUnsubscribe(clientID, username, topic) {
+func (b *Broker) invokeOnBeforeUnsubscribe(info ConnInfo, topic []byte) bool {
+	for _, p := range b.activePlugins() {
+		if p.onBeforeUnsubscribeInfo != nil {
+			if !p.onBeforeUnsubscribeInfo(info, topic) {
+				return false
+			}
+		} else if p.onBeforeUnsubscribe != nil {
+			if !p.onBeforeUnsubscribe(info.ClientID, info.Username, topic) {
 				return false
 			}
 		}
@@ -263,18 +372,30 @@ func (b *Broker) invokeOnBeforeUnsubscribe(clientID, username string, topic []by
 	return true
 }
 
-func (b *Broker) invokeOnUnsubscribe(clientID, username string, topic []byte) {
-	for _, p := range b.plugins {
-		if p.onUnsubscribe != nil {
-			p.onUnsubscribe(clientID, username, topic)
+func (b *Broker) invokeOnUnsubscribe(info ConnInfo, topic []byte) {
+	for _, p := range b.activePlugins() {
+		if p.onUnsubscribeInfo != nil {
+			p.onUnsubscribeInfo(info, topic)
+		} else if p.onUnsubscribe != nil {
+			p.onUnsubscribe(info.ClientID, info.Username, topic)
 		}
 	}
 }
 
-func (b *Broker) invokeOnDisconnect(clientID, username string, graceful bool) {
-	for _, p := range b.plugins {
-		if p.onDisconnect != nil {
-			p.onDisconnect(clientID, username, graceful)
+func (b *Broker) invokeOnDisconnect(info ConnInfo, graceful bool) {
+	for _, p := range b.activePlugins() {
+		if p.onDisconnectInfo != nil {
+			p.onDisconnectInfo(info, graceful)
+		} else if p.onDisconnect != nil {
+			p.onDisconnect(info.ClientID, info.Username, graceful)
+		}
+	}
+}
+
+func (b *Broker) invokeOnSessionExpired(clientID string) {
+	for _, p := range b.activePlugins() {
+		if p.onSessionExpired != nil {
+			p.onSessionExpired(clientID)
 		}
 	}
 }
@@ -0,0 +1,172 @@
+package gott
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"plugin"
+
+	"go.uber.org/zap"
+)
+
+// Errors returned by the plugin management methods of the Broker.
+var (
+	ErrPluginLoaded    = errors.New("plugin is already loaded")
+	ErrPluginNotLoaded = errors.New("plugin is not loaded")
+	ErrPluginName      = errors.New("plugin name must be a file name in the plugins directory")
+)
+
+// activePlugins returns the enabled plugins in load order.
+// The returned slice is never modified in place so it is safe to range over without holding the lock.
+func (b *Broker) activePlugins() []*gottPlugin {
+	b.pluginsMutex.RLock()
+	defer b.pluginsMutex.RUnlock()
+	return b.enabledPlugins
+}
+
+// refreshEnabledPlugins rebuilds the enabled plugins snapshot. Must be called with pluginsMutex locked.
+func (b *Broker) refreshEnabledPlugins() {
+	enabled := make([]*gottPlugin, 0, len(b.plugins))
+	for _, p := range b.plugins {
+		if p.enabled.Load() {
+			enabled = append(enabled, p)
+		}
+	}
+	b.enabledPlugins = enabled
+}
+
+func (b *Broker) findPlugin(name string) *gottPlugin {
+	for _, p := range b.plugins {
+		if p.name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// LoadPlugin opens a plugin file from the plugins directory, bootstraps it with the passed config and
+// enables its hooks. Plugins are appended to the end of the invocation order.
+// Returns an error if the plugin is already loaded or fails the compatibility checks.
+// The plugin is opened and bootstrapped without holding the plugins lock so hooks keep being dispatched.
+func (b *Broker) LoadPlugin(name string, conf map[interface{}]interface{}) error {
+	if name == "" || path.Base(name) != name {
+		return fmt.Errorf("%w: %s", ErrPluginName, name)
+	}
+
+	b.pluginsMutex.Lock()
+	if b.findPlugin(name) != nil || b.loadingPlugins[name] {
+		b.pluginsMutex.Unlock()
+		return fmt.Errorf("%w: %s", ErrPluginLoaded, name)
+	}
+	if b.loadingPlugins == nil {
+		b.loadingPlugins = map[string]bool{}
+	}
+	b.loadingPlugins[name] = true
+	b.pluginsMutex.Unlock()
+
+	pluginObj, err := b.openPlugin(name, conf)
+
+	b.pluginsMutex.Lock()
+	defer b.pluginsMutex.Unlock()
+
+	delete(b.loadingPlugins, name)
+	if err != nil {
+		return err
+	}
+
+	b.config.pluginConfig[name] = conf
+	pluginObj.enabled.Store(true)
+	b.plugins = append(b.plugins, pluginObj)
+	b.refreshEnabledPlugins()
+
+	b.logger.Info("plugin loaded", zap.String("name", name), zap.Strings("hooks", pluginObj.info.Hooks))
+
+	return nil
+}
+
+// openPlugin opens a plugin file, checks it and runs its Bootstrap function.
+func (b *Broker) openPlugin(name string, conf map[interface{}]interface{}) (*gottPlugin, error) {
+	p, err := plugin.Open(path.Join(pluginDir, name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open plugin %s: %v", name, err)
+	}
+
+	pluginObj, err := loadPlugin(name, p)
+	if err != nil {
+		return nil, err
+	}
+
+	if pluginObj.info.APIVersion == 0 {
+		log.Printf("Plugin %s does not export APIVersion, assuming version %d", name, minPluginAPIVersion)
+		b.logger.Info("plugin loader APIVersion missing", zap.String("name", name))
+		pluginObj.info.APIVersion = minPluginAPIVersion
+	}
+
+	if bootstrap, err := p.Lookup("Bootstrap"); err == nil {
+		if bootFunc, ok := bootstrap.(func()); ok {
+			bootFunc()
+		} else if bootFunc, ok := bootstrap.(func(map[interface{}]interface{})); ok {
+			bootFunc(conf)
+		} else {
+			return nil, fmt.Errorf("plugin %s: Bootstrap has an incompatible signature", name)
+		}
+	}
+	return pluginObj, nil
+}
+
+// EnablePlugin resumes invoking the hooks of a loaded plugin.
+func (b *Broker) EnablePlugin(name string) error {
+	return b.setPluginEnabled(name, true)
+}
+
+// DisablePlugin stops invoking the hooks of a loaded plugin without unloading it.
+// Go plugins can't be unloaded, a disabled plugin stays in memory until the broker exits.
+func (b *Broker) DisablePlugin(name string) error {
+	return b.setPluginEnabled(name, false)
+}
+
+func (b *Broker) setPluginEnabled(name string, enabled bool) error {
+	b.pluginsMutex.Lock()
+	defer b.pluginsMutex.Unlock()
+
+	p := b.findPlugin(name)
+	if p == nil {
+		return fmt.Errorf("%w: %s", ErrPluginNotLoaded, name)
+	}
+
+	p.enabled.Store(enabled)
+	b.refreshEnabledPlugins()
+
+	b.logger.Info("plugin state changed", zap.String("name", name), zap.Bool("enabled", enabled))
+
+	return nil
+}
+
+// ReconfigurePlugin passes a new config map to the plugin's Reconfigure function.
+// The new config replaces the one from the config file for the rest of the broker's lifetime.
+func (b *Broker) ReconfigurePlugin(name string, conf map[interface{}]interface{}) error {
+	b.pluginsMutex.RLock()
+	p := b.findPlugin(name)
+	b.pluginsMutex.RUnlock()
+
+	if p == nil {
+		return fmt.Errorf("%w: %s", ErrPluginNotLoaded, name)
+	}
+
+	if p.reconfigure == nil {
+		return fmt.Errorf("plugin %s does not export Reconfigure", name)
+	}
+
+	if err := p.reconfigure(conf); err != nil {
+		return fmt.Errorf("plugin %s rejected the new config: %v", name, err)
+	}
+
+	b.pluginsMutex.Lock()
+	b.config.pluginConfig[name] = conf
+	b.pluginsMutex.Unlock()
+
+	b.logger.Info("plugin reconfigured", zap.String("name", name))
+
+	return nil
+}
@@ -0,0 +1,177 @@
+package gott
+
+import (
+	gob "bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+const replayListener = "replay"
+
+// ReplayResult summarizes the differences between the recorded and the replayed responses of a capture.
+type ReplayResult struct {
+	Inbound    int // frames sent to the broker
+	Matched    int // responses identical to the recorded ones
+	Mismatched int // responses different from the recorded ones
+	Missing    int // recorded responses the broker did not send
+	Extra      int // responses the broker sent that were not recorded
+}
+
+// Differences returns the number of responses that didn't match the capture.
+func (r ReplayResult) Differences() int {
+	return r.Mismatched + r.Missing + r.Extra
+}
+
+// ReplayCapture feeds the inbound frames of a capture file into a new broker, with the current config and plugins
+// and an empty in-memory session store, over an in-memory connection. Every response is compared to the recorded
+// outbound frame at the same position and the differences are written to out.
+// timeout is how long to wait for each expected response.
+func ReplayCapture(path string, out io.Writer, timeout time.Duration) (ReplayResult, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return ReplayResult{}, err
+	}
+	records, err := ReadCapture(file)
+	_ = file.Close()
+	if err != nil {
+		return ReplayResult{}, err
+	}
+
+	b, err := newBroker(func(c *Config) {
+		c.Sessions.Store.Backend = SessionStoreMemory
+		c.Capture.Enabled = false
+	})
+	if err != nil {
+		return ReplayResult{}, err
+	}
+	defer func() {
+		b.cleanupPlugins()
+		_ = b.SessionStore.Close()
+	}()
+
+	return b.replay(records, out, timeout), nil
+}
+
+func (b *Broker) replay(records []CaptureRecord, out io.Writer, timeout time.Duration) ReplayResult {
+	var result ReplayResult
+
+	conn, server := net.Pipe()
+	defer conn.Close()
+	b.handleConnection(server, TransportTCP, replayListener)
+
+	frames := make(chan []byte, 64)
+	go readFrames(conn, frames)
+
+	closed := false
+	for i, rec := range records {
+		switch rec.Direction {
+		case CaptureInbound:
+			if closed {
+				continue
+			}
+			result.Inbound++
+			_ = conn.SetWriteDeadline(time.Now().Add(timeout))
+			if _, err := conn.Write(rec.Frame); err != nil {
+				fmt.Fprintf(out, "#%d in  %s: the broker closed the connection: %v\n", i, describeFrame(rec.Frame), err)
+				closed = true
+			}
+		case CaptureOutbound:
+			select {
+			case frame, ok := <-frames:
+				if !ok {
+					result.Missing++
+					fmt.Fprintf(out, "#%d out missing %s\n", i, describeFrame(rec.Frame))
+					continue
+				}
+				if gob.Equal(frame, rec.Frame) {
+					result.Matched++
+					continue
+				}
+				result.Mismatched++
+				fmt.Fprintf(out, "#%d out expected %s\n      %x\n    got      %s\n      %x\n", i, describeFrame(rec.Frame), rec.Frame, describeFrame(frame), frame)
+			case <-time.After(timeout):
+				result.Missing++
+				fmt.Fprintf(out, "#%d out missing %s\n", i, describeFrame(rec.Frame))
+			}
+		}
+	}
+
+	// anything sent after the last recorded response is extra
+	for {
+		select {
+		case frame, ok := <-frames:
+			if !ok {
+				return result
+			}
+			result.Extra++
+			fmt.Fprintf(out, "extra out %s\n      %x\n", describeFrame(frame), frame)
+		case <-time.After(timeout):
+			return result
+		}
+	}
+}
+
+// readFrames reads MQTT frames from conn until it is closed.
+func readFrames(conn net.Conn, frames chan<- []byte) {
+	defer close(frames)
+
+	for {
+		frame, err := readFrame(conn)
+		if err != nil {
+			return
+		}
+		frames <- frame
+	}
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	frame := make([]byte, 2)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+
+	remLen, mult := int(frame[1]&127), 128
+	for frame[len(frame)-1] >= 128 {
+		if len(frame) == 5 {
+			return nil, errors.New("malformed remaining length")
+		}
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		frame = append(frame, b[0])
+		remLen += int(b[0]&127) * mult
+		mult *= 128
+	}
+
+	body := make([]byte, remLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return append(frame, body...), nil
+}
+
+// describeFrame returns a short human readable description of a frame.
+func describeFrame(frame []byte) string {
+	i := 1
+	for i < len(frame) && frame[i] >= 128 {
+		i++
+	}
+	if len(frame) < 2 || i >= len(frame) {
+		return fmt.Sprintf("malformed %x", frame)
+	}
+
+	p := decodeTracedPacket(frame[0], frame[i+1:])
+	desc := fmt.Sprintf("%s (%dB)", p.Type, len(frame))
+	if p.PacketID != 0 {
+		desc += fmt.Sprintf(" id=%d", p.PacketID)
+	}
+	if p.Topic != "" {
+		desc += fmt.Sprintf(" topic=%q qos=%d", p.Topic, p.QoS)
+	}
+	return desc
+}
@@ -0,0 +1,165 @@
+package gott
+
+import (
+	gob "bytes"
+	"sort"
+	"sync"
+)
+
+// retainedStore indexes the retained messages by topic name in a trie of their own,
+// independent from the subscriptions in the Topic Tree.
+// Only levels on the path to a retained message exist, they are pruned when it is cleared.
+type retainedStore struct {
+	root  *retainedNode
+	count int
+	mutex sync.RWMutex
+}
+
+type retainedNode struct {
+	parent   *retainedNode
+	name     string
+	children map[string]*retainedNode
+	msg      *message
+}
+
+func newRetainedStore() *retainedStore {
+	return &retainedStore{root: &retainedNode{}}
+}
+
+// set retains msg on a valid topic name, a nil msg clears it.
+func (rs *retainedStore) set(topic []byte, msg *message) {
+	segs := gob.Split(topic, topicDelim)
+
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	if msg == nil {
+		node := rs.root.find(segs)
+		if node == nil || node.msg == nil {
+			return
+		}
+		node.msg = nil
+		rs.count--
+
+		// prune the levels left empty
+		for node.parent != nil && node.msg == nil && len(node.children) == 0 {
+			delete(node.parent.children, node.name)
+			node = node.parent
+		}
+		return
+	}
+
+	node := rs.root
+	for _, seg := range segs {
+		child := node.children[string(seg)]
+		if child == nil {
+			if node.children == nil {
+				node.children = make(map[string]*retainedNode)
+			}
+			child = &retainedNode{parent: node, name: string(seg)}
+			node.children[child.name] = child
+		}
+		node = child
+	}
+
+	if node.msg == nil {
+		rs.count++
+	}
+	node.msg = msg
+}
+
+// get returns the message retained on a topic name or nil.
+func (rs *retainedStore) get(topic []byte) *message {
+	rs.mutex.RLock()
+	defer rs.mutex.RUnlock()
+
+	if node := rs.root.find(gob.Split(topic, topicDelim)); node != nil {
+		return node.msg
+	}
+	return nil
+}
+
+// match returns the retained messages whose topic matches a valid topic filter in the order they were received.
+func (rs *retainedStore) match(filter []byte) []*message {
+	var matches []*message
+
+	rs.mutex.RLock()
+	rs.root.match(gob.Split(filter, topicDelim), &matches)
+	rs.mutex.RUnlock()
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Timestamp.Before(matches[j].Timestamp)
+	})
+	return matches
+}
+
+// len returns the number of retained messages.
+func (rs *retainedStore) len() int {
+	rs.mutex.RLock()
+	defer rs.mutex.RUnlock()
+	return rs.count
+}
+
+// forEach calls fn for every retained message. fn must not modify the store.
+func (rs *retainedStore) forEach(fn func(msg *message)) {
+	rs.mutex.RLock()
+	defer rs.mutex.RUnlock()
+	rs.root.walk(fn)
+}
+
+func (n *retainedNode) find(segs [][]byte) *retainedNode {
+	for _, seg := range segs {
+		if n = n.children[string(seg)]; n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+func (n *retainedNode) match(segs [][]byte, matches *[]*message) {
+	if len(segs) == 0 {
+		if n.msg != nil {
+			*matches = append(*matches, n.msg)
+		}
+		return
+	}
+
+	seg := segs[0]
+	isRoot := n.parent == nil
+
+	switch {
+	case gob.Equal(seg, topicMultiLevelWildcard):
+		// "a/#" also matches "a" as per [MQTT-4.7.1-2]
+		if !isRoot && n.msg != nil {
+			*matches = append(*matches, n.msg)
+		}
+		for name, child := range n.children {
+			if isRoot && name != "" && name[0] == '$' { // as per [MQTT-4.7.2-1]
+				continue
+			}
+			child.walk(func(msg *message) {
+				*matches = append(*matches, msg)
+			})
+		}
+	case gob.Equal(seg, topicSingleLevelWildcard):
+		for name, child := range n.children {
+			if isRoot && name != "" && name[0] == '$' { // as per [MQTT-4.7.2-1]
+				continue
+			}
+			child.match(segs[1:], matches)
+		}
+	default:
+		if child := n.children[string(seg)]; child != nil {
+			child.match(segs[1:], matches)
+		}
+	}
+}
+
+func (n *retainedNode) walk(fn func(msg *message)) {
+	if n.msg != nil {
+		fn(n.msg)
+	}
+	for _, child := range n.children {
+		child.walk(fn)
+	}
+}
@@ -1,18 +1,34 @@
 package gott
 
+import (
+	"sync/atomic"
+	"time"
+)
+
 type session struct {
-	client       *Client
-	clean        bool
-	ID           string
-	MessageStore *messageStore
+	client         *Client
+	clean          bool
+	ID             string
+	MessageStore   *messageStore // inflight messages
+	Inbound        *messageStore // QoS 2 messages received from the client, waiting for their PUBREL
+	Queue          *messageQueue // messages published while the client was offline
+	DisconnectedAt time.Time     // when the last client of a persistent session disconnected, zero while connected
 }
 
 func newSession(client *Client, cleanFlag bool) *session {
+	s := newStoredSession(client.ClientID)
+	s.client = client
+	s.clean = cleanFlag
+	return s
+}
+
+// newStoredSession returns an empty session to load a stored session into.
+func newStoredSession(id string) *session {
 	return &session{
-		client:       client,
-		clean:        cleanFlag,
+		ID:           id,
 		MessageStore: newMessageStore(),
-		ID:           client.ClientID,
+		Inbound:      newMessageStore(),
+		Queue:        newMessageQueue(),
 	}
 }
 
@@ -24,37 +40,200 @@ func (s *session) load() error {
 	return err
 }
 
+// put saves the metadata of a persistent session.
 func (s *session) put() error {
 	//start := time.Now()
-	err := GOTT.SessionStore.set(s.ID, s)
+	err := GOTT.SessionStore.put(s)
 	//end := time.Since(start)
 	//LogBench("session put took:", end)
 	return err
 }
 
-func (s *session) storeMessage(packetID uint16, msg *clientMessage) {
-	s.MessageStore.store(packetID, msg)
+// enqueue queues a message for the offline client of a persistent session. Returns false if the message
+// was dropped because of the queue limits. Only the message and the messages it displaced are written.
+func (s *session) enqueue(topic, payload []byte, qos byte) bool {
+	e := &queueEntry{Topic: topic, Payload: payload, QoS: qos, QueuedAt: time.Now()}
+	_, ok := s.Queue.push(e, GOTT.config.Sessions.Queue, func(dropped []*queueEntry, ok bool) {
+		s.stored(e, dropped, ok)
+	})
+
+	// publishers that matched the subscriptions before they were reattached to a reconnecting client
+	// may push to the queue after it was replayed
+	if live := s.Queue.liveSession(); ok && live != nil {
+		live.sendQueued()
+	}
+	return ok
+}
+
+// hold queues a message published to the connected client of a persistent session until the client was sent
+// the messages queued before it connected. Returns held false, without queuing it, once it was.
+func (s *session) hold(topic, payload []byte, qos byte) (held, ok bool) {
+	e := &queueEntry{Topic: topic, Payload: payload, QoS: qos, QueuedAt: time.Now()}
+	_, ok, held = s.Queue.hold(e, GOTT.config.Sessions.Queue, func(dropped []*queueEntry, ok bool) {
+		s.stored(e, dropped, ok)
+	})
+	return held, ok
+}
+
+// stored writes a message pushed to the queue, if it was queued, and deletes the messages it displaced.
+// It's called with the queue locked so a client draining the queue can't delete the message before it's written.
+func (s *session) stored(e *queueEntry, dropped []*queueEntry, ok bool) {
+	var ops []StoreOp
+	for _, d := range dropped {
+		ops = append(ops, StoreOp{Key: sessionQueueKey(s.ID, d.seq), Delete: true})
+	}
+	if ok {
+		ops = append(ops, StoreOp{Key: sessionQueueKey(s.ID, e.seq), Value: encodeQueueEntry(e)})
+	}
+	n := len(dropped)
+	if !ok {
+		n++
+	}
+	if n > 0 {
+		// the dropped count is part of the metadata
+		atomic.AddInt64(&metrics.droppedMessages, int64(n))
+		ops = append(ops, StoreOp{Key: sessionMetaKey(s.ID), Value: encodeSessionMetaDropped(s, s.Queue.Dropped)})
+	}
+	_ = GOTT.SessionStore.batch(ops)
+}
+
+// nextPacketID returns a packet identifier that isn't used by an inflight message of the session,
+// which may have been restored with identifiers assigned before the broker restarted.
+func (s *session) nextPacketID() uint16 {
+	for i := 0; i < 1<<16; i++ {
+		if packetID := uint16(packetSeq.next()); s.MessageStore.get(packetID) == nil {
+			return packetID
+		}
+	}
+	return uint16(packetSeq.next())
+}
+
+// track keeps a QoS 1 or 2 message sent to the client inflight until it's acknowledged, and resends it until then.
+// For persistent sessions it's written to the store before being sent so it's resent after a crash of the broker.
+func (s *session) track(packetID uint16, cm *clientMessage) {
+	s.MessageStore.store(packetID, cm)
+	go Retry(packetID, cm)
+	if s.clean {
+		return
+	}
+	_ = GOTT.SessionStore.batch([]StoreOp{{Key: sessionInflightKey(s.ID, packetID), Value: encodeClientMessage(cm)}})
+}
+
+// received checks whether a QoS 2 message from the client is waiting for its PUBREL.
+func (s *session) received(packetID uint16) bool {
+	return s.Inbound.get(packetID) != nil
+}
+
+// receive keeps a QoS 2 message from the client with its packet identifier until its PUBREL, persisted for
+// persistent sessions so it's neither lost nor published twice after a crash of the broker.
+// Messages received by older versions were already published and only hold the topic, with StatusPubrecReceived.
+func (s *session) receive(packetID uint16, topic, payload []byte, retain bool) {
+	cm := &clientMessage{Topic: topic, Payload: payload, QoS: 2, Status: StatusUnacknowledged}
+	if retain {
+		cm.Retain = 1
+	}
+	s.Inbound.store(packetID, cm)
+	if !s.clean {
+		_ = GOTT.SessionStore.batch([]StoreOp{{Key: sessionInboundKey(s.ID, packetID), Value: encodeClientMessage(cm)}})
+	}
+}
+
+// release forgets a QoS 2 message from the client once it's published after its PUBREL.
+func (s *session) release(packetID uint16) {
+	if !s.received(packetID) {
+		return
+	}
+	s.Inbound.acknowledge(packetID, StatusPubrelReceived, true)
 	if !s.clean {
-		_ = s.put()
+		_ = GOTT.SessionStore.batch([]StoreOp{{Key: sessionInboundKey(s.ID, packetID), Delete: true}})
 	}
 }
 
 func (s *session) acknowledge(packetID uint16, status int32, delete bool) {
+	cm := s.MessageStore.get(packetID)
 	s.MessageStore.acknowledge(packetID, status, delete)
-	if !s.clean {
-		_ = s.put()
+	if s.clean || cm == nil {
+		return
+	}
+
+	if delete {
+		_ = GOTT.SessionStore.batch([]StoreOp{{Key: sessionInflightKey(s.ID, packetID), Delete: true}})
+	} else {
+		_ = GOTT.SessionStore.batch([]StoreOp{{Key: sessionInflightKey(s.ID, packetID), Value: encodeClientMessage(cm)}})
 	}
 }
 
+// replay resends the inflight messages of a persistent session, then sends its queued messages in the order
+// they were queued, including the ones published while they're sent, until the queue is empty.
+// Messages published to the client are sent directly from then on.
 func (s *session) replay() {
-	if s.clean {
+	if s.clean || s.client == nil {
+		return
+	}
+
+	s.MessageStore.RangeSorted(func(packetID uint16, cm *clientMessage) bool {
+		GOTT.resume(s.client, packetID, cm)
+		return true
+	})
+
+	for {
+		s.sendQueued()
+		if s.Queue.deliver(s) {
+			return
+		}
+	}
+}
+
+// sendQueued sends the queued messages of a persistent session. They get their packet identifiers now and stay
+// inflight until acknowledged. They're moved from the queue to the inflight messages in the store with a single
+// batch, written with the queue locked as the messages pushed to it are, before being sent.
+func (s *session) sendQueued() {
+	var packetIDs []uint16
+	var messages []*clientMessage
+	entries, _ := s.Queue.drain(GOTT.config.Sessions.Queue, time.Now(), func(entries, expired []*queueEntry) {
+		if len(entries) == 0 && len(expired) == 0 {
+			return
+		}
+
+		ops := make([]StoreOp, 0, 2*len(entries)+len(expired)+1)
+		for _, e := range expired {
+			ops = append(ops, StoreOp{Key: sessionQueueKey(s.ID, e.seq), Delete: true})
+		}
+		if len(expired) > 0 {
+			atomic.AddInt64(&metrics.droppedMessages, int64(len(expired)))
+			ops = append(ops, StoreOp{Key: sessionMetaKey(s.ID), Value: encodeSessionMetaDropped(s, s.Queue.Dropped)})
+		}
+
+		packetIDs = make([]uint16, len(entries))
+		messages = make([]*clientMessage, len(entries))
+		for i, e := range entries {
+			ops = append(ops, StoreOp{Key: sessionQueueKey(s.ID, e.seq), Delete: true})
+			if e.QoS == 0 {
+				continue
+			}
+
+			packetIDs[i] = s.nextPacketID()
+			messages[i] = &clientMessage{
+				Topic:   e.Topic,
+				Payload: e.Payload,
+				QoS:     e.QoS,
+				Status:  StatusUnacknowledged,
+			}
+			s.MessageStore.store(packetIDs[i], messages[i])
+			ops = append(ops, StoreOp{Key: sessionInflightKey(s.ID, packetIDs[i]), Value: encodeClientMessage(messages[i])})
+		}
+		_ = GOTT.SessionStore.batch(ops)
+	})
+	if len(entries) == 0 {
 		return
 	}
 
-	if s.client != nil {
-		s.MessageStore.RangeSorted(func(packetId uint16, cm *clientMessage) bool {
-			GOTT.PublishToClient(s.client, packetId, cm)
-			return true
-		})
+	for i, e := range entries {
+		if e.QoS == 0 {
+			packet, _ := makePublishPacket(e.Topic, e.Payload, 0, 0, 0)
+			s.client.emit(packet)
+			continue
+		}
+		GOTT.PublishToClient(s.client, packetIDs[i], messages[i])
 	}
 }
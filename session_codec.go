@@ -0,0 +1,244 @@
+package gott
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Sessions are stored as one key for their metadata and one key per inflight message, QoS 2 message received
+// and waiting for its PUBREL, queued message and subscription, so storing or acknowledging a message only
+// writes that message.
+// Keys start with a zero byte, which MQTT client IDs can't contain, followed by the kind of record and
+// the length prefixed client ID. Sessions stored as a single JSON value under their client ID by older
+// versions are migrated when the store is opened.
+// Retained messages are stored in the same store, with the topic name in place of the client ID.
+const (
+	sessionKeyMeta         = 's'
+	sessionKeyInflight     = 'i'
+	sessionKeyInbound      = 'r'
+	sessionKeyQueue        = 'q'
+	sessionKeySubscription = 'f'
+	sessionKeyRetained     = 'm'
+
+	sessionCodecVersion = 1
+)
+
+var errCorruptSessionRecord = errors.New("corrupt session record")
+
+// sessionKindPrefix returns the prefix of the keys of one kind of all the sessions.
+func sessionKindPrefix(kind byte) string {
+	return string([]byte{0, kind})
+}
+
+// sessionKeyPrefix returns the prefix of the keys of one kind of a single session.
+func sessionKeyPrefix(kind byte, id string) string {
+	key := make([]byte, 4, 4+len(id))
+	key[1] = kind
+	binary.BigEndian.PutUint16(key[2:], uint16(len(id)))
+	return string(append(key, id...))
+}
+
+func sessionMetaKey(id string) string {
+	return sessionKeyPrefix(sessionKeyMeta, id)
+}
+
+func sessionInflightKey(id string, packetID uint16) string {
+	var suffix [2]byte
+	binary.BigEndian.PutUint16(suffix[:], packetID)
+	return sessionKeyPrefix(sessionKeyInflight, id) + string(suffix[:])
+}
+
+func sessionInboundKey(id string, packetID uint16) string {
+	var suffix [2]byte
+	binary.BigEndian.PutUint16(suffix[:], packetID)
+	return sessionKeyPrefix(sessionKeyInbound, id) + string(suffix[:])
+}
+
+func sessionQueueKey(id string, seq uint64) string {
+	var suffix [8]byte
+	binary.BigEndian.PutUint64(suffix[:], seq)
+	return sessionKeyPrefix(sessionKeyQueue, id) + string(suffix[:])
+}
+
+func sessionSubscriptionKey(id string, filter []byte) string {
+	return sessionKeyPrefix(sessionKeySubscription, id) + string(filter)
+}
+
+func retainedKey(topic []byte) string {
+	return sessionKeyPrefix(sessionKeyRetained, string(topic))
+}
+
+// parseSessionKey splits a key into its kind, client ID and suffix.
+func parseSessionKey(key string) (kind byte, id, suffix string, ok bool) {
+	if len(key) < 4 || key[0] != 0 {
+		return 0, "", "", false
+	}
+	n := int(binary.BigEndian.Uint16([]byte(key[2:4])))
+	if len(key) < 4+n {
+		return 0, "", "", false
+	}
+	return key[1], key[4 : 4+n], key[4+n:], true
+}
+
+// legacySessionKey checks whether a key holds a whole session stored as JSON by an older version.
+func legacySessionKey(key string) bool {
+	return len(key) > 0 && key[0] != 0
+}
+
+func encodeSessionMeta(s *session) []byte {
+	return encodeSessionMetaDropped(s, s.Queue.dropped())
+}
+
+// encodeSessionMetaDropped is encodeSessionMeta with the dropped count of the queue, read with its lock held.
+func encodeSessionMetaDropped(s *session, dropped int64) []byte {
+	b := []byte{sessionCodecVersion}
+	b = appendTime(b, s.DisconnectedAt)
+	return appendUvarint(b, uint64(dropped))
+}
+
+func decodeSessionMeta(b []byte, s *session) error {
+	d := sessionDecoder{b: b}
+	if d.byte() != sessionCodecVersion {
+		return errCorruptSessionRecord
+	}
+	s.DisconnectedAt = d.time()
+	s.Queue.Dropped = int64(d.uvarint())
+	return d.err
+}
+
+func encodeClientMessage(cm *clientMessage) []byte {
+	b := make([]byte, 0, 24+len(cm.Topic)+len(cm.Payload))
+	b = append(b, cm.QoS, cm.Retain)
+	b = appendUvarint(b, uint64(cm.Status))
+	b = appendVarint(b, cm.StoredAt)
+	b = appendBytes(b, cm.Topic)
+	return append(b, cm.Payload...)
+}
+
+func decodeClientMessage(b []byte) (*clientMessage, error) {
+	d := sessionDecoder{b: b}
+	cm := &clientMessage{QoS: d.byte(), Retain: d.byte()}
+	cm.Status = int32(d.uvarint())
+	cm.StoredAt = d.varint()
+	cm.Topic = d.bytes()
+	cm.Payload = d.rest()
+	return cm, d.err
+}
+
+func encodeQueueEntry(e *queueEntry) []byte {
+	b := make([]byte, 0, 16+len(e.Topic)+len(e.Payload))
+	b = append(b, e.QoS)
+	b = appendTime(b, e.QueuedAt)
+	b = appendBytes(b, e.Topic)
+	return append(b, e.Payload...)
+}
+
+func decodeQueueEntry(b []byte, seq uint64) (*queueEntry, error) {
+	d := sessionDecoder{b: b}
+	e := &queueEntry{seq: seq, QoS: d.byte()}
+	e.QueuedAt = d.time()
+	e.Topic = d.bytes()
+	e.Payload = d.rest()
+	return e, d.err
+}
+
+func encodeRetainedMessage(msg *message) []byte {
+	b := make([]byte, 0, 12+len(msg.Payload))
+	b = append(b, msg.QoS)
+	b = appendTime(b, msg.Timestamp)
+	return append(b, msg.Payload...)
+}
+
+func decodeRetainedMessage(topic string, b []byte) (*message, error) {
+	d := sessionDecoder{b: b}
+	msg := &message{Topic: []byte(topic), QoS: d.byte()}
+	msg.Timestamp = d.time()
+	msg.Payload = d.rest()
+	return msg, d.err
+}
+
+func appendVarint(b []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+func appendBytes(b, v []byte) []byte {
+	return append(appendUvarint(b, uint64(len(v))), v...)
+}
+
+// appendTime encodes t as unix nanoseconds, the zero time as 0.
+func appendTime(b []byte, t time.Time) []byte {
+	if t.IsZero() {
+		return appendVarint(b, 0)
+	}
+	return appendVarint(b, t.UnixNano())
+}
+
+// sessionDecoder reads the fields of a record in order. Reads past a malformed field return zero values
+// and the first error is kept in err.
+type sessionDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *sessionDecoder) fail() {
+	if d.err == nil {
+		d.err = errCorruptSessionRecord
+	}
+	d.b = nil
+}
+
+func (d *sessionDecoder) byte() byte {
+	if len(d.b) < 1 {
+		d.fail()
+		return 0
+	}
+	v := d.b[0]
+	d.b = d.b[1:]
+	return v
+}
+
+func (d *sessionDecoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *sessionDecoder) varint() int64 {
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *sessionDecoder) time() time.Time {
+	if v := d.varint(); v != 0 {
+		return time.Unix(0, v)
+	}
+	return time.Time{}
+}
+
+func (d *sessionDecoder) bytes() []byte {
+	n := d.uvarint()
+	if n > uint64(len(d.b)) {
+		d.fail()
+		return nil
+	}
+	v := d.b[:n:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *sessionDecoder) rest() []byte {
+	v := d.b
+	d.b = nil
+	return v
+}
@@ -0,0 +1,227 @@
+package gott
+
+import (
+	gob "bytes"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	js "github.com/json-iterator/go"
+	"go.uber.org/zap"
+)
+
+func TestParseSessionKey(t *testing.T) {
+	for _, tc := range []struct {
+		key          string
+		kind         byte
+		id, suffix   string
+		ok           bool
+		legacyFormat bool
+	}{
+		{key: sessionMetaKey("a/b"), kind: sessionKeyMeta, id: "a/b", ok: true},
+		{key: sessionMetaKey(""), kind: sessionKeyMeta, ok: true},
+		{key: sessionInflightKey("a", 0x0102), kind: sessionKeyInflight, id: "a", suffix: "\x01\x02", ok: true},
+		{key: sessionInboundKey("a", 7), kind: sessionKeyInbound, id: "a", suffix: "\x00\x07", ok: true},
+		{key: sessionQueueKey("a", 1), kind: sessionKeyQueue, id: "a", suffix: "\x00\x00\x00\x00\x00\x00\x00\x01", ok: true},
+		{key: sessionSubscriptionKey("a", []byte("x/#")), kind: sessionKeySubscription, id: "a", suffix: "x/#", ok: true},
+		{key: retainedKey([]byte("x/y")), kind: sessionKeyRetained, id: "x/y", ok: true},
+		{key: "\x00s\x00\x05abc"},             // client ID longer than the key
+		{key: "\x00s\x00"},                    // too short
+		{key: "client-1", legacyFormat: true}, // a whole session stored as JSON
+	} {
+		kind, id, suffix, ok := parseSessionKey(tc.key)
+		if kind != tc.kind || id != tc.id || suffix != tc.suffix || ok != tc.ok {
+			t.Errorf("%q: parsed %q %q %q %v", tc.key, kind, id, suffix, ok)
+		}
+		if legacySessionKey(tc.key) != tc.legacyFormat {
+			t.Errorf("%q: legacy %v", tc.key, !tc.legacyFormat)
+		}
+	}
+
+	// the keys of a session never start with the prefix of another session's keys
+	if prefix := sessionKeyPrefix(sessionKeyQueue, "a"); gob.HasPrefix([]byte(sessionQueueKey("a/b", 0)), []byte(prefix)) {
+		t.Error("the keys of a/b are in the range of a")
+	}
+}
+
+func TestSessionCodecRoundTrip(t *testing.T) {
+	now := time.Unix(1700000000, 123456789)
+
+	s := newStoredSession("a")
+	s.DisconnectedAt = now
+	s.Queue.Dropped = 300
+	out := newStoredSession("a")
+	if err := decodeSessionMeta(encodeSessionMeta(s), out); err != nil || !out.DisconnectedAt.Equal(now) || out.Queue.Dropped != 300 {
+		t.Errorf("meta: %v %v: %v", out.DisconnectedAt, out.Queue.Dropped, err)
+	}
+	// connected sessions have no disconnect time
+	if err := decodeSessionMeta(encodeSessionMeta(newStoredSession("a")), out); err != nil || !out.DisconnectedAt.IsZero() {
+		t.Errorf("meta of a connected session: %v: %v", out.DisconnectedAt, err)
+	}
+
+	cm := &clientMessage{Topic: []byte("a/b"), Payload: []byte{0, 1, 2}, QoS: 2, Retain: 1, Status: StatusPubrecReceived, StoredAt: -5}
+	if got, err := decodeClientMessage(encodeClientMessage(cm)); err != nil || string(got.Topic) != "a/b" || !gob.Equal(got.Payload, cm.Payload) ||
+		got.QoS != 2 || got.Retain != 1 || got.Status != StatusPubrecReceived || got.StoredAt != -5 {
+		t.Errorf("client message: %+v: %v", got, err)
+	}
+
+	e := &queueEntry{Topic: []byte("t"), Payload: nil, QoS: 1, QueuedAt: now}
+	if got, err := decodeQueueEntry(encodeQueueEntry(e), 42); err != nil || string(got.Topic) != "t" || len(got.Payload) != 0 ||
+		got.QoS != 1 || !got.QueuedAt.Equal(now) || got.seq != 42 {
+		t.Errorf("queue entry: %+v: %v", got, err)
+	}
+
+	msg := &message{Topic: []byte("x/y"), Payload: []byte("on"), QoS: 1, Timestamp: now}
+	if got, err := decodeRetainedMessage("x/y", encodeRetainedMessage(msg)); err != nil || string(got.Topic) != "x/y" ||
+		string(got.Payload) != "on" || got.QoS != 1 || !got.Timestamp.Equal(now) {
+		t.Errorf("retained message: %+v: %v", got, err)
+	}
+}
+
+func TestSessionCodecCorrupt(t *testing.T) {
+	now := time.Now()
+	meta := encodeSessionMeta(&session{DisconnectedAt: now, Queue: &messageQueue{Dropped: 1 << 40}})
+	// payloads are the rest of the record, only the fields before them can be truncated
+	cm := encodeClientMessage(&clientMessage{Topic: []byte("a/b"), QoS: 1, Status: StatusUnacknowledged, StoredAt: now.Unix()})
+	e := encodeQueueEntry(&queueEntry{Topic: []byte("a/b"), QoS: 1, QueuedAt: now})
+	msg := encodeRetainedMessage(&message{QoS: 1, Timestamp: now})
+
+	for name, tc := range map[string]struct {
+		record []byte
+		decode func(b []byte) error
+	}{
+		"meta": {meta, func(b []byte) error { return decodeSessionMeta(b, newStoredSession("a")) }},
+		"client message": {cm, func(b []byte) error {
+			_, err := decodeClientMessage(b)
+			return err
+		}},
+		"queue entry": {e, func(b []byte) error {
+			_, err := decodeQueueEntry(b, 0)
+			return err
+		}},
+		"retained message": {msg, func(b []byte) error {
+			_, err := decodeRetainedMessage("t", b)
+			return err
+		}},
+	} {
+		for n := 0; n < len(tc.record); n++ {
+			if err := tc.decode(tc.record[:n]); err != errCorruptSessionRecord {
+				t.Errorf("%s truncated to %d bytes: %v", name, n, err)
+			}
+		}
+	}
+
+	if err := decodeSessionMeta(append([]byte{sessionCodecVersion + 1}, meta[1:]...), newStoredSession("a")); err != errCorruptSessionRecord {
+		t.Errorf("meta of an unknown version: %v", err)
+	}
+	// a topic length past the end of the record
+	if _, err := decodeClientMessage([]byte{1, 0, 0, 0, 0xff, 0xff, 0x03, 'a'}); err != errCorruptSessionRecord {
+		t.Errorf("client message with a topic too long: %v", err)
+	}
+	// a varint that never ends
+	if _, err := decodeQueueEntry(append([]byte{1}, gob.Repeat([]byte{0xff}, 11)...), 0); err != errCorruptSessionRecord {
+		t.Errorf("queue entry with an overflowing time: %v", err)
+	}
+
+	if err := checkSessionRecord(sessionKeyInflight, "\x00\x01", encodeClientMessage(&clientMessage{QoS: 3})); err != ErrInvalidQoS {
+		t.Errorf("inflight message with QoS 3: %v", err)
+	}
+	if err := checkSessionRecord(sessionKeySubscription, "a/#/b", []byte{1}); err == nil {
+		t.Error("invalid subscription filter accepted")
+	}
+}
+
+func TestCorruptSessionFlaggedOnce(t *testing.T) {
+	ss := &sessionStore{SessionStore: newMemoryStore(), logger: zap.NewNop()}
+	_ = ss.Set(sessionMetaKey("a"), []byte{sessionCodecVersion})
+
+	before := atomic.LoadInt64(&metrics.corruptSessions)
+	for i := 0; i < 3; i++ {
+		if err := ss.forEach(func(string, *session) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt64(&metrics.corruptSessions) - before; n != 1 || len(ss.corrupt) != 1 {
+		t.Fatalf("counted %d times, %d flagged", n, len(ss.corrupt))
+	}
+
+	// flagged again once repaired, if it's still corrupt
+	if _, err := ss.repairSession("a"); err != nil {
+		t.Fatal(err)
+	}
+	_ = ss.Set(sessionMetaKey("a"), []byte{sessionCodecVersion})
+	_ = ss.forEach(func(string, *session) error { return nil })
+	if len(ss.corrupt) != 2 {
+		t.Fatalf("%d flagged after a repair", len(ss.corrupt))
+	}
+}
+
+func TestMigrateLegacySessions(t *testing.T) {
+	GOTT = &Broker{config: defaultConfig(), logger: zap.NewNop()}
+	mem := newMemoryStore()
+	ss := &sessionStore{SessionStore: mem, logger: zap.NewNop()}
+	GOTT.SessionStore = ss
+
+	// a session stored as a single JSON value by older versions
+	disconnectedAt := time.Unix(1700000000, 0)
+	legacy := newStoredSession("a/b")
+	legacy.DisconnectedAt = disconnectedAt
+	legacy.MessageStore.store(7, &clientMessage{Topic: []byte("t"), Payload: []byte("inflight"), QoS: 2, Status: StatusPubrecReceived})
+	legacy.Queue.Messages = []*queueEntry{
+		{Topic: []byte("t"), Payload: []byte("q1"), QoS: 1, QueuedAt: disconnectedAt},
+		{Topic: []byte("t"), Payload: []byte("q2"), QoS: 0, QueuedAt: disconnectedAt},
+	}
+	legacy.Queue.Dropped = 4
+	val, err := js.Marshal(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = mem.Set("a/b", val)
+	_ = mem.Set("a", []byte("{broken"))
+
+	// verifying doesn't migrate, the sessions of older versions aren't problems unless they're malformed
+	report, err := ss.verify(false, nil)
+	if n, _ := mem.Count(""); err != nil || n != 2 || report.Sessions != 1 || len(report.Problems) != 1 || report.Problems[0].Key != "61" {
+		t.Fatalf("verified %d keys: %+v: %v", n, report, err)
+	}
+
+	if err := ss.migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// meta, one inflight message and two queued messages, the malformed session is dropped
+	if n, _ := mem.Count(""); n != 4 || ss.count() != 1 || ss.exists("a") {
+		t.Fatalf("%d keys and %d sessions after the migration", n, ss.count())
+	}
+
+	s := newStoredSession("a/b")
+	if err := s.load(); err != nil {
+		t.Fatal(err)
+	}
+	cm := s.MessageStore.get(7)
+	if !s.DisconnectedAt.Equal(disconnectedAt) || s.Queue.len() != 2 || s.Queue.Dropped != 4 ||
+		cm == nil || string(cm.Payload) != "inflight" || cm.Status != StatusPubrecReceived {
+		t.Fatalf("migrated session: %+v", s)
+	}
+
+	// messages queued after the migration follow the migrated ones
+	if !s.enqueue([]byte("t"), []byte("q3"), 1) {
+		t.Fatal("enqueue")
+	}
+	s = newStoredSession("a/b")
+	if err := s.load(); err != nil {
+		t.Fatal(err)
+	}
+	_, entries := s.Queue.snapshot()
+	if len(entries) != 3 || string(entries[0].Payload) != "q1" || string(entries[2].Payload) != "q3" || entries[2].seq != 2 {
+		t.Fatalf("queue after the migration: %+v", entries)
+	}
+
+	// migrating again is a no-op
+	if err := ss.migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := mem.Count(""); n != 5 {
+		t.Fatalf("%d keys after migrating again", n)
+	}
+}
@@ -0,0 +1,80 @@
+package gott
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// sweepSessions deletes the persistent sessions that expired every interval until the broker exits.
+func (b *Broker) sweepSessions(expiry, interval time.Duration) {
+	defer Recover(nil)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		b.expireSessions(expiry, time.Now())
+	}
+}
+
+// expireSessions deletes the sessions of clients that have been disconnected for longer than expiry,
+// along with their queued messages and subscriptions. Sessions stored before expiry was tracked,
+// without a disconnect time, start expiring now.
+func (b *Broker) expireSessions(expiry time.Duration, now time.Time) (expired int) {
+	var ids, untracked []string
+	err := b.SessionStore.forEach(func(id string, s *session) error {
+		if s.DisconnectedAt.IsZero() {
+			untracked = append(untracked, id)
+		} else if now.Sub(s.DisconnectedAt) > expiry {
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("error sweeping sessions:", err)
+		b.logger.Error("session sweep", zap.Error(err))
+	}
+
+	// a client connecting is registered before it loads its session, checking that it isn't connected and
+	// changing the session with its registry shard locked keeps it from loading a session being deleted
+	for _, id := range untracked {
+		b.clients.ifAbsent(id, func() {
+			s := newStoredSession(id)
+			if b.SessionStore.get(id, s) == nil && s.DisconnectedAt.IsZero() {
+				s.DisconnectedAt = now
+				_ = b.SessionStore.put(s)
+			}
+		})
+	}
+
+	for _, id := range ids {
+		var err error
+		deleted := false
+		b.clients.ifAbsent(id, func() {
+			// the client may have reconnected and disconnected again since the sweep started
+			s := newStoredSession(id)
+			if b.SessionStore.get(id, s) != nil || s.DisconnectedAt.IsZero() || now.Sub(s.DisconnectedAt) <= expiry {
+				return
+			}
+			b.TopicFilterStorage.deleteSessionSubscriptions(id)
+			err = b.SessionStore.delete(id)
+			deleted = err == nil
+		})
+		if err != nil {
+			log.Println("error deleting expired session:", err)
+			b.logger.Error("session expiry", zap.String("id", id), zap.Error(err))
+		}
+		if !deleted {
+			continue
+		}
+
+		expired++
+		atomic.AddInt64(&metrics.expiredSessions, 1)
+		b.logger.Info("session expired", zap.String("id", id))
+		b.invokeOnSessionExpired(id)
+	}
+	return
+}
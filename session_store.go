@@ -1,83 +1,386 @@
 package gott
 
 import (
-	"github.com/dgraph-io/badger"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
 	js "github.com/json-iterator/go"
+	"go.uber.org/zap"
 )
 
-type sessionStore struct {
-	*badger.DB
+// Session store backends selectable with sessions.store.backend.
+const (
+	SessionStoreBadger = "badger" // badger database in a directory, the default
+	SessionStoreMemory = "memory" // kept in memory only, lost when the broker exits
+	SessionStoreLog    = "log"    // append-only log file in a directory, loaded in memory on start
+)
+
+// ErrKeyNotFound is returned by a SessionStore when a key doesn't exist.
+var ErrKeyNotFound = errors.New("key not found")
+
+// StoreOp is a write of a SessionStore batch, Value is ignored by deletes.
+type StoreOp struct {
+	Key    string
+	Value  []byte
+	Delete bool
 }
 
-func loadSessionStore() (*sessionStore, error) {
-	opts := badger.DefaultOptions(".sessions.store").WithEventLogging(false)
+// SessionStore is the key-value store persistent sessions are saved to.
+// Values passed to Set and Batch may be reused by the caller once they return, values passed to
+// the callers of Get and Iterate must not be modified.
+type SessionStore interface {
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte) error
+	// Batch applies the ops in order, with as few writes to disk as the backend allows.
+	Batch(ops []StoreOp) error
+	Delete(key string) error
+	Exists(key string) bool
+	// Iterate calls fn for every key starting with prefix, in key order, and stops at the first error.
+	Iterate(prefix string, fn func(key string, value []byte) error) error
+	// Count returns the number of keys starting with prefix.
+	Count(prefix string) (int, error)
+	Close() error
+}
 
-	db, err := badger.Open(opts)
+// openSessionStore opens the session store backend selected in the config.
+// A backend opened read-only fails every write.
+func openSessionStore(cnf sessionStoreConfig, readOnly bool) (SessionStore, error) {
+	switch cnf.Backend {
+	case SessionStoreBadger, "":
+		return openBadgerStore(cnf.Path, cnf.Sync, readOnly)
+	case SessionStoreMemory:
+		return newMemoryStore(), nil
+	case SessionStoreLog:
+		return openLogStore(cnf.Path, cnf.Sync, readOnly)
+	default:
+		return nil, fmt.Errorf("unknown session store backend: %s", cnf.Backend)
+	}
+}
+
+// sessionStore encodes sessions to and from the configured SessionStore backend, see session_codec.go.
+type sessionStore struct {
+	SessionStore
+	config sessionStoreConfig
+	logger *zap.Logger
+
+	// health, see session_store_maintenance.go
+	healthMutex    sync.Mutex
+	corrupt        []StoreProblem
+	flagged        map[string]bool // client IDs of the corrupt sessions reported since they were last repaired
+	lastGC         time.Time
+	lastCompaction time.Time
+	lastError      string
+}
+
+func loadSessionStore(cnf sessionStoreConfig, logger *zap.Logger) (*sessionStore, error) {
+	if cnf.Backend != SessionStoreMemory {
+		if err := recoverRekey(cnf.Path); err != nil {
+			return nil, err
+		}
+	}
+	ss, err := openEncryptedSessionStore(cnf, false, logger)
 	if err != nil {
 		return nil, err
 	}
 
-	return &sessionStore{db}, nil
+	if es, ok := ss.SessionStore.(*encryptedStore); ok {
+		stale, err := es.staleRecords()
+		if err != nil {
+			_ = ss.Close()
+			return nil, err
+		}
+		if _, onDisk := ss.maintained(); stale > 0 && onDisk {
+			// the store is closed and replaced with a copy, which is loaded instead
+			if err := rekeySessionStore(ss, es, stale); err != nil {
+				err = fmt.Errorf("encrypting the session store with the current key: %v", err)
+				log.Println(err)
+				logger.Error("session store rekey", zap.Error(err))
+				return nil, err
+			}
+			return loadSessionStore(cnf, logger)
+		} else if stale > 0 {
+			if err := es.rekey(); err != nil {
+				_ = ss.Close()
+				return nil, err
+			}
+		}
+	}
+	if err := ss.migrate(); err != nil {
+		_ = ss.Close()
+		return nil, err
+	}
+	return ss, nil
 }
 
-func (ss *sessionStore) get(key string, out *session) error {
-	return ss.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(key))
+// inspectSessionStore opens the session store read-only, so it can't be repaired or compacted: records in
+// plaintext or encrypted with a previous key aren't encrypted with the current key, sessions stored by older
+// versions aren't migrated and an interrupted rekey isn't recovered, the complete copy is read instead.
+func inspectSessionStore(cnf sessionStoreConfig, logger *zap.Logger) (*sessionStore, error) {
+	if cnf.Backend != SessionStoreMemory {
+		cnf.Path = rekeyedPath(cnf.Path)
+	}
+	return openEncryptedSessionStore(cnf, true, logger)
+}
+
+// openEncryptedSessionStore opens the backend and decrypts it with the configured keys, or checks it holds no
+// encrypted records if encryption isn't enabled.
+func openEncryptedSessionStore(cnf sessionStoreConfig, readOnly bool, logger *zap.Logger) (*sessionStore, error) {
+	backend, err := openSessionStore(cnf, readOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	if cnf.Encryption.Enabled() {
+		keys, err := loadStoreKeys(cnf.Encryption)
 		if err != nil {
-			return err
+			_ = backend.Close()
+			return nil, err
 		}
+		backend = &encryptedStore{SessionStore: backend, keys: keys}
+	} else if err := checkUnencrypted(backend); err != nil {
+		_ = backend.Close()
+		return nil, err
+	}
 
-		return item.Value(func(val []byte) error {
-			return js.Unmarshal(val, out)
-		})
-	})
+	return &sessionStore{SessionStore: backend, config: cnf, logger: logger}, nil
 }
 
-func (ss *sessionStore) exists(key string) bool {
-	return ss.View(func(txn *badger.Txn) error {
-		_, err := txn.Get([]byte(key))
-		return err
-	}) == nil
+// openConfiguredSessionStore opens the session store of the config file for the offline commands with open,
+// loadSessionStore or inspectSessionStore.
+func openConfiguredSessionStore(open func(sessionStoreConfig, *zap.Logger) (*sessionStore, error)) (*sessionStore, error) {
+	c, err := newConfig()
+	if err != nil {
+		return nil, err
+	}
+	return open(c.Sessions.Store, NewLogger(c.Logging))
 }
 
-func (ss *sessionStore) set(key string, value interface{}) error {
-	txn := ss.NewTransaction(true)
+// get loads a session with its inflight and queued messages.
+func (ss *sessionStore) get(id string, out *session) error {
+	defer metrics.sessionStoreOp("get", time.Now())
 
-	if err := set(txn, key, value); err == badger.ErrTxnTooBig {
-		err = txn.Commit()
+	val, err := ss.Get(sessionMetaKey(id))
+	if err != nil {
+		return err
+	}
+	if err := decodeSessionMeta(val, out); err != nil {
+		return err
+	}
+
+	for kind, ms := range map[byte]*messageStore{sessionKeyInflight: out.MessageStore, sessionKeyInbound: out.Inbound} {
+		err = ss.Iterate(sessionKeyPrefix(kind, id), func(key string, val []byte) error {
+			_, _, suffix, _ := parseSessionKey(key)
+			cm, err := decodeClientMessage(val)
+			if err != nil || len(suffix) != 2 {
+				return errCorruptSessionRecord
+			}
+			ms.Messages[binary.BigEndian.Uint16([]byte(suffix))] = cm
+			return nil
+		})
 		if err != nil {
 			return err
 		}
+	}
 
-		txn = ss.NewTransaction(true)
-		err := set(txn, key, value)
+	out.Queue.Messages = nil
+	err = ss.Iterate(sessionKeyPrefix(sessionKeyQueue, id), func(key string, val []byte) error {
+		_, _, suffix, _ := parseSessionKey(key)
+		if len(suffix) != 8 {
+			return errCorruptSessionRecord
+		}
+		e, err := decodeQueueEntry(val, binary.BigEndian.Uint64([]byte(suffix)))
 		if err != nil {
 			return err
 		}
-	} else if err != nil {
+		out.Queue.Messages = append(out.Queue.Messages, e)
+		return nil
+	})
+	if err != nil {
 		return err
 	}
+	out.Queue.loaded()
+	return nil
+}
 
-	err := txn.Commit()
+func (ss *sessionStore) exists(id string) bool {
+	return ss.Exists(sessionMetaKey(id))
+}
 
+// put saves the metadata of a session, its messages are saved as they're queued and acknowledged.
+func (ss *sessionStore) put(s *session) error {
+	defer metrics.sessionStoreOp("set", time.Now())
+	return ss.Set(sessionMetaKey(s.ID), encodeSessionMeta(s))
+}
+
+// batch applies the ops of a session.
+func (ss *sessionStore) batch(ops []StoreOp) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	defer metrics.sessionStoreOp("set", time.Now())
+	return ss.Batch(ops)
+}
+
+// save writes a whole session with all its messages.
+func (ss *sessionStore) save(s *session) error {
+	ops := []StoreOp{{Key: sessionMetaKey(s.ID), Value: encodeSessionMeta(s)}}
+	s.MessageStore.Range(func(packetID uint16, cm *clientMessage) bool {
+		ops = append(ops, StoreOp{Key: sessionInflightKey(s.ID, packetID), Value: encodeClientMessage(cm)})
+		return true
+	})
+	_, entries := s.Queue.snapshot()
+	for _, e := range entries {
+		ops = append(ops, StoreOp{Key: sessionQueueKey(s.ID, e.seq), Value: encodeQueueEntry(e)})
+	}
+	return ss.batch(ops)
+}
+
+// delete removes a session with its messages and subscriptions.
+func (ss *sessionStore) delete(id string) error {
+	defer metrics.sessionStoreOp("delete", time.Now())
+
+	ops := []StoreOp{{Key: sessionMetaKey(id), Delete: true}}
+	for _, kind := range []byte{sessionKeyInflight, sessionKeyInbound, sessionKeyQueue, sessionKeySubscription} {
+		err := ss.Iterate(sessionKeyPrefix(kind, id), func(key string, _ []byte) error {
+			ops = append(ops, StoreOp{Key: key, Delete: true})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := ss.Batch(ops); err != nil {
+		return err
+	}
+	ss.unflag(id)
+	return nil
+}
+
+// forEach loads every session in the store and passes it to fn.
+// Sessions that can't be decoded are flagged as corrupt and skipped, iteration stops at the first error
+// returned by fn or by the backend.
+func (ss *sessionStore) forEach(fn func(id string, s *session) error) error {
+	var ids []string
+	err := ss.Iterate(sessionKindPrefix(sessionKeyMeta), func(key string, _ []byte) error {
+		if _, id, _, ok := parseSessionKey(key); ok {
+			ids = append(ids, id)
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
+	for _, id := range ids {
+		s := newStoredSession(id)
+		if err := ss.get(id, s); err == ErrKeyNotFound {
+			continue // deleted since
+		} else if err == errCorruptSessionRecord {
+			ss.flagCorrupt(id, err)
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := fn(id, s); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (ss *sessionStore) delete(key string) error {
-	return ss.Update(func(txn *badger.Txn) error {
-		return txn.Delete([]byte(key))
-	})
+// count returns the number of sessions in the store.
+func (ss *sessionStore) count() int {
+	n, _ := ss.Count(sessionKindPrefix(sessionKeyMeta))
+	return n
 }
 
-func set(txn *badger.Txn, key string, value interface{}) error {
-	valJSON, err := js.Marshal(value)
+// setSubscription saves a subscription of a persistent session.
+func (ss *sessionStore) setSubscription(id string, filter []byte, qos byte) error {
+	return ss.Set(sessionSubscriptionKey(id, filter), []byte{qos})
+}
+
+func (ss *sessionStore) deleteSubscription(id string, filter []byte) error {
+	return ss.Delete(sessionSubscriptionKey(id, filter))
+}
+
+// deleteSubscriptions removes all the saved subscriptions of a session.
+func (ss *sessionStore) deleteSubscriptions(id string) error {
+	var ops []StoreOp
+	err := ss.Iterate(sessionKeyPrefix(sessionKeySubscription, id), func(key string, _ []byte) error {
+		ops = append(ops, StoreOp{Key: key, Delete: true})
+		return nil
+	})
 	if err != nil {
+		return err
+	}
+	return ss.batch(ops)
+}
+
+// forEachSubscription calls fn for every saved subscription.
+func (ss *sessionStore) forEachSubscription(fn func(id string, filter []byte, qos byte)) error {
+	return ss.Iterate(sessionKindPrefix(sessionKeySubscription), func(key string, val []byte) error {
+		if _, id, filter, ok := parseSessionKey(key); ok && len(val) == 1 {
+			fn(id, []byte(filter), val[0])
+		}
+		return nil
+	})
+}
+
+// migrate converts the sessions stored as a single JSON value by older versions to separate keys.
+// Sessions that can't be decoded are deleted, as they would be when their client connects.
+func (ss *sessionStore) migrate() error {
+	var legacy []string
+	err := ss.Iterate("", func(key string, _ []byte) error {
+		if legacySessionKey(key) {
+			legacy = append(legacy, key)
+		}
 		return nil
+	})
+	if err != nil || len(legacy) == 0 {
+		return err
 	}
 
-	return txn.Set([]byte(key), valJSON)
+	for _, id := range legacy {
+		val, err := ss.Get(id)
+		if err != nil {
+			return err
+		}
+
+		s := newStoredSession(id)
+		if err := decodeLegacySession(val, s); err != nil {
+			log.Println("deleting malformed session:", id, err)
+			ss.logger.Error("session migration", zap.String("id", id), zap.Error(err))
+		} else if err := ss.save(s); err != nil {
+			return err
+		}
+		if err := ss.Delete(id); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("migrated %d sessions to the new format", len(legacy))
+	ss.logger.Info("session migration", zap.Int("sessions", len(legacy)))
+	return nil
+}
+
+// decodeLegacySession unmarshals a session stored as JSON by older versions.
+func decodeLegacySession(val []byte, out *session) error {
+	if err := js.Unmarshal(val, out); err != nil {
+		return err
+	}
+	if out.MessageStore == nil {
+		out.MessageStore = newMessageStore()
+	}
+	if out.Queue == nil {
+		out.Queue = newMessageQueue()
+	}
+	for i, e := range out.Queue.Messages {
+		e.seq = uint64(i)
+	}
+	out.Queue.loaded()
+	return nil
 }
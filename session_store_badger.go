@@ -0,0 +1,135 @@
+package gott
+
+import (
+	"github.com/dgraph-io/badger"
+)
+
+// badgerStore is a SessionStore backed by a badger database.
+type badgerStore struct {
+	db *badger.DB
+}
+
+func openBadgerStore(path string, sync, readOnly bool) (*badgerStore, error) {
+	opts := badger.DefaultOptions(path).WithEventLogging(false).WithSyncWrites(sync).WithReadOnly(readOnly)
+
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &badgerStore{db}, nil
+}
+
+func (bs *badgerStore) Get(key string) (val []byte, err error) {
+	err = bs.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err == badger.ErrKeyNotFound {
+			return ErrKeyNotFound
+		} else if err != nil {
+			return err
+		}
+
+		val, err = item.ValueCopy(nil)
+		return err
+	})
+	return
+}
+
+func (bs *badgerStore) Set(key string, value []byte) error {
+	return bs.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(key), append([]byte(nil), value...))
+	})
+}
+
+func (bs *badgerStore) Batch(ops []StoreOp) error {
+	wb := bs.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	for _, op := range ops {
+		var err error
+		if op.Delete {
+			err = wb.Delete([]byte(op.Key))
+		} else {
+			err = wb.Set([]byte(op.Key), append([]byte(nil), op.Value...))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
+
+func (bs *badgerStore) Delete(key string) error {
+	return bs.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(key))
+	})
+}
+
+func (bs *badgerStore) Exists(key string) bool {
+	return bs.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(key))
+		return err
+	}) == nil
+}
+
+func (bs *badgerStore) Iterate(prefix string, fn func(key string, value []byte) error) error {
+	return bs.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		p := []byte(prefix)
+		for it.Seek(p); it.ValidForPrefix(p); it.Next() {
+			item := it.Item()
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if err := fn(string(item.KeyCopy(nil)), val); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (bs *badgerStore) Count(prefix string) (n int, err error) {
+	err = bs.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		p := []byte(prefix)
+		for it.Seek(p); it.ValidForPrefix(p); it.Next() {
+			n++
+		}
+		return nil
+	})
+	return
+}
+
+// gc rewrites the value log files that are at least half deleted or overwritten values, until none is left.
+func (bs *badgerStore) gc() error {
+	for {
+		err := bs.db.RunValueLogGC(0.5)
+		if err == badger.ErrNoRewrite || err == badger.ErrRejected {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// compact merges the levels of the LSM tree into the last one, dropping deleted and overwritten keys.
+func (bs *badgerStore) compact() error {
+	return bs.db.Flatten(1)
+}
+
+func (bs *badgerStore) diskSize() int64 {
+	lsm, vlog := bs.db.Size()
+	return lsm + vlog
+}
+
+func (bs *badgerStore) Close() error {
+	return bs.db.Close()
+}
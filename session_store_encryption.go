@@ -0,0 +1,354 @@
+package gott
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Values of an encrypted store are sealed in an envelope: encryptedValueMagic, the envelope version,
+// the ID of the key, a random nonce and the value encrypted with AES-256-GCM, with the record key as
+// additional data so values can't be moved between keys. Plaintext records never start with
+// encryptedValueMagic, so stores being encrypted or rotated to a new key can hold both.
+// Record keys, which hold client IDs, topic filters and retained topic names, aren't encrypted.
+const (
+	encryptedValueMagic   = 0xFF
+	encryptedValueVersion = 1
+	storeKeyIDSize        = 4
+	storeKeySize          = 32 // AES-256
+	rekeyBatchSize        = 1000
+	rekeyDirSuffix        = ".rekey" // of the directory a store is copied to when it's encrypted with a new key
+	staleDirSuffix        = ".stale" // of the directory of the store it replaces, until it's deleted
+)
+
+var (
+	ErrStoreEncrypted  = errors.New("session store is encrypted, set sessions.store.encryption.key_file or key_env")
+	ErrStoreKeyNotSet  = errors.New("session store encryption key is not set")
+	errUnknownStoreKey = errors.New("session store records are encrypted with a key that isn't configured")
+	errStopIteration   = errors.New("stop iteration")
+)
+
+// storeKey is a key of an encrypted store, identified by the first bytes of its SHA-256.
+type storeKey struct {
+	id   [storeKeyIDSize]byte
+	aead cipher.AEAD
+}
+
+// loadStoreKeys reads the keys from the configured file or environment variable. Keys are 32 bytes,
+// hex or base64 encoded, separated by whitespace or commas. The first one encrypts, the others are
+// previous keys only used to decrypt records until they're encrypted again with the first one.
+func loadStoreKeys(cnf storeEncryptionConfig) ([]storeKey, error) {
+	var text string
+	switch {
+	case cnf.KeyFile != "" && cnf.KeyEnv != "":
+		return nil, errors.New("set only one of sessions.store.encryption.key_file and key_env")
+	case cnf.KeyFile != "":
+		b, err := ioutil.ReadFile(cnf.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		text = string(b)
+	default:
+		text = os.Getenv(cnf.KeyEnv)
+	}
+
+	var keys []storeKey
+	for _, line := range strings.Split(text, "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		for _, field := range strings.FieldsFunc(line, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' || r == '\r' }) {
+			key, err := parseStoreKey(field)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, ErrStoreKeyNotSet
+	}
+	return keys, nil
+}
+
+func parseStoreKey(s string) (storeKey, error) {
+	raw, err := hex.DecodeString(s)
+	if err != nil {
+		raw, err = base64.StdEncoding.DecodeString(s)
+	}
+	if err != nil || len(raw) != storeKeySize {
+		return storeKey{}, fmt.Errorf("session store encryption keys must be %d bytes, hex or base64 encoded", storeKeySize)
+	}
+
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return storeKey{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return storeKey{}, err
+	}
+
+	key := storeKey{aead: aead}
+	sum := sha256.Sum256(raw)
+	copy(key.id[:], sum[:])
+	return key, nil
+}
+
+// encryptedStore encrypts the values of another SessionStore.
+type encryptedStore struct {
+	SessionStore
+	keys []storeKey
+}
+
+func encryptedValue(val []byte) bool {
+	return len(val) > 0 && val[0] == encryptedValueMagic
+}
+
+func (es *encryptedStore) seal(key string, val []byte) []byte {
+	k := es.keys[0]
+	out := make([]byte, 2+storeKeyIDSize+k.aead.NonceSize(), 2+storeKeyIDSize+k.aead.NonceSize()+len(val)+k.aead.Overhead())
+	out[0], out[1] = encryptedValueMagic, encryptedValueVersion
+	copy(out[2:], k.id[:])
+	nonce := out[2+storeKeyIDSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err) // the system's random source is broken
+	}
+	return k.aead.Seal(out, nonce, val, []byte(key))
+}
+
+// key returns the key a value was encrypted with.
+func (es *encryptedStore) key(val []byte) (*storeKey, error) {
+	if len(val) < 2+storeKeyIDSize || val[1] != encryptedValueVersion {
+		return nil, errCorruptSessionRecord
+	}
+	for i := range es.keys {
+		if string(es.keys[i].id[:]) == string(val[2:2+storeKeyIDSize]) {
+			return &es.keys[i], nil
+		}
+	}
+	return nil, errUnknownStoreKey
+}
+
+func (es *encryptedStore) open(key string, val []byte) ([]byte, error) {
+	if !encryptedValue(val) {
+		return val, nil // not encrypted yet
+	}
+	k, err := es.key(val)
+	if err != nil {
+		return nil, err
+	}
+
+	header := 2 + storeKeyIDSize + k.aead.NonceSize()
+	if len(val) < header {
+		return nil, errCorruptSessionRecord
+	}
+	plain, err := k.aead.Open(nil, val[2+storeKeyIDSize:header], val[header:], []byte(key))
+	if err != nil {
+		return nil, errCorruptSessionRecord
+	}
+	return plain, nil
+}
+
+func (es *encryptedStore) Get(key string) ([]byte, error) {
+	val, err := es.SessionStore.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return es.open(key, val)
+}
+
+func (es *encryptedStore) Set(key string, value []byte) error {
+	return es.SessionStore.Set(key, es.seal(key, value))
+}
+
+func (es *encryptedStore) Batch(ops []StoreOp) error {
+	sealed := make([]StoreOp, len(ops))
+	for i, op := range ops {
+		sealed[i] = op
+		if !op.Delete {
+			sealed[i].Value = es.seal(op.Key, op.Value)
+		}
+	}
+	return es.SessionStore.Batch(sealed)
+}
+
+// Iterate passes the records that can't be decrypted with an empty value, which no decoder accepts,
+// so they're handled as corrupt records instead of stopping the iteration.
+func (es *encryptedStore) Iterate(prefix string, fn func(key string, value []byte) error) error {
+	return es.SessionStore.Iterate(prefix, func(key string, val []byte) error {
+		plain, err := es.open(key, val)
+		if err != nil {
+			plain = []byte{}
+		}
+		return fn(key, plain)
+	})
+}
+
+// staleRecords counts the records that aren't encrypted yet or are encrypted with a previous key.
+// Records encrypted with a key that isn't configured make it fail, so a wrong key can't turn the whole
+// store into corrupt records.
+func (es *encryptedStore) staleRecords() (int, error) {
+	stale := 0
+	err := es.SessionStore.Iterate("", func(key string, val []byte) error {
+		if encryptedValue(val) {
+			k, err := es.key(val)
+			if err == errUnknownStoreKey {
+				return err
+			} else if err != nil || k == &es.keys[0] {
+				return nil
+			}
+			if _, err := es.open(key, val); err != nil {
+				return nil // corrupt records are left to verify
+			}
+		}
+		stale++
+		return nil
+	})
+	return stale, err
+}
+
+// reseal returns the value of a record encrypted with the current key. Values that already are,
+// and values that can't be decrypted, which are left to verify, are returned as they are.
+func (es *encryptedStore) reseal(key string, val []byte) []byte {
+	if encryptedValue(val) {
+		if k, err := es.key(val); err != nil || k == &es.keys[0] {
+			return val
+		}
+	}
+	plain, err := es.open(key, val)
+	if err != nil {
+		return val
+	}
+	return es.seal(key, plain)
+}
+
+// rekey encrypts the stale records with the current key in place, for the backends that aren't on the disk.
+func (es *encryptedStore) rekey() error {
+	var ops []StoreOp
+	err := es.SessionStore.Iterate("", func(key string, val []byte) error {
+		ops = append(ops, StoreOp{Key: key, Value: es.reseal(key, val)})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return es.SessionStore.Batch(ops)
+}
+
+// rewrite copies every record of the store to a new store of the same backend in dir, with the values
+// encrypted with the current key.
+func (es *encryptedStore) rewrite(cnf sessionStoreConfig, dir string) error {
+	cnf.Path = dir
+	dst, err := openSessionStore(cnf, false)
+	if err != nil {
+		return err
+	}
+
+	ops := make([]StoreOp, 0, rekeyBatchSize)
+	err = es.SessionStore.Iterate("", func(key string, val []byte) error {
+		ops = append(ops, StoreOp{Key: key, Value: es.reseal(key, val)})
+		if len(ops) < rekeyBatchSize {
+			return nil
+		}
+		err := dst.Batch(ops)
+		ops = ops[:0]
+		return err
+	})
+	if err == nil {
+		err = dst.Batch(ops)
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// rekeySessionStore replaces a store holding stale records with a copy encrypted with the current key.
+// The copy is written next to the store and swapped in once complete, so the files holding the records in
+// plaintext or encrypted with a previous key are deleted rather than left for the backend to reclaim.
+// The store is closed and must be opened again.
+func rekeySessionStore(ss *sessionStore, es *encryptedStore, stale int) error {
+	dir := ss.config.Path
+	if err := os.RemoveAll(dir + rekeyDirSuffix); err != nil {
+		return err
+	}
+	err := es.rewrite(ss.config, dir+rekeyDirSuffix)
+	if cerr := ss.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.RemoveAll(dir + rekeyDirSuffix)
+		return err
+	}
+
+	if err := os.Rename(dir, dir+staleDirSuffix); err != nil {
+		return err
+	}
+	if err := os.Rename(dir+rekeyDirSuffix, dir); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir + staleDirSuffix); err != nil {
+		return err
+	}
+
+	log.Printf("encrypted %d session store records with the current key", stale)
+	ss.logger.Info("session store rekey", zap.Int("records", stale), zap.String("key", es.keyID()))
+	return nil
+}
+
+// recoverRekey completes or undoes a rekey of the store in dir interrupted by a crash of the broker:
+// once the stale store was moved aside, the new one is complete and replaces it.
+func recoverRekey(dir string) error {
+	if _, err := os.Stat(dir + staleDirSuffix); os.IsNotExist(err) {
+		return os.RemoveAll(dir + rekeyDirSuffix)
+	}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := os.Rename(dir+rekeyDirSuffix, dir); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(dir + staleDirSuffix)
+}
+
+// rekeyedPath returns the directory holding the complete store in dir, without recovering an interrupted rekey:
+// the copy until it replaced the stale store.
+func rekeyedPath(dir string) string {
+	if _, err := os.Stat(dir + staleDirSuffix); err == nil {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			return dir + rekeyDirSuffix
+		}
+	}
+	return dir
+}
+
+// keyID returns the ID of the current key, hex encoded.
+func (es *encryptedStore) keyID() string {
+	return hex.EncodeToString(es.keys[0].id[:])
+}
+
+// checkUnencrypted fails if a store opened without encryption holds encrypted records,
+// they would otherwise be handled as corrupt records.
+func checkUnencrypted(store SessionStore) error {
+	err := store.Iterate("", func(_ string, val []byte) error {
+		if encryptedValue(val) {
+			return errStopIteration
+		}
+		return nil
+	})
+	if err == errStopIteration {
+		return ErrStoreEncrypted
+	}
+	return err
+}
@@ -0,0 +1,174 @@
+package gott
+
+import (
+	gob "bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// storeFilesContain checks whether any file of a store directory holds b.
+func storeFilesContain(t *testing.T, dir string, b []byte) bool {
+	t.Helper()
+	found := false
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		found = found || gob.Contains(data, b)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+// TestRekeySessionStore runs on the log backend, whose files are easy to search, the copy and the swap of
+// the store don't depend on the backend.
+func TestRekeySessionStore(t *testing.T) {
+	secret := []byte("plaintext payload")
+	keys := []string{strings.Repeat("01", storeKeySize), strings.Repeat("02", storeKeySize)}
+
+	dir, err := ioutil.TempDir("", "gott-rekey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backend := SessionStoreLog
+	cnf := sessionStoreConfig{Backend: backend, Path: filepath.Join(dir, "store")}
+	keyFile := filepath.Join(dir, "keys")
+
+	load := func(keys ...string) *sessionStore {
+		cnf.Encryption.KeyFile = ""
+		if len(keys) > 0 {
+			cnf.Encryption.KeyFile = keyFile
+			if err := ioutil.WriteFile(keyFile, []byte(strings.Join(keys, "\n")), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ss, err := loadSessionStore(cnf, zap.NewNop())
+		if err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+		return ss
+	}
+
+	ss := load()
+	msg := &message{Topic: []byte("t"), Payload: secret, QoS: 1, Timestamp: time.Now()}
+	if err := ss.Set(retainedKey(msg.Topic), encodeRetainedMessage(msg)); err != nil {
+		t.Fatal(err)
+	}
+	_ = ss.Close()
+
+	// encrypting a plaintext store leaves no plaintext in its files
+	ss = load(keys[0])
+	_ = ss.Close()
+	if storeFilesContain(t, cnf.Path, secret) {
+		t.Errorf("%s: plaintext left on the disk", backend)
+	}
+	for _, suffix := range []string{rekeyDirSuffix, staleDirSuffix} {
+		if _, err := os.Stat(cnf.Path + suffix); !os.IsNotExist(err) {
+			t.Errorf("%s: %s left: %v", backend, suffix, err)
+		}
+	}
+
+	// once rotated, the previous key isn't needed to read the store
+	ss = load(keys[1], keys[0])
+	_ = ss.Close()
+	ss = load(keys[1])
+	val, err := ss.Get(retainedKey(msg.Topic))
+	if err != nil {
+		t.Fatalf("%s: %v", backend, err)
+	}
+	if got, err := decodeRetainedMessage("t", val); err != nil || !gob.Equal(got.Payload, secret) {
+		t.Errorf("%s: retained message %+v: %v", backend, got, err)
+	}
+	_ = ss.Close()
+
+	// a crash once the stale store was moved aside leaves the new store complete
+	if err := os.Rename(cnf.Path, cnf.Path+rekeyDirSuffix); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(cnf.Path+staleDirSuffix, 0700); err != nil {
+		t.Fatal(err)
+	}
+	ss = load(keys[1])
+	if !ss.Exists(retainedKey(msg.Topic)) {
+		t.Errorf("%s: store lost after recovering an interrupted rekey", backend)
+	}
+	_ = ss.Close()
+	if _, err := os.Stat(cnf.Path + staleDirSuffix); !os.IsNotExist(err) {
+		t.Errorf("%s: stale store left after recovering: %v", backend, err)
+	}
+
+}
+
+// newEncryptedMemoryStore returns a memory session store encrypted with keys, the first one encrypting.
+func newEncryptedMemoryStore(t *testing.T, keys ...string) *sessionStore {
+	t.Helper()
+	es := &encryptedStore{SessionStore: newMemoryStore()}
+	for _, k := range keys {
+		key, err := parseStoreKey(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		es.keys = append(es.keys, key)
+	}
+	return &sessionStore{SessionStore: es, logger: zap.NewNop()}
+}
+
+func TestSealedSnapshot(t *testing.T) {
+	secret := []byte("plaintext payload")
+	keys := []string{strings.Repeat("01", storeKeySize), strings.Repeat("02", storeKeySize)}
+
+	ss := newEncryptedMemoryStore(t, keys[0])
+	msg := &message{Topic: []byte("t"), Payload: secret, QoS: 1, Timestamp: time.Now()}
+	if err := ss.Set(retainedKey(msg.Topic), encodeRetainedMessage(msg)); err != nil {
+		t.Fatal(err)
+	}
+
+	var snapshot gob.Buffer
+	if info, err := ss.backup(&snapshot, SnapshotBinary, false); err != nil || !info.Sealed || info.Retained != 1 {
+		t.Fatalf("backup %+v: %v", info, err)
+	}
+	if gob.Contains(snapshot.Bytes(), secret) {
+		t.Fatal("plaintext in a snapshot of an encrypted store")
+	}
+	if _, err := ss.backup(&gob.Buffer{}, SnapshotJSON, false); err != ErrSnapshotPlaintext {
+		t.Fatalf("JSON backup without plaintext: %v", err)
+	}
+	var export gob.Buffer
+	if _, err := ss.backup(&export, SnapshotJSON, true); err != nil || !gob.Contains(export.Bytes(), []byte("cGxhaW50ZXh0IHBheWxvYWQ=")) {
+		t.Fatalf("JSON backup with plaintext: %v", err)
+	}
+
+	// sealed snapshots need the key they were encrypted with
+	plain := &sessionStore{SessionStore: newMemoryStore(), logger: zap.NewNop()}
+	if _, err := plain.restore(gob.NewReader(snapshot.Bytes()), false); err != ErrSnapshotSealed {
+		t.Fatalf("restored into a plaintext store: %v", err)
+	}
+	if _, err := newEncryptedMemoryStore(t, keys[1]).restore(gob.NewReader(snapshot.Bytes()), false); !errors.Is(err, ErrSnapshotSealed) {
+		t.Fatalf("restored with another key: %v", err)
+	}
+
+	// and are encrypted with the current key of the store they're restored into
+	rotated := newEncryptedMemoryStore(t, keys[1], keys[0])
+	if info, err := rotated.restore(gob.NewReader(snapshot.Bytes()), false); err != nil || info.Keys != 1 {
+		t.Fatalf("restore %+v: %v", info, err)
+	}
+	if stale, err := rotated.SessionStore.(*encryptedStore).staleRecords(); err != nil || stale != 0 {
+		t.Fatalf("%d records not encrypted with the current key: %v", stale, err)
+	}
+	val, err := rotated.Get(retainedKey(msg.Topic))
+	if got, derr := decodeRetainedMessage("t", val); err != nil || derr != nil || !gob.Equal(got.Payload, secret) {
+		t.Fatalf("restored retained message: %v %v", err, derr)
+	}
+}
@@ -0,0 +1,351 @@
+package gott
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	logStoreFile           = "sessions.log"
+	logStoreLockFile       = "sessions.lock"
+	logStoreCompactMinSize = 1 << 20 // the log isn't compacted below this size
+	logOpSet               = byte(1)
+	logOpDelete            = byte(2)
+)
+
+var (
+	errCorruptLogRecord = errors.New("corrupt log record")
+	errReadOnlyStore    = errors.New("session store opened read-only")
+
+	// ErrStoreLocked is returned when opening a log session store another process has open for writing,
+	// or for reading when opening it for writing.
+	ErrStoreLocked = errors.New("session store is in use by another process")
+)
+
+// logStore is a SessionStore kept in memory and persisted to an append-only log file.
+// Every change appends a record: crc32 of the rest, op, key length and value length as uvarints, key, value.
+// The log is replayed on open and rewritten with the live keys only once most of it is overwritten records.
+// A torn record at the end of the log, left by a crash, is truncated unless the log is opened read-only.
+// The lock file next to the log is locked while it's open, exclusively unless it's read-only.
+type logStore struct {
+	*memoryStore
+	path     string
+	sync     bool // fsync after every write
+	readOnly bool // nothing is written to the log, not even to repair or compact it
+	lock     *os.File
+	file     *os.File
+	sizes    map[string]int64 // size of the last record of each live key
+	size     int64            // size of the log
+	live     int64            // size of the last records of the live keys
+	mutex    sync.Mutex       // serializes writes to the log
+}
+
+// openLogStore opens the log in dir, creating it unless readOnly is set.
+func openLogStore(dir string, sync, readOnly bool) (*logStore, error) {
+	ls := &logStore{
+		memoryStore: newMemoryStore(),
+		path:        filepath.Join(dir, logStoreFile),
+		sync:        sync,
+		readOnly:    readOnly,
+		sizes:       map[string]int64{},
+	}
+
+	if readOnly {
+		// a missing log isn't created
+		if _, err := os.Stat(ls.path); err != nil {
+			return nil, err
+		}
+	} else if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	lock, err := lockFile(filepath.Join(dir, logStoreLockFile), !readOnly)
+	if err == ErrStoreLocked {
+		return nil, fmt.Errorf("%w: %s", ErrStoreLocked, dir)
+	} else if err != nil {
+		return nil, err
+	}
+	ls.lock = lock
+
+	if err := ls.open(); err != nil {
+		if ls.file != nil {
+			_ = ls.file.Close()
+		}
+		_ = lock.Close()
+		return nil, err
+	}
+	return ls, nil
+}
+
+// open loads the log and, unless it's read-only, opens it for appending and compacts it if needed.
+func (ls *logStore) open() error {
+	if ls.readOnly {
+		file, err := os.Open(ls.path)
+		if err != nil {
+			return err
+		}
+		ls.file = file
+		return ls.load(file)
+	}
+
+	file, err := os.OpenFile(ls.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	ls.file = file
+	if err := ls.load(file); err != nil {
+		return err
+	}
+	if _, err := file.Seek(ls.size, io.SeekStart); err != nil {
+		return err
+	}
+	return ls.compactIfNeeded()
+}
+
+// load replays the log into memory and truncates it after the last valid record, or stops there if it's read-only.
+func (ls *logStore) load(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(file)
+	for ls.size < info.Size() {
+		op, key, val, n, err := readLogRecord(r, info.Size()-ls.size)
+		if err != nil && ls.readOnly {
+			log.Printf("session store log %s is corrupt at offset %d, ignoring %d bytes: %v", ls.path, ls.size, info.Size()-ls.size, err)
+			return nil
+		} else if err != nil {
+			log.Printf("session store log %s is corrupt at offset %d, truncating %d bytes: %v", ls.path, ls.size, info.Size()-ls.size, err)
+			return file.Truncate(ls.size)
+		}
+
+		ls.size += n
+		ls.live -= ls.sizes[key]
+		if op == logOpSet {
+			ls.memoryStore.data[key] = val
+			ls.sizes[key] = n
+			ls.live += n
+		} else {
+			delete(ls.memoryStore.data, key)
+			delete(ls.sizes, key)
+		}
+	}
+	return nil
+}
+
+func readLogRecord(r *bufio.Reader, remaining int64) (op byte, key string, val []byte, n int64, err error) {
+	var header [5]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+	op = header[4]
+	if op != logOpSet && op != logOpDelete {
+		err = errCorruptLogRecord
+		return
+	}
+
+	keyLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return
+	}
+	valLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return
+	}
+	// checked separately, their sum can overflow
+	if remaining < 0 || keyLen > uint64(remaining) || valLen > uint64(remaining)-keyLen {
+		err = errCorruptLogRecord
+		return
+	}
+
+	body := make([]byte, keyLen+valLen)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return
+	}
+
+	record := encodeLogRecord(op, string(body[:keyLen]), body[keyLen:])
+	if binary.BigEndian.Uint32(header[:4]) != binary.BigEndian.Uint32(record[:4]) {
+		err = errCorruptLogRecord
+		return
+	}
+	return op, string(body[:keyLen]), body[keyLen:], int64(len(record)), nil
+}
+
+func encodeLogRecord(op byte, key string, val []byte) []byte {
+	record := make([]byte, 5, 5+2*binary.MaxVarintLen64+len(key)+len(val))
+	record[4] = op
+	record = appendUvarint(record, uint64(len(key)))
+	record = appendUvarint(record, uint64(len(val)))
+	record = append(record, key...)
+	record = append(record, val...)
+	binary.BigEndian.PutUint32(record[:4], crc32.ChecksumIEEE(record[4:]))
+	return record
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func (ls *logStore) Set(key string, value []byte) error {
+	return ls.Batch([]StoreOp{{Key: key, Value: value}})
+}
+
+func (ls *logStore) Delete(key string) error {
+	return ls.Batch([]StoreOp{{Key: key, Delete: true}})
+}
+
+// Batch appends the records of all the ops to the log with a single write.
+func (ls *logStore) Batch(ops []StoreOp) error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	if ls.readOnly {
+		return errReadOnlyStore
+	}
+
+	var records []byte
+	sizes := make([]int64, len(ops))
+	for i, op := range ops {
+		var record []byte
+		if op.Delete {
+			record = encodeLogRecord(logOpDelete, op.Key, nil)
+		} else {
+			record = encodeLogRecord(logOpSet, op.Key, op.Value)
+		}
+		sizes[i] = int64(len(record))
+		records = append(records, record...)
+	}
+	if err := ls.append(records); err != nil {
+		return err
+	}
+	_ = ls.memoryStore.Batch(ops)
+
+	for i, op := range ops {
+		ls.live -= ls.sizes[op.Key]
+		if op.Delete {
+			delete(ls.sizes, op.Key)
+		} else {
+			ls.sizes[op.Key] = sizes[i]
+			ls.live += sizes[i]
+		}
+	}
+	return ls.compactIfNeeded()
+}
+
+// append writes records at the end of the log. Partially written records are cut off
+// so the next records stay readable.
+func (ls *logStore) append(records []byte) error {
+	_, err := ls.file.Write(records)
+	if err == nil && ls.sync {
+		err = ls.file.Sync()
+	}
+	if err != nil {
+		if terr := ls.file.Truncate(ls.size); terr == nil {
+			_, _ = ls.file.Seek(ls.size, io.SeekStart)
+		}
+		return err
+	}
+	ls.size += int64(len(records))
+	return nil
+}
+
+// compactIfNeeded rewrites the log with the live keys only once more than half of it is overwritten records.
+// Must be called with the mutex held.
+func (ls *logStore) compactIfNeeded() error {
+	if ls.size < logStoreCompactMinSize || ls.size < 2*ls.live {
+		return nil
+	}
+	return ls.rewrite()
+}
+
+// rewrite replaces the log with a new one holding the live keys only. Must be called with the mutex held.
+func (ls *logStore) rewrite() error {
+	tmpPath := ls.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	var size int64
+	err = ls.memoryStore.Iterate("", func(key string, value []byte) error {
+		n, err := w.Write(encodeLogRecord(logOpSet, key, value))
+		size += int64(n)
+		return err
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, ls.path)
+	}
+	if err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	_ = ls.file.Close()
+	ls.file, ls.size, ls.live = tmp, size, size
+	return nil
+}
+
+// gc compacts the log if most of it is overwritten records.
+func (ls *logStore) gc() error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	if ls.readOnly {
+		return errReadOnlyStore
+	}
+	return ls.compactIfNeeded()
+}
+
+// compact rewrites the log with the live keys only, whatever its size.
+func (ls *logStore) compact() error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	if ls.readOnly {
+		return errReadOnlyStore
+	}
+	if ls.size == ls.live {
+		return nil
+	}
+	return ls.rewrite()
+}
+
+func (ls *logStore) diskSize() int64 {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	return ls.size
+}
+
+func (ls *logStore) Close() error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	// closing the lock file releases the lock
+	defer ls.lock.Close()
+
+	if ls.readOnly {
+		return ls.file.Close()
+	}
+	if err := ls.file.Sync(); err != nil {
+		_ = ls.file.Close()
+		return err
+	}
+	return ls.file.Close()
+}
@@ -0,0 +1,31 @@
+//go:build !windows
+// +build !windows
+
+package gott
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile opens path, creating it if needed, and takes an flock on it, exclusive or shared.
+// Returns ErrStoreLocked if another process holds a conflicting lock. The lock is released when the file is closed.
+func lockFile(path string, exclusive bool) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
+		_ = f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrStoreLocked
+		}
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,30 @@
+package gott
+
+import (
+	"os"
+	"syscall"
+)
+
+const errorSharingViolation = syscall.Errno(32) // ERROR_SHARING_VIOLATION
+
+// lockFile opens path, creating it if needed, sharing it for reading only when it isn't exclusive and denying
+// any sharing otherwise. Returns ErrStoreLocked if another process has it open in a conflicting mode.
+// The lock is released when the file is closed.
+func lockFile(path string, exclusive bool) (*os.File, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+
+	access, share := uint32(syscall.GENERIC_READ), uint32(syscall.FILE_SHARE_READ)
+	if exclusive {
+		access, share = syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0
+	}
+	h, err := syscall.CreateFile(name, access, share, nil, syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err == errorSharingViolation {
+		return nil, ErrStoreLocked
+	} else if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(h), path), nil
+}
@@ -0,0 +1,131 @@
+package gott
+
+import (
+	"bufio"
+	gob "bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadLogRecord(t *testing.T) {
+	record := encodeLogRecord(logOpSet, "key", []byte("value"))
+	op, key, val, n, err := readLogRecord(bufio.NewReader(gob.NewReader(record)), int64(len(record)))
+	if err != nil || op != logOpSet || key != "key" || string(val) != "value" || n != int64(len(record)) {
+		t.Fatalf("read %d %q %q %d: %v", op, key, val, n, err)
+	}
+
+	lengths := func(keyLen, valLen uint64) []byte {
+		b := []byte{0, 0, 0, 0, logOpSet}
+		b = appendUvarint(b, keyLen)
+		return appendUvarint(b, valLen)
+	}
+	for name, tc := range map[string]struct {
+		record    []byte
+		remaining int64
+		err       error
+	}{
+		"overflowing lengths": {lengths(1<<63, 1<<63), 1 << 20, errCorruptLogRecord},
+		"key too long":        {lengths(1<<40, 1), 1 << 20, errCorruptLogRecord},
+		"value too long":      {lengths(1, 1<<20), 1 << 20, errCorruptLogRecord},
+		"unknown op":          {[]byte{0, 0, 0, 0, 9, 0, 0}, 1 << 20, errCorruptLogRecord},
+		"bad checksum":        {append([]byte{1}, record[1:]...), int64(len(record)), errCorruptLogRecord},
+		"truncated":           {record[:len(record)-1], 1 << 20, io.ErrUnexpectedEOF},
+	} {
+		_, _, _, _, err := readLogRecord(bufio.NewReader(gob.NewReader(tc.record)), tc.remaining)
+		if err != tc.err {
+			t.Errorf("%s: got %v, want %v", name, err, tc.err)
+		}
+	}
+}
+
+func TestLogStoreReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gott-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := openLogStore(dir, false, true); !os.IsNotExist(err) {
+		t.Fatalf("opened a missing log read-only: %v", err)
+	}
+	ls, err := openLogStore(dir, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ls.Set("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	_ = ls.Close()
+
+	// a torn record, as left by a crash
+	path := filepath.Join(dir, logStoreFile)
+	record := encodeLogRecord(logOpSet, "b", []byte("2"))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write(record[:len(record)-1])
+	_ = f.Close()
+	info, _ := os.Stat(path)
+
+	ls, err = openLogStore(dir, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, err := ls.Get("a"); err != nil || string(val) != "1" || ls.Exists("b") {
+		t.Fatalf("read %q: %v", val, err)
+	}
+	if err := ls.Set("c", nil); err != errReadOnlyStore {
+		t.Fatalf("wrote to a read-only log: %v", err)
+	}
+	if err := ls.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := os.Stat(path); after.Size() != info.Size() {
+		t.Fatalf("log of %d bytes is %d bytes once opened read-only", info.Size(), after.Size())
+	}
+}
+
+func TestLogStoreLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gott-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ls, err := openLogStore(dir, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, readOnly := range []bool{false, true} {
+		if _, err := openLogStore(dir, false, readOnly); !errors.Is(err, ErrStoreLocked) {
+			t.Fatalf("opened a log open for writing, read-only %v: %v", readOnly, err)
+		}
+	}
+	_ = ls.Close()
+
+	// readers share the lock
+	var readers []*logStore
+	for i := 0; i < 2; i++ {
+		ls, err := openLogStore(dir, false, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readers = append(readers, ls)
+	}
+	if _, err := openLogStore(dir, false, false); !errors.Is(err, ErrStoreLocked) {
+		t.Fatalf("opened a log open for reading: %v", err)
+	}
+	for _, ls := range readers {
+		_ = ls.Close()
+	}
+	if ls, err := openLogStore(dir, false, false); err != nil {
+		t.Fatalf("lock not released: %v", err)
+	} else {
+		_ = ls.Close()
+	}
+}
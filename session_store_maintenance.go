@@ -0,0 +1,406 @@
+package gott
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// maxFlaggedSessions is the number of corrupt sessions kept in the store stats.
+const maxFlaggedSessions = 100
+
+// maintainedStore is implemented by the backends that need their disk space reclaimed.
+type maintainedStore interface {
+	gc() error      // reclaims the space of deleted and overwritten values
+	compact() error // rewrites the store in its most compact form
+	diskSize() int64
+}
+
+// maintained returns the backend if it needs its disk space reclaimed.
+func (ss *sessionStore) maintained() (maintainedStore, bool) {
+	backend := ss.SessionStore
+	if es, ok := backend.(*encryptedStore); ok {
+		backend = es.SessionStore
+	}
+	ms, ok := backend.(maintainedStore)
+	return ms, ok
+}
+
+// StoreStats describes the session store.
+type StoreStats struct {
+	Backend        string
+	Path           string `json:",omitempty"`
+	DiskSize       int64  // bytes used on disk, 0 for the memory backend
+	Encrypted      bool
+	KeyID          string `json:",omitempty"` // of the key new records are encrypted with
+	Keys           int
+	Sessions       int
+	Inflight       int // messages sent to clients and not acknowledged yet
+	Inbound        int // QoS 2 messages received from clients and waiting for their PUBREL
+	Queued         int
+	Subscriptions  int
+	Retained       int
+	Corrupt        []StoreProblem // sessions that failed to load since the broker started, most recent last
+	LastGC         *time.Time     `json:",omitempty"`
+	LastCompaction *time.Time     `json:",omitempty"`
+	LastError      string         `json:",omitempty"` // of the last maintenance run
+}
+
+// StoreProblem is a record of the session store that can't be decoded or doesn't belong to any session.
+type StoreProblem struct {
+	ClientID string
+	Kind     string // of record: meta, inflight, inbound, queue, subscription, retained or unknown
+	Key      string `json:",omitempty"` // hex encoded
+	Error    string
+	Time     time.Time
+}
+
+// StoreReport is the result of verifying, and possibly repairing, the session store.
+type StoreReport struct {
+	Keys     int
+	Sessions int
+	Problems []StoreProblem
+	Repaired int // deleted records
+	Skipped  int // problems left as they are because their client is connected
+}
+
+var sessionKindNames = map[byte]string{
+	sessionKeyMeta:         "meta",
+	sessionKeyInflight:     "inflight",
+	sessionKeyInbound:      "inbound",
+	sessionKeyQueue:        "queue",
+	sessionKeySubscription: "subscription",
+	sessionKeyRetained:     "retained",
+}
+
+func sessionKindName(kind byte) string {
+	if name, ok := sessionKindNames[kind]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// checkSessionRecord returns why a record of the store can't be decoded, nil if it's valid.
+func checkSessionRecord(kind byte, suffix string, val []byte) error {
+	switch kind {
+	case sessionKeyMeta:
+		if suffix != "" {
+			return errCorruptSessionRecord
+		}
+		return decodeSessionMeta(val, newStoredSession(""))
+	case sessionKeyInflight, sessionKeyInbound:
+		if len(suffix) != 2 {
+			return errCorruptSessionRecord
+		}
+		cm, err := decodeClientMessage(val)
+		if err == nil && (cm.QoS == 0 || cm.QoS > 2) {
+			return ErrInvalidQoS
+		}
+		return err
+	case sessionKeyQueue:
+		if len(suffix) != 8 {
+			return errCorruptSessionRecord
+		}
+		e, err := decodeQueueEntry(val, 0)
+		if err == nil && e.QoS > 2 {
+			return ErrInvalidQoS
+		}
+		return err
+	case sessionKeySubscription:
+		if len(val) != 1 || val[0] > 2 {
+			return ErrInvalidQoS
+		}
+		if !validFilter([]byte(suffix)) {
+			return fmt.Errorf("invalid topic filter: %q", suffix)
+		}
+		return nil
+	case sessionKeyRetained:
+		if suffix != "" {
+			return errCorruptSessionRecord
+		}
+		msg, err := decodeRetainedMessage("", val)
+		if err == nil && msg.QoS > 2 {
+			return ErrInvalidQoS
+		}
+		return err
+	default:
+		return errCorruptSessionRecord
+	}
+}
+
+func newStoreProblem(key string, err error) StoreProblem {
+	kind, id, _, ok := parseSessionKey(key)
+	p := StoreProblem{ClientID: id, Kind: sessionKindName(kind), Key: hex.EncodeToString([]byte(key)), Error: err.Error(), Time: time.Now()}
+	if !ok {
+		p.Kind = "unknown"
+	}
+	return p
+}
+
+// verify checks every record of the store. Records that can't be decoded and records of sessions without
+// valid metadata are reported, and deleted if repair is set unless inUse returns true for their client ID.
+func (ss *sessionStore) verify(repair bool, inUse func(id string) bool) (StoreReport, error) {
+	var report StoreReport
+	sessions := map[string]bool{}
+	var others []string
+
+	err := ss.Iterate("", func(key string, val []byte) error {
+		report.Keys++
+		kind, id, suffix, ok := parseSessionKey(key)
+		if !ok && legacySessionKey(key) && decodeLegacySession(val, newStoredSession(key)) == nil {
+			sessions[key] = true // stored by an older version, migrated when the store is loaded
+			return nil
+		}
+		if !ok {
+			report.Problems = append(report.Problems, newStoreProblem(key, errCorruptSessionRecord))
+			return nil
+		}
+		if err := checkSessionRecord(kind, suffix, val); err != nil {
+			report.Problems = append(report.Problems, newStoreProblem(key, err))
+			return nil
+		}
+
+		if kind == sessionKeyMeta {
+			sessions[id] = true
+		} else if kind != sessionKeyRetained {
+			others = append(others, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	report.Sessions = len(sessions)
+
+	for _, key := range others {
+		if _, id, _, _ := parseSessionKey(key); !sessions[id] {
+			report.Problems = append(report.Problems, newStoreProblem(key, fmt.Errorf("no session metadata")))
+		}
+	}
+
+	if !repair {
+		return report, nil
+	}
+
+	var ops []StoreOp
+	for _, p := range report.Problems {
+		if inUse != nil && p.ClientID != "" && inUse(p.ClientID) {
+			report.Skipped++
+			continue
+		}
+		key, _ := hex.DecodeString(p.Key)
+		ops = append(ops, StoreOp{Key: string(key), Delete: true})
+	}
+	if err := ss.batch(ops); err != nil {
+		return report, err
+	}
+	report.Repaired = len(ops)
+
+	if report.Repaired > 0 {
+		log.Printf("repaired the session store: deleted %d records", report.Repaired)
+		ss.logger.Info("session store repaired", zap.Int("deleted", report.Repaired), zap.Int("skipped", report.Skipped))
+	}
+	return report, nil
+}
+
+// repairSession deletes the records of a session that can't be decoded and keeps the others.
+// A session whose metadata is corrupt gets new metadata, as if it was just created.
+func (ss *sessionStore) repairSession(id string) (deleted int, err error) {
+	var ops []StoreOp
+	for _, kind := range []byte{sessionKeyMeta, sessionKeyInflight, sessionKeyInbound, sessionKeyQueue, sessionKeySubscription} {
+		err := ss.Iterate(sessionKeyPrefix(kind, id), func(key string, val []byte) error {
+			_, _, suffix, _ := parseSessionKey(key)
+			if checkSessionRecord(kind, suffix, val) != nil {
+				ops = append(ops, StoreOp{Key: key, Delete: true})
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	deleted = len(ops)
+	for _, op := range ops[:deleted] {
+		if op.Key == sessionMetaKey(id) {
+			ops = append(ops, StoreOp{Key: op.Key, Value: encodeSessionMeta(newStoredSession(id))})
+			break
+		}
+	}
+	if err := ss.batch(ops); err != nil {
+		return 0, err
+	}
+	ss.unflag(id)
+	return deleted, nil
+}
+
+// flagCorrupt reports a session that failed to load. A session is reported once until it's repaired or deleted,
+// however many times it's loaded in between.
+func (ss *sessionStore) flagCorrupt(id string, err error) {
+	ss.healthMutex.Lock()
+	defer ss.healthMutex.Unlock()
+
+	if ss.flagged[id] {
+		return
+	}
+	if ss.flagged == nil {
+		ss.flagged = map[string]bool{}
+	}
+	ss.flagged[id] = true
+
+	log.Printf("session %s is corrupt: %v", id, err)
+	ss.logger.Error("corrupt session", zap.String("id", id), zap.Error(err))
+	atomic.AddInt64(&metrics.corruptSessions, 1)
+
+	ss.corrupt = append(ss.corrupt, StoreProblem{ClientID: id, Kind: "session", Error: err.Error(), Time: time.Now()})
+	if len(ss.corrupt) > maxFlaggedSessions {
+		ss.corrupt = ss.corrupt[len(ss.corrupt)-maxFlaggedSessions:]
+	}
+}
+
+// unflag reports the session again the next time it fails to load, once it was repaired or deleted.
+func (ss *sessionStore) unflag(id string) {
+	ss.healthMutex.Lock()
+	defer ss.healthMutex.Unlock()
+	delete(ss.flagged, id)
+}
+
+// maintain runs the garbage collection and the compaction of the backend.
+func (ss *sessionStore) maintain(compact bool) error {
+	ms, ok := ss.maintained()
+	if !ok {
+		return nil
+	}
+
+	err := ms.gc()
+	if err == nil && compact {
+		err = ms.compact()
+	}
+
+	ss.healthMutex.Lock()
+	ss.lastGC = time.Now()
+	if err == nil && compact {
+		ss.lastCompaction = ss.lastGC
+	}
+	ss.lastError = ""
+	if err != nil {
+		ss.lastError = err.Error()
+	}
+	ss.healthMutex.Unlock()
+
+	if err != nil {
+		log.Println("session store maintenance failed:", err)
+		ss.logger.Error("session store maintenance", zap.Error(err))
+	}
+	return err
+}
+
+// maintainSessionStore runs the garbage collection of the session store every gcInterval and its compaction
+// every compactInterval until the broker exits. A zero interval disables either.
+func (b *Broker) maintainSessionStore(gcInterval, compactInterval time.Duration) {
+	defer Recover(nil)
+
+	if _, ok := b.SessionStore.maintained(); !ok || (gcInterval <= 0 && compactInterval <= 0) {
+		return
+	}
+
+	var gc, compact <-chan time.Time
+	if gcInterval > 0 {
+		t := time.NewTicker(gcInterval)
+		defer t.Stop()
+		gc = t.C
+	}
+	if compactInterval > 0 {
+		t := time.NewTicker(compactInterval)
+		defer t.Stop()
+		compact = t.C
+	}
+
+	for {
+		select {
+		case <-gc:
+			_ = b.SessionStore.maintain(false)
+		case <-compact:
+			_ = b.SessionStore.maintain(true)
+		}
+	}
+}
+
+// StoreStats returns the size, the number of records and the health of the session store.
+func (b *Broker) StoreStats() StoreStats {
+	ss := b.SessionStore
+	stats := StoreStats{Backend: ss.config.Backend}
+	if stats.Backend == "" {
+		stats.Backend = SessionStoreBadger
+	}
+	if stats.Backend != SessionStoreMemory {
+		stats.Path = ss.config.Path
+	}
+	if ms, ok := ss.maintained(); ok {
+		stats.DiskSize = ms.diskSize()
+	}
+	if es, ok := ss.SessionStore.(*encryptedStore); ok {
+		stats.Encrypted, stats.KeyID = true, es.keyID()
+	}
+
+	stats.Keys, _ = ss.Count("")
+	for kind, n := range map[byte]*int{
+		sessionKeyMeta:         &stats.Sessions,
+		sessionKeyInflight:     &stats.Inflight,
+		sessionKeyInbound:      &stats.Inbound,
+		sessionKeyQueue:        &stats.Queued,
+		sessionKeySubscription: &stats.Subscriptions,
+		sessionKeyRetained:     &stats.Retained,
+	} {
+		*n, _ = ss.Count(sessionKindPrefix(kind))
+	}
+
+	ss.healthMutex.Lock()
+	defer ss.healthMutex.Unlock()
+
+	stats.Corrupt = append([]StoreProblem{}, ss.corrupt...)
+	if !ss.lastGC.IsZero() {
+		lastGC := ss.lastGC
+		stats.LastGC = &lastGC
+	}
+	if !ss.lastCompaction.IsZero() {
+		lastCompaction := ss.lastCompaction
+		stats.LastCompaction = &lastCompaction
+	}
+	stats.LastError = ss.lastError
+	return stats
+}
+
+// VerifyStore checks every record of the session store and reports the ones that can't be decoded or
+// don't belong to any session. With repair set they're deleted, except the ones of connected clients.
+func (b *Broker) VerifyStore(repair bool) (StoreReport, error) {
+	return b.SessionStore.verify(repair, func(id string) bool {
+		return b.getClient(id) != nil
+	})
+}
+
+// MaintainStore runs the garbage collection and the compaction of the session store now.
+func (b *Broker) MaintainStore() error {
+	return b.SessionStore.maintain(true)
+}
+
+// CheckSessionStore opens the session store of the config file, while the broker isn't running,
+// and verifies it, repairing it if repair is set. The store is opened read-only unless it's repaired,
+// which migrates the sessions stored by older versions first.
+func CheckSessionStore(repair bool) (StoreReport, error) {
+	open := inspectSessionStore
+	if repair {
+		open = loadSessionStore
+	}
+	ss, err := openConfiguredSessionStore(open)
+	if err != nil {
+		return StoreReport{}, err
+	}
+	defer ss.Close()
+
+	return ss.verify(repair, nil)
+}
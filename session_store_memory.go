@@ -0,0 +1,110 @@
+package gott
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// memoryStore is a SessionStore kept in memory, for ephemeral deployments and tests.
+type memoryStore struct {
+	data  map[string][]byte
+	mutex sync.RWMutex
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{data: map[string][]byte{}}
+}
+
+func (ms *memoryStore) Get(key string) ([]byte, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	val, ok := ms.data[key]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return val, nil
+}
+
+func (ms *memoryStore) Set(key string, value []byte) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	ms.data[key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (ms *memoryStore) Batch(ops []StoreOp) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	for _, op := range ops {
+		if op.Delete {
+			delete(ms.data, op.Key)
+		} else {
+			ms.data[op.Key] = append([]byte(nil), op.Value...)
+		}
+	}
+	return nil
+}
+
+func (ms *memoryStore) Delete(key string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	delete(ms.data, key)
+	return nil
+}
+
+func (ms *memoryStore) Exists(key string) bool {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	_, ok := ms.data[key]
+	return ok
+}
+
+// Iterate calls fn on a snapshot of the keys so fn may modify the store.
+func (ms *memoryStore) Iterate(prefix string, fn func(key string, value []byte) error) error {
+	ms.mutex.RLock()
+	keys := ms.keys(prefix)
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = ms.data[key]
+	}
+	ms.mutex.RUnlock()
+
+	for i, key := range keys {
+		if err := fn(key, values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ms *memoryStore) Count(prefix string) (int, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	if prefix == "" {
+		return len(ms.data), nil
+	}
+	return len(ms.keys(prefix)), nil
+}
+
+// keys returns the sorted keys starting with prefix. The caller must hold the lock.
+func (ms *memoryStore) keys(prefix string) []string {
+	keys := make([]string, 0)
+	for key := range ms.data {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (ms *memoryStore) Close() error {
+	return nil
+}
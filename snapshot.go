@@ -0,0 +1,499 @@
+package gott
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"time"
+
+	js "github.com/json-iterator/go"
+	"go.uber.org/zap"
+)
+
+// Snapshot formats.
+const (
+	SnapshotBinary = "binary" // the records of the session store as they are, restorable by the same codec version
+	SnapshotJSON   = "json"   // decoded sessions and retained messages, to inspect, edit or migrate them
+)
+
+// A binary snapshot starts with snapshotMagic, the snapshot version, the session codec version, flags
+// (since version 2) and the time it was taken, followed by a log record (see session_store_log.go) per key
+// of the store. It ends with a delete record of an empty key holding the number of records, so truncated
+// snapshots are detected. Snapshots of an encrypted store have snapshotSealed set and their values
+// encrypted with the current key of the store, as in the store.
+const (
+	snapshotMagic     = "GOTTSNAP"
+	snapshotVersion   = 2
+	snapshotSealed    = 1 << 0
+	snapshotMaxRecord = 1 << 29 // larger than the largest MQTT message
+	exportVersion     = 1
+)
+
+var (
+	ErrSnapshotFormat    = errors.New("unknown snapshot format")
+	ErrSnapshotVersion   = errors.New("unsupported snapshot version")
+	ErrSnapshotTruncated = errors.New("snapshot is truncated")
+	ErrStoreNotEmpty     = errors.New("session store is not empty")
+	ErrSnapshotSealed    = errors.New("snapshot is encrypted, restore it into a session store encrypted with its key")
+	ErrSnapshotPlaintext = errors.New("session store is encrypted, JSON snapshots are written in plaintext and must be requested explicitly")
+)
+
+// SnapshotInfo describes a snapshot that was written or restored.
+type SnapshotInfo struct {
+	Format   string
+	Version  int
+	Created  time.Time
+	Keys     int
+	Sessions int
+	Retained int
+	Skipped  int  `json:",omitempty"` // corrupt records left out of the snapshot
+	Sealed   bool `json:",omitempty"` // of a binary snapshot whose values are encrypted
+}
+
+// Export is the broker state in the JSON snapshot format.
+type Export struct {
+	Version  int
+	Created  time.Time
+	Sessions []SessionExport
+	Retained []RetainedMessage
+}
+
+// SessionExport is a persistent session with its subscriptions and messages.
+type SessionExport struct {
+	ID             string
+	DisconnectedAt *time.Time `json:",omitempty"`
+	Dropped        int64      // messages dropped from the offline queue
+	Subscriptions  []SubscriptionExport
+	Inflight       []MessageExport // sent to the client and not acknowledged yet
+	Inbound        []MessageExport // QoS 2 messages received from the client and waiting for their PUBREL
+	Queued         []MessageExport // published while the client was offline, in order
+}
+
+// SubscriptionExport is a subscription of a persistent session.
+type SubscriptionExport struct {
+	Filter string
+	QoS    byte
+}
+
+// MessageExport is a message of a persistent session. Queued messages have no packet identifier.
+type MessageExport struct {
+	PacketID uint16 `json:",omitempty"`
+	Topic    string
+	Payload  []byte
+	QoS      byte
+	Retain   bool      `json:",omitempty"`
+	Status   int32     `json:",omitempty"`
+	Time     time.Time // when it was stored or queued
+}
+
+// snapshot calls fn for every valid record of the store, in a single iteration so the records
+// are consistent with each other. Corrupt records are skipped and counted in info.
+func (ss *sessionStore) snapshot(info *SnapshotInfo, fn func(kind byte, id, suffix string, key string, val []byte) error) error {
+	return ss.Iterate("", func(key string, val []byte) error {
+		kind, id, suffix, ok := parseSessionKey(key)
+		if !ok || checkSessionRecord(kind, suffix, val) != nil {
+			info.Skipped++
+			return nil
+		}
+
+		info.Keys++
+		switch kind {
+		case sessionKeyMeta:
+			info.Sessions++
+		case sessionKeyRetained:
+			info.Retained++
+		}
+		return fn(kind, id, suffix, key, val)
+	})
+}
+
+// backup writes a snapshot of the store to w in the given format. JSON snapshots of an encrypted store
+// are only written if plaintext is set.
+func (ss *sessionStore) backup(w io.Writer, format string, plaintext bool) (SnapshotInfo, error) {
+	info := SnapshotInfo{Format: format, Created: time.Now()}
+	es, encrypted := ss.SessionStore.(*encryptedStore)
+
+	var err error
+	switch format {
+	case SnapshotBinary, "":
+		info.Format, info.Version, info.Sealed = SnapshotBinary, snapshotVersion, encrypted
+		err = ss.writeSnapshot(w, &info, es)
+	case SnapshotJSON:
+		if encrypted && !plaintext {
+			return info, ErrSnapshotPlaintext
+		}
+		info.Version = exportVersion
+		err = ss.writeExport(w, &info)
+	default:
+		return info, ErrSnapshotFormat
+	}
+	if err != nil {
+		return info, err
+	}
+
+	if info.Skipped > 0 {
+		log.Printf("left %d corrupt records out of the snapshot", info.Skipped)
+	}
+	ss.logger.Info("session store backup", zap.String("format", info.Format), zap.Int("keys", info.Keys),
+		zap.Int("skipped", info.Skipped))
+	return info, nil
+}
+
+// writeSnapshot writes a binary snapshot, with the values encrypted with the current key of es if it's set.
+func (ss *sessionStore) writeSnapshot(w io.Writer, info *SnapshotInfo, es *encryptedStore) error {
+	bw := bufio.NewWriter(w)
+
+	header := append([]byte(snapshotMagic), snapshotVersion, sessionCodecVersion, 0)
+	if es != nil {
+		header[len(header)-1] |= snapshotSealed
+	}
+	if _, err := bw.Write(appendTime(header, info.Created)); err != nil {
+		return err
+	}
+
+	err := ss.snapshot(info, func(_ byte, _, _ string, key string, val []byte) error {
+		if es != nil {
+			val = es.seal(key, val)
+		}
+		_, err := bw.Write(encodeLogRecord(logOpSet, key, val))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := bw.Write(encodeLogRecord(logOpDelete, "", appendUvarint(nil, uint64(info.Keys)))); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func (ss *sessionStore) writeExport(w io.Writer, info *SnapshotInfo) error {
+	export := Export{Version: exportVersion, Created: info.Created, Sessions: []SessionExport{}, Retained: []RetainedMessage{}}
+	sessions := map[string]*SessionExport{}
+	records := map[string]int{} // of each session, to leave out the sessions without metadata
+	session := func(id string) *SessionExport {
+		records[id]++
+		if sessions[id] == nil {
+			sessions[id] = &SessionExport{ID: id}
+		}
+		return sessions[id]
+	}
+	metas := map[string]bool{}
+
+	// the records were checked by snapshot, decoding them can't fail
+	err := ss.snapshot(info, func(kind byte, id, suffix string, _ string, val []byte) error {
+		switch kind {
+		case sessionKeyMeta:
+			s := newStoredSession(id)
+			_ = decodeSessionMeta(val, s)
+			e := session(id)
+			e.Dropped = s.Queue.Dropped
+			if !s.DisconnectedAt.IsZero() {
+				e.DisconnectedAt = &s.DisconnectedAt
+			}
+			metas[id] = true
+		case sessionKeyInflight, sessionKeyInbound:
+			cm, _ := decodeClientMessage(val)
+			m := MessageExport{
+				PacketID: binary.BigEndian.Uint16([]byte(suffix)),
+				Topic:    string(cm.Topic),
+				Payload:  cm.Payload,
+				QoS:      cm.QoS,
+				Retain:   cm.Retain == 1,
+				Status:   cm.Status,
+			}
+			if cm.StoredAt != 0 {
+				m.Time = time.Unix(0, cm.StoredAt)
+			}
+			if e := session(id); kind == sessionKeyInflight {
+				e.Inflight = append(e.Inflight, m)
+			} else {
+				e.Inbound = append(e.Inbound, m)
+			}
+		case sessionKeyQueue:
+			e, _ := decodeQueueEntry(val, 0)
+			s := session(id)
+			s.Queued = append(s.Queued, MessageExport{Topic: string(e.Topic), Payload: e.Payload, QoS: e.QoS, Time: e.QueuedAt})
+		case sessionKeySubscription:
+			s := session(id)
+			s.Subscriptions = append(s.Subscriptions, SubscriptionExport{Filter: suffix, QoS: val[0]})
+		case sessionKeyRetained:
+			msg, _ := decodeRetainedMessage(id, val)
+			export.Retained = append(export.Retained, RetainedMessage{Topic: id, Payload: msg.Payload, QoS: msg.QoS, Timestamp: msg.Timestamp})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for id, s := range sessions {
+		if !metas[id] {
+			// the records of sessions without metadata would be deleted by a repair
+			info.Keys -= records[id]
+			info.Skipped += records[id]
+			continue
+		}
+		export.Sessions = append(export.Sessions, *s)
+	}
+	sort.Slice(export.Sessions, func(i, j int) bool {
+		return export.Sessions[i].ID < export.Sessions[j].ID
+	})
+
+	enc := js.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(export)
+}
+
+// restore replaces the content of the store with a snapshot in either format.
+// Unless force is set, the store must be empty.
+func (ss *sessionStore) restore(r io.Reader, force bool) (SnapshotInfo, error) {
+	br := bufio.NewReader(r)
+	first, err := br.Peek(1)
+	if err != nil {
+		return SnapshotInfo{}, ErrSnapshotTruncated
+	}
+
+	var info SnapshotInfo
+	var ops []StoreOp
+	if first[0] == snapshotMagic[0] {
+		es, _ := ss.SessionStore.(*encryptedStore)
+		info, ops, err = readSnapshot(br, es)
+	} else {
+		info, ops, err = readExport(br)
+	}
+	if err != nil {
+		return info, err
+	}
+
+	var clear []StoreOp
+	err = ss.Iterate("", func(key string, _ []byte) error {
+		clear = append(clear, StoreOp{Key: key, Delete: true})
+		return nil
+	})
+	if err != nil {
+		return info, err
+	}
+	if len(clear) > 0 && !force {
+		return info, ErrStoreNotEmpty
+	}
+
+	if err := ss.batch(append(clear, ops...)); err != nil {
+		return info, err
+	}
+
+	log.Printf("restored %d keys: %d sessions and %d retained messages", info.Keys, info.Sessions, info.Retained)
+	ss.logger.Info("session store restore", zap.String("format", info.Format), zap.Int("keys", info.Keys),
+		zap.Int("replaced", len(clear)))
+	return info, nil
+}
+
+// readSnapshot reads and checks every record of a binary snapshot. The values of sealed snapshots are
+// decrypted with the keys of es, which must be set, and returned in plaintext.
+func readSnapshot(r *bufio.Reader, es *encryptedStore) (SnapshotInfo, []StoreOp, error) {
+	info := SnapshotInfo{Format: SnapshotBinary}
+
+	header := make([]byte, len(snapshotMagic)+2)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return info, nil, ErrSnapshotFormat
+	}
+	info.Version = int(header[len(snapshotMagic)])
+	if info.Version < 1 || info.Version > snapshotVersion {
+		return info, nil, ErrSnapshotVersion
+	}
+	if codec := header[len(snapshotMagic)+1]; codec != sessionCodecVersion {
+		return info, nil, fmt.Errorf("snapshot of session codec version %d, restore a JSON snapshot instead: %w", codec, ErrSnapshotVersion)
+	}
+	if info.Version >= 2 {
+		flags, err := r.ReadByte()
+		if err != nil {
+			return info, nil, ErrSnapshotTruncated
+		}
+		info.Sealed = flags&snapshotSealed != 0
+	}
+	if info.Sealed && es == nil {
+		return info, nil, ErrSnapshotSealed
+	}
+	created, err := binary.ReadVarint(r)
+	if err != nil {
+		return info, nil, ErrSnapshotTruncated
+	}
+	if created != 0 {
+		info.Created = time.Unix(0, created)
+	}
+
+	var ops []StoreOp
+	for {
+		op, key, val, _, err := readLogRecord(r, snapshotMaxRecord)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return info, nil, ErrSnapshotTruncated
+		} else if err != nil {
+			return info, nil, err
+		}
+
+		if op == logOpDelete && key == "" {
+			if count, n := binary.Uvarint(val); n <= 0 || count != uint64(len(ops)) {
+				return info, nil, ErrSnapshotTruncated
+			}
+			return info, ops, nil
+		}
+
+		kind, _, suffix, ok := parseSessionKey(key)
+		if op != logOpSet || !ok {
+			return info, nil, errCorruptSessionRecord
+		}
+		if info.Sealed {
+			if !encryptedValue(val) {
+				return info, nil, fmt.Errorf("%s record %x: %v", sessionKindName(kind), key, errCorruptSessionRecord)
+			}
+			if val, err = es.open(key, val); err == errUnknownStoreKey {
+				return info, nil, fmt.Errorf("%v: %w", errUnknownStoreKey, ErrSnapshotSealed)
+			} else if err != nil {
+				return info, nil, fmt.Errorf("%s record %x: %v", sessionKindName(kind), key, err)
+			}
+		}
+		if err := checkSessionRecord(kind, suffix, val); err != nil {
+			return info, nil, fmt.Errorf("%s record %x: %v", sessionKindName(kind), key, err)
+		}
+
+		info.Keys++
+		switch kind {
+		case sessionKeyMeta:
+			info.Sessions++
+		case sessionKeyRetained:
+			info.Retained++
+		}
+		ops = append(ops, StoreOp{Key: key, Value: val})
+	}
+}
+
+// readExport reads and checks a JSON snapshot and encodes it to the records of the store.
+func readExport(r io.Reader) (SnapshotInfo, []StoreOp, error) {
+	info := SnapshotInfo{Format: SnapshotJSON}
+
+	var export Export
+	if err := js.NewDecoder(r).Decode(&export); err != nil {
+		return info, nil, err
+	}
+	info.Version, info.Created = export.Version, export.Created
+	if export.Version != exportVersion {
+		return info, nil, ErrSnapshotVersion
+	}
+
+	var ops []StoreOp
+	for _, e := range export.Sessions {
+		if e.ID == "" {
+			return info, nil, fmt.Errorf("session without ID")
+		}
+
+		s := newStoredSession(e.ID)
+		s.Queue.Dropped = e.Dropped
+		if e.DisconnectedAt != nil {
+			s.DisconnectedAt = *e.DisconnectedAt
+		}
+		ops = append(ops, StoreOp{Key: sessionMetaKey(e.ID), Value: encodeSessionMeta(s)})
+
+		for _, sub := range e.Subscriptions {
+			if !validFilter([]byte(sub.Filter)) {
+				return info, nil, fmt.Errorf("session %s: %w: %q", e.ID, ErrInvalidTopicFilter, sub.Filter)
+			}
+			if sub.QoS > 2 {
+				return info, nil, fmt.Errorf("session %s: %w", e.ID, ErrInvalidQoS)
+			}
+			ops = append(ops, StoreOp{Key: sessionSubscriptionKey(e.ID, []byte(sub.Filter)), Value: []byte{sub.QoS}})
+		}
+
+		for kind, messages := range map[byte][]MessageExport{sessionKeyInflight: e.Inflight, sessionKeyInbound: e.Inbound} {
+			for _, m := range messages {
+				if err := checkExportedMessage(m, 1); err != nil {
+					return info, nil, fmt.Errorf("session %s: %w", e.ID, err)
+				}
+
+				cm := &clientMessage{Topic: []byte(m.Topic), Payload: m.Payload, QoS: m.QoS, Status: m.Status}
+				if m.Retain {
+					cm.Retain = 1
+				}
+				if !m.Time.IsZero() {
+					cm.StoredAt = m.Time.UnixNano()
+				}
+				key := sessionInflightKey(e.ID, m.PacketID)
+				if kind == sessionKeyInbound {
+					key = sessionInboundKey(e.ID, m.PacketID)
+				}
+				ops = append(ops, StoreOp{Key: key, Value: encodeClientMessage(cm)})
+			}
+		}
+
+		for i, m := range e.Queued {
+			if err := checkExportedMessage(m, 0); err != nil {
+				return info, nil, fmt.Errorf("session %s: %w", e.ID, err)
+			}
+			entry := &queueEntry{Topic: []byte(m.Topic), Payload: m.Payload, QoS: m.QoS, QueuedAt: m.Time}
+			ops = append(ops, StoreOp{Key: sessionQueueKey(e.ID, uint64(i)), Value: encodeQueueEntry(entry)})
+		}
+		info.Sessions++
+	}
+
+	for _, m := range export.Retained {
+		if !validTopicName([]byte(m.Topic)) {
+			return info, nil, fmt.Errorf("retained message: %w: %q", ErrInvalidTopicName, m.Topic)
+		}
+		if m.QoS > 2 {
+			return info, nil, fmt.Errorf("retained message %s: %w", m.Topic, ErrInvalidQoS)
+		}
+		msg := &message{Payload: m.Payload, QoS: m.QoS, Timestamp: m.Timestamp}
+		ops = append(ops, StoreOp{Key: retainedKey([]byte(m.Topic)), Value: encodeRetainedMessage(msg)})
+		info.Retained++
+	}
+
+	info.Keys = len(ops)
+	return info, ops, nil
+}
+
+// checkExportedMessage validates a message of a JSON snapshot, minQoS is 1 for inflight and inbound messages.
+func checkExportedMessage(m MessageExport, minQoS byte) error {
+	if !validTopicName([]byte(m.Topic)) {
+		return fmt.Errorf("%w: %q", ErrInvalidTopicName, m.Topic)
+	}
+	if m.QoS < minQoS || m.QoS > 2 {
+		return ErrInvalidQoS
+	}
+	return nil
+}
+
+// Backup writes a consistent snapshot of the persistent sessions and the retained messages to w
+// while the broker is running. format is SnapshotBinary or SnapshotJSON. Binary snapshots of an encrypted
+// store are encrypted with its current key, JSON snapshots of it are only written, in plaintext,
+// if plaintext is set.
+func (b *Broker) Backup(w io.Writer, format string, plaintext bool) (SnapshotInfo, error) {
+	return b.SessionStore.backup(w, format, plaintext)
+}
+
+// BackupSessionStore opens the session store of the config file, while the broker isn't running,
+// and writes a snapshot of it to w as Backup does.
+func BackupSessionStore(w io.Writer, format string, plaintext bool) (SnapshotInfo, error) {
+	ss, err := openConfiguredSessionStore(loadSessionStore)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	defer ss.Close()
+
+	return ss.backup(w, format, plaintext)
+}
+
+// RestoreSessionStore opens the session store of the config file, while the broker isn't running,
+// and replaces its content with a snapshot in either format. Unless force is set, the store must be empty.
+func RestoreSessionStore(r io.Reader, force bool) (SnapshotInfo, error) {
+	ss, err := openConfiguredSessionStore(loadSessionStore)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	defer ss.Close()
+
+	return ss.restore(r, force)
+}
@@ -0,0 +1,52 @@
+package gott
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of the broker's statistics.
+type Stats struct {
+	Version            string
+	Uptime             int64 // seconds
+	ClientsConnected   int
+	ClientsByTransport map[string]int
+	Sessions           int
+	Subscriptions      int
+	TopicLevels        int
+	RetainedMessages   int
+	InflightMessages   int
+	MessagesReceived   int64
+	MessagesSent       int64
+	PublishReceived    int64
+	PublishSent        int64
+	BytesReceived      int64
+	BytesSent          int64
+}
+
+// Stats returns a snapshot of the broker's statistics.
+func (b *Broker) Stats() Stats {
+	tree := b.TopicFilterStorage.stats()
+	byTransport := b.clientsByTransport()
+
+	stats := Stats{
+		Version:            Version,
+		Uptime:             int64(time.Since(b.startedAt).Seconds()),
+		ClientsByTransport: byTransport,
+		Sessions:           b.SessionStore.count(),
+		Subscriptions:      tree.Subscriptions,
+		TopicLevels:        tree.Levels,
+		RetainedMessages:   b.RetainedStore.len(),
+		InflightMessages:   int(atomic.LoadInt64(&metrics.inflight[1]) + atomic.LoadInt64(&metrics.inflight[2])),
+		MessagesReceived:   sumCounters(&metrics.packetsReceived),
+		MessagesSent:       sumCounters(&metrics.packetsSent),
+		PublishReceived:    atomic.LoadInt64(&metrics.packetsReceived[TypePublish]),
+		PublishSent:        atomic.LoadInt64(&metrics.packetsSent[TypePublish]),
+		BytesReceived:      sumCounters(&metrics.bytesReceived),
+		BytesSent:          sumCounters(&metrics.bytesSent),
+	}
+	for _, n := range byTransport {
+		stats.ClientsConnected += n
+	}
+	return stats
+}
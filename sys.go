@@ -0,0 +1,46 @@
+package gott
+
+import (
+	"strconv"
+	"time"
+)
+
+// publishSysTopics publishes the broker's statistics under the $SYS topic tree as retained messages
+// every interval until the broker exits.
+func (b *Broker) publishSysTopics(interval time.Duration) {
+	defer Recover(nil)
+
+	b.publishSys("$SYS/broker/version", Version)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		b.publishSysStats()
+		<-ticker.C
+	}
+}
+
+func (b *Broker) publishSysStats() {
+	stats := b.Stats()
+
+	b.publishSys("$SYS/broker/uptime", strconv.FormatInt(stats.Uptime, 10)+" seconds")
+	b.publishSysInt("$SYS/broker/clients/connected", int64(stats.ClientsConnected))
+	b.publishSysInt("$SYS/broker/clients/total", int64(stats.Sessions))
+	b.publishSysInt("$SYS/broker/messages/received", stats.MessagesReceived)
+	b.publishSysInt("$SYS/broker/messages/sent", stats.MessagesSent)
+	b.publishSysInt("$SYS/broker/publish/messages/received", stats.PublishReceived)
+	b.publishSysInt("$SYS/broker/publish/messages/sent", stats.PublishSent)
+	b.publishSysInt("$SYS/broker/bytes/received", stats.BytesReceived)
+	b.publishSysInt("$SYS/broker/bytes/sent", stats.BytesSent)
+	b.publishSysInt("$SYS/broker/subscriptions/count", int64(stats.Subscriptions))
+	b.publishSysInt("$SYS/broker/retained messages/count", int64(stats.RetainedMessages))
+}
+
+func (b *Broker) publishSysInt(topic string, value int64) {
+	b.publishSys(topic, strconv.FormatInt(value, 10))
+}
+
+func (b *Broker) publishSys(topic, payload string) {
+	b.Publish([]byte(topic), []byte(payload), publishFlags{Retain: true})
+}
@@ -0,0 +1,137 @@
+package gott
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Policies applied when a client connects with the ID of a connected client.
+const (
+	TakeoverPolicyTakeover     = "takeover"      // the new connection replaces the existing one
+	TakeoverPolicyReject       = "reject"        // the new connection is rejected
+	TakeoverPolicySameUsername = "same_username" // the new connection replaces the existing one only if they share a username
+)
+
+// takeoverHistoryLimit is the number of client IDs with recent takeovers above which expired entries are swept.
+const takeoverHistoryLimit = 10000
+
+// takeoverLimiter detects clients with the same ID kicking each other in a loop. A client ID taken over
+// loop_threshold times within loop_window seconds is blocked, new connections with it are rejected for
+// loop_block seconds.
+type takeoverLimiter struct {
+	history map[string]*takeoverHistory
+	mutex   sync.Mutex
+}
+
+type takeoverHistory struct {
+	windowStart  time.Time
+	count        int
+	blockedUntil time.Time
+}
+
+func newTakeoverLimiter() *takeoverLimiter {
+	return &takeoverLimiter{history: map[string]*takeoverHistory{}}
+}
+
+// blocked checks whether a client ID is blocked because of a takeover loop.
+func (tl *takeoverLimiter) blocked(clientID string, now time.Time) bool {
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+
+	h := tl.history[clientID]
+	return h != nil && now.Before(h.blockedUntil)
+}
+
+// record counts a takeover of a client ID and returns true if it starts blocking the ID.
+func (tl *takeoverLimiter) record(clientID string, now time.Time, cnf takeoverConfig) bool {
+	if cnf.LoopThreshold <= 0 {
+		return false
+	}
+	window := time.Duration(cnf.LoopWindow) * time.Second
+
+	tl.mutex.Lock()
+	defer tl.mutex.Unlock()
+
+	h := tl.history[clientID]
+	if h == nil {
+		if len(tl.history) >= takeoverHistoryLimit {
+			tl.sweep(now, window)
+		}
+		h = &takeoverHistory{}
+		tl.history[clientID] = h
+	}
+	if now.Sub(h.windowStart) > window {
+		h.windowStart, h.count = now, 0
+	}
+
+	h.count++
+	if h.count < cnf.LoopThreshold {
+		return false
+	}
+	h.windowStart, h.count = now, 0
+	h.blockedUntil = now.Add(time.Duration(cnf.LoopBlock) * time.Second)
+	return true
+}
+
+// sweep forgets the client IDs that are neither blocked nor taken over within the window.
+func (tl *takeoverLimiter) sweep(now time.Time, window time.Duration) {
+	for id, h := range tl.history {
+		if now.Sub(h.windowStart) > window && !now.Before(h.blockedUntil) {
+			delete(tl.history, id)
+		}
+	}
+}
+
+// allowTakeover applies the takeover policy to a client connecting with the ID of a connected client.
+func (b *Broker) allowTakeover(old, client *Client) bool {
+	switch b.config.Takeover.Policy {
+	case TakeoverPolicyReject:
+		return false
+	case TakeoverPolicySameUsername:
+		return old.Username == client.Username
+	default:
+		return true
+	}
+}
+
+// addClient registers a connected client and returns the CONNACK return code. An existing client
+// with the same ID is either taken over, replaced in a single step and its connection closed,
+// or the new client is rejected, depending on the takeover policy and on takeover loops.
+func (b *Broker) addClient(client *Client) byte {
+	now := time.Now()
+	if b.takeovers.blocked(client.ClientID, now) {
+		client.setDisconnectReason(DisconnectTakeoverLoop)
+		return ConnectIDRejected
+	}
+
+	old, ok := b.clients.swap(client, b.allowTakeover)
+	if !ok {
+		log.Println("rejected client with the id of a connected client:", client.ClientID)
+		b.logger.Info("takeover rejected", zap.String("id", client.ClientID), zap.String("policy", b.config.Takeover.Policy))
+		client.setDisconnectReason(DisconnectTakeoverRejected)
+		return ConnectIDRejected
+	}
+	if old == nil {
+		return ConnectAccepted
+	}
+
+	log.Println("disconnecting existing client with id:", old.ClientID)
+	old.setDisconnectReason(DisconnectTakeover)
+	old.closeConnection()
+
+	if b.takeovers.record(client.ClientID, now, b.config.Takeover) {
+		cnf := b.config.Takeover
+		log.Printf("client id %s was taken over %d times within %ds, rejecting it for %ds", client.ClientID, cnf.LoopThreshold, cnf.LoopWindow, cnf.LoopBlock)
+		b.logger.Error("takeover loop", zap.String("id", client.ClientID), zap.Int("takeovers", cnf.LoopThreshold),
+			zap.Int("window", cnf.LoopWindow), zap.Int("block", cnf.LoopBlock))
+	}
+	return ConnectAccepted
+}
+
+// removeClient unregisters a client unless it was already taken over.
+func (b *Broker) removeClient(client *Client) {
+	b.clients.remove(client)
+}
@@ -4,8 +4,10 @@ import (
 	gob "bytes"
 	"fmt"
 	"gott/utils"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 var (
@@ -13,212 +15,106 @@ var (
 	topicDelim               = []byte{47} // /
 	topicSingleLevelWildcard = []byte{43} // +
 	topicMultiLevelWildcard  = []byte{35} // #
+	sysTopic                 = []byte("$SYS")
+	sysTopicPrefix           = []byte("$SYS/")
 )
 
+// topicLevel is a node of the Topic Tree. Its children map and subscription list are copied on write
+// so that publishing can match topics without taking any lock.
 type topicLevel struct {
-	hasSingleWildcardAsChild atomicBool
-	hasMultiWildcardAsChild  atomicBool
-	parent                   *topicLevel
-	Bytes                    []byte
-	Children                 []*topicLevel
-	Subscriptions            *subscriptionList
-	QoS                      byte
-	RetainedMessage          *message
+	parent        *topicLevel
+	Bytes         []byte
+	children      atomic.Value // map[string]*topicLevel
+	Subscriptions *subscriptionList
 }
 
-func (tl *topicLevel) deleteSubscription(index int) {
-	tl.Subscriptions.Delete(index)
+func newTopicLevel(parent *topicLevel, b []byte) *topicLevel {
+	return &topicLevel{parent: parent, Bytes: b, Subscriptions: &subscriptionList{}}
 }
 
-func (tl *topicLevel) reverse(segs [][]byte, matches *[]*topicLevel) {
-	if len(segs) == 0 {
-		if tl.RetainedMessage != nil {
-			*matches = append(*matches, tl)
-		}
-		return
-	}
-
-	seg := segs[0]
-
-	isSingleWildcard := gob.Equal(seg, topicSingleLevelWildcard)
-	isMultiWildcard := gob.Equal(seg, topicMultiLevelWildcard)
-
-	if isMultiWildcard && !gob.Equal(tl.Bytes, topicMultiLevelWildcard) && tl.RetainedMessage != nil {
-		*matches = append(*matches, tl)
-	}
-
-	for _, child := range tl.Children {
-		if isMultiWildcard {
-			child.reverse([][]byte{topicMultiLevelWildcard}, matches)
-		} else if isSingleWildcard || gob.Equal(seg, child.Bytes) {
-			child.reverse(segs[1:], matches)
-		}
-	}
-}
-
-func (tl *topicLevel) match(segs [][]byte, matches *[]*topicLevel) *topicLevel {
-	if (tl.Subscriptions.Len() != 0 || len(tl.Children) == 0) && len(segs) == 0 || (gob.Equal(tl.Bytes, topicSingleLevelWildcard) && len(tl.Children) == 0 && len(segs) == 0) || gob.Equal(tl.Bytes, topicMultiLevelWildcard) {
-		*matches = append(*matches, tl)
-		return tl
-	}
-
-	if len(tl.Children) != 0 && len(segs) != 0 {
-		if tl.hasMultiWildcardAsChild.Load() && len(segs) == 0 {
-			*matches = append(*matches, tl)
-		}
-		hits := tl.findAll(segs[0])
-		for _, hit := range hits {
-			hit.match(segs[1:], matches)
-		}
-	}
-
-	return nil
+func (tl *topicLevel) loadChildren() map[string]*topicLevel {
+	children, _ := tl.children.Load().(map[string]*topicLevel)
+	return children
 }
 
-func (tl *topicLevel) retain(msg *message) {
-	tl.RetainedMessage = msg
+func (tl *topicLevel) child(b []byte) *topicLevel {
+	return tl.loadChildren()[string(b)]
 }
 
+// addChild and removeChild must be called with the topicStorage mutex held.
 func (tl *topicLevel) addChild(child *topicLevel) {
-	tl.Children = append(tl.Children, child)
-}
-
-func (tl *topicLevel) parseChildren(client *Client, children [][]byte, qos byte) {
-	childrenLen := len(children)
-	if childrenLen == 0 {
-		return
-	}
-
-	b := children[0]
-	l := tl.find(b)
-
-	if l == nil {
-		l = &topicLevel{Bytes: b, parent: tl, Subscriptions: &subscriptionList{}}
-		tl.addChild(l)
-	}
-
-	if gob.Equal(b, topicSingleLevelWildcard) {
-		tl.hasSingleWildcardAsChild.Store(true)
-	} else if gob.Equal(b, topicMultiLevelWildcard) {
-		tl.hasMultiWildcardAsChild.Store(true)
-		tl.createOrUpdateSubscription(client, qos)
-	}
-
-	if childrenLen == 1 {
-		l.createOrUpdateSubscription(client, qos)
-		return
-	}
-	l.parseChildren(client, children[1:], qos)
-}
-
-func (tl *topicLevel) parseChildrenRetain(msg *message, children [][]byte) {
-	childrenLen := len(children)
-	if childrenLen == 0 {
-		return
-	}
-
-	b := children[0]
-	l := tl.find(b)
-	if l == nil {
-		l = &topicLevel{Bytes: b, parent: tl, Subscriptions: &subscriptionList{}}
-		tl.addChild(l)
+	old := tl.loadChildren()
+	children := make(map[string]*topicLevel, len(old)+1)
+	for k, v := range old {
+		children[k] = v
 	}
-
-	if childrenLen == 1 && !gob.Equal(l.Bytes, topicSingleLevelWildcard) {
-		l.retain(msg)
-		return
-	}
-	l.parseChildrenRetain(msg, children[1:])
+	children[string(child.Bytes)] = child
+	tl.children.Store(children)
 }
 
-func (tl *topicLevel) traverseDelete(client *Client, children [][]byte) bool {
-	childrenLen := len(children)
-	if childrenLen == 0 {
-		return false
-	}
-
-	if l := tl.find(children[0]); l != nil {
-		if childrenLen == 1 {
-			return l.DeleteSubscription(client, true)
+func (tl *topicLevel) removeChild(child *topicLevel) {
+	old := tl.loadChildren()
+	children := make(map[string]*topicLevel, len(old))
+	for k, v := range old {
+		if v != child {
+			children[k] = v
 		}
-
-		return l.traverseDelete(client, children[1:])
 	}
-
-	return false
+	tl.children.Store(children)
 }
 
-func (tl *topicLevel) traverseDeleteAll(client *Client) {
-	for _, l := range tl.Children {
-		l.DeleteSubscription(client, false)
-		l.traverseDeleteAll(client)
-	}
+func (tl *topicLevel) isRoot() bool {
+	return tl.parent == nil
 }
 
-func (tl *topicLevel) find(child []byte) *topicLevel {
-	for _, c := range tl.Children {
-		if gob.Equal(c.Bytes, child) {
-			return c
-		}
-	}
-	return nil
+func (tl *topicLevel) empty() bool {
+	return tl.Subscriptions.Len() == 0 && len(tl.loadChildren()) == 0
 }
 
-func (tl *topicLevel) findAll(b []byte) (matches []*topicLevel) {
-	targetFound := false
-	singleWildcardFound := false
-	multiWildcardFound := false
+// match collects the levels with subscriptions matching the remaining segments of a topic name.
+func (tl *topicLevel) match(segs [][]byte, reserved bool, matches *[]*topicLevel) {
+	children := tl.loadChildren()
 
-	for _, f := range tl.Children {
-		if !targetFound && gob.Equal(f.Bytes, b) {
-			matches = append(matches, f)
-			targetFound = true
+	if len(segs) == 0 {
+		if tl.Subscriptions.Len() != 0 {
+			*matches = append(*matches, tl)
 		}
-		if tl.hasSingleWildcardAsChild.Load() && !singleWildcardFound && gob.Equal(f.Bytes, topicSingleLevelWildcard) {
-			matches = append(matches, f)
-			singleWildcardFound = true
+		// "a/#" also matches "a" as per [MQTT-4.7.1-2]
+		if multi := children[string(topicMultiLevelWildcard)]; multi != nil && multi.Subscriptions.Len() != 0 {
+			*matches = append(*matches, multi)
 		}
+		return
+	}
 
-		if tl.hasMultiWildcardAsChild.Load() && !multiWildcardFound && gob.Equal(f.Bytes, topicMultiLevelWildcard) {
-			matches = append(matches, f)
-			multiWildcardFound = true
+	// filters starting with a wildcard must not match topics starting with $ as per [MQTT-4.7.2-1]
+	if !(reserved && tl.isRoot()) {
+		if multi := children[string(topicMultiLevelWildcard)]; multi != nil && multi.Subscriptions.Len() != 0 {
+			*matches = append(*matches, multi)
 		}
-
-		if targetFound && (!tl.hasSingleWildcardAsChild.Load() || singleWildcardFound) && (!tl.hasMultiWildcardAsChild.Load() || multiWildcardFound) {
-			break
+		if single := children[string(topicSingleLevelWildcard)]; single != nil {
+			single.match(segs[1:], reserved, matches)
 		}
 	}
-	return
-}
 
-func (tl *topicLevel) createOrUpdateSubscription(client *Client, qos byte) {
-	var ret bool
-	tl.Subscriptions.Range(func(i int, sub *subscription) bool {
-		if sub.Session.ID == client.ClientID {
-			sub.QoS = qos
-
-			sub.Session = client.Session
-			ret = true
-			return false
-		}
-		return true
-	})
-	if ret {
-		return
+	if child := children[string(segs[0])]; child != nil {
+		child.match(segs[1:], reserved, matches)
 	}
+}
 
-	sub := &subscription{
-		Session: client.Session,
-		QoS:     qos,
+// walk calls fn for the level and all its descendants, parents before children.
+func (tl *topicLevel) walk(fn func(tl *topicLevel)) {
+	fn(tl)
+	for _, c := range tl.loadChildren() {
+		c.walk(fn)
 	}
-
-	tl.Subscriptions.Add(sub)
 }
 
 // DeleteSubscription removes a client's subscription from the Topic Level.
+// The subscriptions of persistent sessions are kept on non graceful disconnections.
 func (tl *topicLevel) DeleteSubscription(client *Client, graceful bool) (success bool) {
 	tl.Subscriptions.RangeDelete(func(i int, sub *subscription, delete func(int)) bool {
-		if sub.Session.ID == client.ClientID {
+		// skip the subscriptions of a newer client that took over the same ID
+		if sub.Session.ID == client.ClientID && (sub.Session.client == nil || sub.Session.client == client) {
 			if graceful || client.Session.clean {
 				delete(i)
 			} else {
@@ -232,18 +128,25 @@ func (tl *topicLevel) DeleteSubscription(client *Client, graceful bool) (success
 	return
 }
 
-// Print outputs the Topic Level's path, subscriptions and the retained message in string form.
+// Print outputs the Topic Level's path and subscriptions in string form.
 func (tl *topicLevel) Print(add string) {
-	retained := "NONE"
-	if tl.RetainedMessage != nil {
-		retained = string(tl.RetainedMessage.Payload)
-	}
-	fmt.Println(add, tl.String(), "- subscriptions:", tl.subscriptionsString(), "- retained:", retained)
-	for _, c := range tl.Children {
+	fmt.Println(add, tl.String(), "- subscriptions:", tl.subscriptionsString())
+	for _, c := range tl.sortedChildren() {
 		c.Print(add + indent)
 	}
 }
 
+func (tl *topicLevel) sortedChildren() []*topicLevel {
+	children := make([]*topicLevel, 0, len(tl.loadChildren()))
+	for _, c := range tl.loadChildren() {
+		children = append(children, c)
+	}
+	sort.Slice(children, func(i, j int) bool {
+		return gob.Compare(children[i].Bytes, children[j].Bytes) < 0
+	})
+	return children
+}
+
 func (tl *topicLevel) subscriptionsString() string {
 	strs := make([]string, 0)
 
@@ -262,7 +165,7 @@ func (tl *topicLevel) Name() string {
 
 // Path returns the path of the Topic Level.
 func (tl *topicLevel) Path() string {
-	if tl.parent != nil {
+	if tl.parent != nil && !tl.parent.isRoot() {
 		return tl.parent.Path() + "/" + tl.Name()
 	}
 	return tl.Name()
@@ -274,102 +177,203 @@ func (tl *topicLevel) String() string {
 	return tl.Path()
 }
 
+// topicStorage is the Topic Tree, a trie of topic levels indexed by name holding the subscriptions.
+// Writers are serialized by mutex and copy the maps and lists they change, readers never lock.
+// Levels left without subscriptions or children are pruned.
 type topicStorage struct {
-	Filters              []*topicLevel
-	mutex                sync.Mutex
-	hasGlobalFilter      atomicBool // has "#"
-	hasTopSingleWildcard atomicBool // has "+" as top level
+	root       *topicLevel
+	subscribed map[string][]*topicLevel // levels holding a subscription of each session, by session ID
+	queues     map[string]*messageQueue // queue of each session with subscriptions, counted in metrics.queued
+	mutex      sync.Mutex
+
+	// counted as the tree changes for the metrics, read without the mutex
+	levels, subscriptions int64
 }
 
-func (ts *topicStorage) addTopLevel(tl *topicLevel) {
-	ts.mutex.Lock()
-	ts.Filters = append(ts.Filters, tl)
-	ts.mutex.Unlock()
-	if gob.Equal(tl.Bytes, topicMultiLevelWildcard) {
-		ts.hasGlobalFilter.Store(true)
-	} else if gob.Equal(tl.Bytes, topicSingleLevelWildcard) {
-		ts.hasTopSingleWildcard.Store(true)
-	}
+func newTopicStorage() *topicStorage {
+	return &topicStorage{root: newTopicLevel(nil, nil), subscribed: map[string][]*topicLevel{}, queues: map[string]*messageQueue{}}
 }
 
-func (ts *topicStorage) find(b []byte) *topicLevel {
-	for _, f := range ts.Filters {
-		if gob.Equal(f.Bytes, b) {
-			return f
+// index records that a level holds a subscription of a session and counts the session's queue.
+// Must be called with the mutex held.
+func (ts *topicStorage) index(s *session, tl *topicLevel) {
+	if q := ts.queues[s.ID]; q != s.Queue {
+		if q != nil {
+			q.detachGauge()
 		}
+		s.Queue.attachGauge(&metrics.queued)
+		ts.queues[s.ID] = s.Queue
 	}
-	return nil
-}
-
-func (ts *topicStorage) findAll(b []byte) (matches []*topicLevel) {
-	targetFound := false
-	globalFilterFound := false
-	topSingleWildcardFound := false
 
-	ts.mutex.Lock()
-	defer ts.mutex.Unlock()
-	for _, f := range ts.Filters {
-		if !targetFound && gob.Equal(f.Bytes, b) {
-			matches = append(matches, f)
-			targetFound = true
-		}
-		if ts.hasGlobalFilter.Load() && !globalFilterFound && gob.Equal(f.Bytes, topicMultiLevelWildcard) {
-			matches = append(matches, f)
-			globalFilterFound = true
-		}
-		if ts.hasTopSingleWildcard.Load() && !topSingleWildcardFound && gob.Equal(f.Bytes, topicSingleLevelWildcard) {
-			matches = append(matches, f)
-			topSingleWildcardFound = true
+	for _, l := range ts.subscribed[s.ID] {
+		if l == tl {
+			return
 		}
+	}
+	ts.subscribed[s.ID] = append(ts.subscribed[s.ID], tl)
+}
 
-		if targetFound && (!ts.hasGlobalFilter.Load() || globalFilterFound) && (!ts.hasTopSingleWildcard.Load() || topSingleWildcardFound) {
+// unindex records that a level no longer holds a subscription of a session. Must be called with the mutex held.
+func (ts *topicStorage) unindex(id string, tl *topicLevel) {
+	levels := ts.subscribed[id]
+	for i, l := range levels {
+		if l == tl {
+			levels[i] = levels[len(levels)-1]
+			levels = levels[:len(levels)-1]
 			break
 		}
 	}
-	return
+	if len(levels) == 0 {
+		ts.unindexAll(id)
+	} else {
+		ts.subscribed[id] = levels
+	}
 }
 
-// Print outputs the whole Topic Tree to stdout.
-func (ts *topicStorage) Print() {
-	fmt.Println("Topic Tree:")
-	for _, f := range ts.Filters {
-		f.Print("")
+// unindexAll records that no level holds a subscription of a session and stops counting its queue.
+// Must be called with the mutex held.
+func (ts *topicStorage) unindexAll(id string) {
+	if q := ts.queues[id]; q != nil {
+		q.detachGauge()
 	}
+	delete(ts.queues, id)
+	delete(ts.subscribed, id)
 }
 
-func (ts *topicStorage) match(topic []byte) []*topicLevel {
-	matches := make([]*topicLevel, 0)
+// counted adds the subscriptions added to or removed from a level that had n subscriptions to the count.
+// Must be called with the mutex held.
+func (ts *topicStorage) counted(tl *topicLevel, n int) {
+	atomic.AddInt64(&ts.subscriptions, int64(tl.Subscriptions.Len()-n))
+}
 
-	segs := gob.Split(topic, topicDelim)
-	hits := ts.findAll(segs[0])
+// levelOrCreate returns the level of a topic name or filter, creating the missing levels.
+// Must be called with the mutex held.
+func (ts *topicStorage) levelOrCreate(segs [][]byte) *topicLevel {
+	tl := ts.root
+	for _, seg := range segs {
+		child := tl.child(seg)
+		if child == nil {
+			child = newTopicLevel(tl, seg)
+			tl.addChild(child)
+			atomic.AddInt64(&ts.levels, 1)
+		}
+		tl = child
+	}
+	return tl
+}
 
-	for _, hit := range hits {
-		hit.match(segs[1:], &matches)
+// prune removes a level and its ancestors as long as they are empty. Must be called with the mutex held.
+func (ts *topicStorage) prune(tl *topicLevel) {
+	for !tl.isRoot() && tl.empty() {
+		tl.parent.removeChild(tl)
+		atomic.AddInt64(&ts.levels, -1)
+		tl = tl.parent
 	}
+}
 
-	return matches
+// subscribe creates or updates the subscription of a client to a valid filter.
+func (ts *topicStorage) subscribe(client *Client, filter []byte, qos byte) {
+	ts.subscribeSession(client.Session, filter, qos)
 }
 
-func (ts *topicStorage) reverseMatch(filter []byte) []*topicLevel {
-	segs := gob.Split(filter, topicDelim)
-	segsLen := len(segs)
+// subscribeSession creates or updates the subscription of a session to a valid filter.
+func (ts *topicStorage) subscribeSession(s *session, filter []byte, qos byte) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	tl := ts.levelOrCreate(gob.Split(filter, topicDelim))
+	n := tl.Subscriptions.Len()
+	tl.Subscriptions.Set(&subscription{Session: s, QoS: qos})
+	ts.counted(tl, n)
+	ts.index(s, tl)
+}
 
-	var matches []*topicLevel
+// unsubscribe removes the subscription of a client to a filter.
+func (ts *topicStorage) unsubscribe(client *Client, filter []byte) bool {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
 
-	topLevel := segs[0]
-	isSingleWildcard := gob.Equal(topLevel, topicSingleLevelWildcard)
-	isMultiWildcard := gob.Equal(topLevel, topicMultiLevelWildcard)
+	tl := ts.level(filter)
+	if tl == nil {
+		return false
+	}
 
-	for _, level := range ts.Filters {
-		if segsLen == 1 && isSingleWildcard && level.RetainedMessage != nil {
-			matches = append(matches, level)
-		} else if (isSingleWildcard || gob.Equal(topLevel, level.Bytes)) && !gob.Equal(level.Bytes, topicMultiLevelWildcard) {
-			level.reverse(segs[1:], &matches)
-		} else if isMultiWildcard {
-			level.reverse([][]byte{topLevel}, &matches)
+	n := tl.Subscriptions.Len()
+	success := tl.DeleteSubscription(client, true)
+	ts.counted(tl, n)
+	if success {
+		ts.unindex(client.ClientID, tl)
+	}
+	ts.prune(tl)
+	return success
+}
+
+// unsubscribeAll removes all the subscriptions of a client, or detaches them from the client
+// if it has a persistent session and did not disconnect gracefully.
+func (ts *topicStorage) unsubscribeAll(client *Client) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	deleted := client.gracefulDisconnect || client.Session.clean
+	for _, tl := range append([]*topicLevel(nil), ts.subscribed[client.ClientID]...) {
+		n := tl.Subscriptions.Len()
+		if !tl.DeleteSubscription(client, client.gracefulDisconnect) || !deleted {
+			continue
 		}
+		ts.counted(tl, n)
+		ts.unindex(client.ClientID, tl)
+		ts.prune(tl)
 	}
+}
+
+// reattach points the subscriptions of a persistent session at the session loaded by its reconnecting client.
+// The session takes over the queue publishers may still be appending to through the subscriptions, holding
+// the messages published to the client until it's replayed.
+// Returns the session the subscriptions were attached to, nil if there were none.
+func (ts *topicStorage) reattach(s *session) (prev *session) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
 
+	for _, tl := range ts.subscribed[s.ID] {
+		tl.Subscriptions.Range(func(i int, sub *subscription) bool {
+			if sub.Session.ID != s.ID {
+				return true
+			}
+			if sub.Session != s {
+				if prev == nil {
+					s.Queue = sub.Session.Queue
+					s.Queue.attach()
+				}
+				prev = sub.Session
+				tl.Subscriptions.Set(&subscription{Session: s, QoS: sub.QoS})
+			}
+			return false
+		})
+	}
+	return
+}
+
+// Print outputs the whole Topic Tree to stdout.
+func (ts *topicStorage) Print() {
+	fmt.Println("Topic Tree:")
+	for _, f := range ts.root.sortedChildren() {
+		f.Print("")
+	}
+}
+
+type topicTreeStats struct {
+	Levels, Subscriptions int
+}
+
+// stats returns the number of levels and subscriptions of the Topic Tree.
+func (ts *topicStorage) stats() topicTreeStats {
+	return topicTreeStats{Levels: int(atomic.LoadInt64(&ts.levels)), Subscriptions: int(atomic.LoadInt64(&ts.subscriptions))}
+}
+
+// match returns the levels with subscriptions matching a topic name.
+func (ts *topicStorage) match(topic []byte) []*topicLevel {
+	matches := make([]*topicLevel, 0)
+	ts.root.match(gob.Split(topic, topicDelim), isReservedTopic(topic), &matches)
 	return matches
 }
 
@@ -397,6 +401,40 @@ func validFilter(filter []byte) bool {
 	return true
 }
 
+// filterMatches checks whether a topic name matches a topic filter without going through the Topic Tree.
+func filterMatches(filter, topic []byte) bool {
+	if isReservedTopic(topic) && len(filter) > 0 && (filter[0] == topicMultiLevelWildcard[0] || filter[0] == topicSingleLevelWildcard[0]) {
+		return false
+	}
+
+	fsegs := gob.Split(filter, topicDelim)
+	tsegs := gob.Split(topic, topicDelim)
+
+	for i, fseg := range fsegs {
+		if gob.Equal(fseg, topicMultiLevelWildcard) {
+			return true
+		}
+		if i >= len(tsegs) {
+			return false
+		}
+		if !gob.Equal(fseg, topicSingleLevelWildcard) && !gob.Equal(fseg, tsegs[i]) {
+			return false
+		}
+	}
+
+	return len(fsegs) == len(tsegs)
+}
+
+// isReservedTopic checks whether a topic is reserved for server use by starting with $.
+func isReservedTopic(topic []byte) bool {
+	return len(topic) > 0 && topic[0] == '$'
+}
+
+// isSysTopic checks whether a topic is in the $SYS tree which clients are not allowed to publish to.
+func isSysTopic(topic []byte) bool {
+	return gob.Equal(topic, sysTopic) || gob.HasPrefix(topic, sysTopicPrefix)
+}
+
 func validTopicName(topicName []byte) bool {
 	return gob.IndexByte(topicName, topicMultiLevelWildcard[0]) == -1 && gob.IndexByte(topicName, topicSingleLevelWildcard[0]) == -1 && len(topicName) > 0
 }
@@ -0,0 +1,153 @@
+package gott
+
+import (
+	"strconv"
+	"testing"
+)
+
+// The benchmarks only go through Broker.Subscribe, Broker.Unsubscribe and topicStorage.match, which the
+// copy-on-write trie and the slice based tree it replaced both have, so the trees can be compared by copying
+// this file to a checkout of the older one and building the tree there with &topicStorage{}, and no
+// RetainedStore, in newBenchBroker.
+
+const benchDevices = 10000
+
+func newBenchBroker() *Broker {
+	GOTT = &Broker{
+		config:             defaultConfig(),
+		TopicFilterStorage: newTopicStorage(),
+		RetainedStore:      newRetainedStore(),
+	}
+	return GOTT
+}
+
+func newBenchClient(id string) *Client {
+	c := &Client{ClientID: id}
+	c.Session = newSession(c, true)
+	return c
+}
+
+// subscribeDevices subscribes a client per device to its own status and commands, and a few monitoring clients
+// to wildcard filters matching every device.
+func subscribeDevices(b *Broker, devices int) {
+	for i := 0; i < devices; i++ {
+		c := newBenchClient("device-" + strconv.Itoa(i))
+		b.Subscribe(c, []byte("devices/"+strconv.Itoa(i)+"/status"), 1)
+		b.Subscribe(c, []byte("devices/"+strconv.Itoa(i)+"/cmd/+"), 1)
+	}
+	monitor := newBenchClient("monitor")
+	b.Subscribe(monitor, []byte("devices/+/status"), 0)
+	b.Subscribe(monitor, []byte("devices/#"), 0)
+	b.Subscribe(newBenchClient("audit"), []byte("#"), 0)
+}
+
+// configFilters returns a filter below the level of each device, which the devices aren't subscribed to.
+func configFilters(devices int) [][]byte {
+	filters := make([][]byte, devices)
+	for i := range filters {
+		filters[i] = []byte("devices/" + strconv.Itoa(i) + "/config")
+	}
+	return filters
+}
+
+// The subscribe and unsubscribe benchmarks cycle through the same filters so the size of the tree doesn't
+// depend on b.N, and undo them with the timer stopped once per cycle.
+
+func BenchmarkTopicTreeSubscribe(b *testing.B) {
+	broker := newBenchBroker()
+	subscribeDevices(broker, benchDevices)
+	c := newBenchClient("bench")
+	filters := configFilters(benchDevices)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i > 0 && i%len(filters) == 0 {
+			b.StopTimer()
+			for _, filter := range filters {
+				broker.Unsubscribe(c, filter)
+			}
+			b.StartTimer()
+		}
+		broker.Subscribe(c, filters[i%len(filters)], 1)
+	}
+}
+
+func BenchmarkTopicTreeUnsubscribe(b *testing.B) {
+	broker := newBenchBroker()
+	subscribeDevices(broker, benchDevices)
+	c := newBenchClient("bench")
+	filters := configFilters(benchDevices)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%len(filters) == 0 {
+			b.StopTimer()
+			for _, filter := range filters {
+				broker.Subscribe(c, filter, 1)
+			}
+			b.StartTimer()
+		}
+		broker.Unsubscribe(c, filters[i%len(filters)])
+	}
+}
+
+func BenchmarkTopicTreeMatch(b *testing.B) {
+	broker := newBenchBroker()
+	subscribeDevices(broker, benchDevices)
+
+	for _, bench := range []struct {
+		name    string
+		topic   string
+		matches int
+	}{
+		{"status", "devices/4242/status", 4},
+		{"command", "devices/4242/cmd/reboot", 3},
+		{"unmatched", "lights/kitchen/state", 1},
+		{"sys", "$SYS/broker/uptime", 0},
+	} {
+		topic := []byte(bench.topic)
+		if n := len(broker.TopicFilterStorage.match(topic)); n != bench.matches {
+			b.Fatalf("%s matched %d levels, want %d", bench.topic, n, bench.matches)
+		}
+
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				broker.TopicFilterStorage.match(topic)
+			}
+		})
+	}
+}
+
+// BenchmarkTopicTreeMatchParallel matches topics from every CPU while a client keeps subscribing and unsubscribing.
+func BenchmarkTopicTreeMatchParallel(b *testing.B) {
+	broker := newBenchBroker()
+	subscribeDevices(broker, benchDevices)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		c := newBenchClient("churn")
+		filter := []byte("devices/churn/status")
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				broker.Subscribe(c, filter, 1)
+				broker.Unsubscribe(c, filter)
+			}
+		}
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		topic := []byte("devices/4242/status")
+		for pb.Next() {
+			broker.TopicFilterStorage.match(topic)
+		}
+	})
+}
@@ -0,0 +1,120 @@
+package gott
+
+import (
+	"testing"
+)
+
+// subscribedFilters returns the paths of the levels indexed for a session and checks each holds its subscription.
+func subscribedFilters(t *testing.T, ts *topicStorage, id string) map[string]bool {
+	t.Helper()
+	filters := map[string]bool{}
+	for _, tl := range ts.subscribed[id] {
+		found := false
+		tl.Subscriptions.Range(func(i int, sub *subscription) bool {
+			found = sub.Session.ID == id
+			return !found
+		})
+		if !found {
+			t.Errorf("level %s is indexed for %s without its subscription", tl.Path(), id)
+		}
+		filters[tl.Path()] = true
+	}
+	return filters
+}
+
+// checkTreeCounts checks the counted levels and subscriptions against a walk of the tree.
+func checkTreeCounts(t *testing.T, ts *topicStorage) {
+	t.Helper()
+	var walked topicTreeStats
+	ts.walk(func(tl *topicLevel) {
+		walked.Levels++
+		walked.Subscriptions += tl.Subscriptions.Len()
+	})
+	if stats := ts.stats(); stats != walked {
+		t.Errorf("counted %+v, walked %+v", stats, walked)
+	}
+}
+
+func TestTopicStorageSessionIndex(t *testing.T) {
+	ts := newTopicStorage()
+	c := newBenchClient("c")
+	c.Session.clean = false
+	other := newBenchClient("other")
+
+	for _, filter := range []string{"a/b", "a/+", "#"} {
+		ts.subscribe(c, []byte(filter), 1)
+	}
+	ts.subscribe(c, []byte("a/b"), 2) // update
+	ts.subscribe(other, []byte("a/b"), 0)
+	checkTreeCounts(t, ts)
+
+	if got := subscribedFilters(t, ts, "c"); len(got) != 3 || !got["a/b"] || !got["a/+"] || !got["#"] {
+		t.Fatalf("indexed %v", got)
+	}
+
+	if !ts.unsubscribe(c, []byte("a/+")) || ts.unsubscribe(c, []byte("a/+")) {
+		t.Fatal("unsubscribe")
+	}
+	if got := subscribedFilters(t, ts, "c"); len(got) != 2 || got["a/+"] {
+		t.Fatalf("indexed %v after unsubscribe", got)
+	}
+	if ts.level([]byte("a/+")) != nil {
+		t.Fatal("a/+ wasn't pruned")
+	}
+	checkTreeCounts(t, ts)
+
+	// a non graceful disconnection of a persistent session keeps its subscriptions for the next client
+	ts.unsubscribeAll(c)
+	if got := subscribedFilters(t, ts, "c"); len(got) != 2 {
+		t.Fatalf("indexed %v after disconnect", got)
+	}
+
+	next := newBenchClient("c")
+	next.Session.clean = false
+	if prev := ts.reattach(next.Session); prev != c.Session {
+		t.Fatalf("reattached from %p, want %p", prev, c.Session)
+	}
+	for _, tl := range ts.subscribed["c"] {
+		tl.Subscriptions.Range(func(i int, sub *subscription) bool {
+			if sub.Session.ID == "c" && sub.Session != next.Session {
+				t.Errorf("%s still points at the previous session", tl.Path())
+			}
+			return true
+		})
+	}
+
+	checkTreeCounts(t, ts)
+
+	next.gracefulDisconnect = true
+	ts.unsubscribeAll(next)
+	if _, ok := ts.subscribed["c"]; ok {
+		t.Fatal("index kept after a graceful disconnection")
+	}
+	if got := subscribedFilters(t, ts, "other"); len(got) != 1 || !got["a/b"] {
+		t.Fatalf("indexed %v for another session", got)
+	}
+
+	ts.deleteSessionSubscriptions("other")
+	if len(ts.subscribed) != 0 || len(ts.queues) != 0 || len(ts.root.loadChildren()) != 0 {
+		t.Fatalf("tree not empty: %v", ts.subscribed)
+	}
+	checkTreeCounts(t, ts)
+}
+
+func TestSubscribeFiltersOutliveThePacket(t *testing.T) {
+	ts := newTopicStorage()
+	c := newBenchClient("c")
+
+	payload := []byte("\x00\x10devices/+/status\x01")
+	filters, err := extractSubTopicFilters(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.subscribe(c, filters[0].Filter, filters[0].QoS)
+
+	// the packet buffer is reused for the next packet
+	copy(payload, "\x00\x10XXXXXXX/Y/ZZZZZZ\x01")
+	if got := subscribedFilters(t, ts, "c"); len(got) != 1 || !got["devices/+/status"] {
+		t.Fatalf("indexed %v", got)
+	}
+}
@@ -0,0 +1,309 @@
+package gott
+
+import (
+	gob "bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// Directions of a traced packet.
+const (
+	TraceInbound  = "in"
+	TraceOutbound = "out"
+)
+
+const (
+	tracePayloadPreviewLen = 256
+	traceBufferSize        = 1024
+)
+
+// Errors returned by StartTrace.
+var (
+	ErrInvalidTopicFilter = errors.New("invalid topic filter")
+	ErrEmptyTrace         = errors.New("a client id or a topic filter is required")
+)
+
+// TracedPacket is a decoded packet sent or received by a traced client.
+type TracedPacket struct {
+	Time        time.Time
+	ClientID    string
+	Direction   string // TraceInbound or TraceOutbound
+	Type        string
+	Flags       byte
+	Size        int      // of the whole packet in bytes
+	PacketID    uint16   `json:",omitempty"`
+	Topic       string   `json:",omitempty"`
+	Filters     []string `json:",omitempty"` // of SUBSCRIBE and UNSUBSCRIBE packets
+	QoS         byte     `json:",omitempty"`
+	Retain      bool     `json:",omitempty"`
+	DUP         bool     `json:",omitempty"`
+	PayloadSize int      `json:",omitempty"`
+	Payload     string   `json:",omitempty"` // the first bytes of the payload, hex encoded if not valid UTF-8
+	PayloadHex  bool     `json:",omitempty"`
+}
+
+// Trace streams the packets of the clients matching a client ID and/or a topic filter.
+// Only packets carrying a topic, PUBLISH, SUBSCRIBE and UNSUBSCRIBE, are matched against the topic filter.
+type Trace struct {
+	clientID string
+	filter   []byte
+	packets  chan TracedPacket
+	dropped  int64
+	stopOnce sync.Once
+}
+
+// Packets returns the channel the traced packets are sent on. It is closed when the trace is stopped.
+func (t *Trace) Packets() <-chan TracedPacket {
+	return t.packets
+}
+
+// Dropped returns the number of packets dropped because the reader did not keep up.
+func (t *Trace) Dropped() int64 {
+	return atomic.LoadInt64(&t.dropped)
+}
+
+func (t *Trace) matches(p *TracedPacket) bool {
+	if t.clientID != "" && t.clientID != p.ClientID {
+		return false
+	}
+	if t.filter == nil {
+		return true
+	}
+	if p.Topic != "" && filterMatches(t.filter, []byte(p.Topic)) {
+		return true
+	}
+	for _, f := range p.Filters {
+		if f == string(t.filter) || filterMatches(t.filter, []byte(f)) {
+			return true
+		}
+	}
+	return false
+}
+
+// traceRegistry holds the active traces. active is checked on the hot path
+// so that nothing is decoded while no trace is running.
+type traceRegistry struct {
+	active int32
+	mutex  sync.RWMutex
+	traces []*Trace
+}
+
+func (tr *traceRegistry) isActive() bool {
+	return atomic.LoadInt32(&tr.active) != 0
+}
+
+// StartTrace starts streaming the packets of the clients matching a client ID and/or a topic filter.
+// StopTrace must be called to end the trace.
+func (b *Broker) StartTrace(clientID, filter string) (*Trace, error) {
+	if clientID == "" && filter == "" {
+		return nil, ErrEmptyTrace
+	}
+
+	t := &Trace{clientID: clientID, packets: make(chan TracedPacket, traceBufferSize)}
+	if filter != "" {
+		if !validFilter([]byte(filter)) {
+			return nil, ErrInvalidTopicFilter
+		}
+		t.filter = []byte(filter)
+	}
+
+	b.traces.mutex.Lock()
+	b.traces.traces = append(b.traces.traces, t)
+	atomic.StoreInt32(&b.traces.active, int32(len(b.traces.traces)))
+	b.traces.mutex.Unlock()
+
+	return t, nil
+}
+
+// StopTrace ends a trace and closes its packets channel.
+func (b *Broker) StopTrace(t *Trace) {
+	t.stopOnce.Do(func() {
+		b.traces.mutex.Lock()
+		for i, tt := range b.traces.traces {
+			if tt == t {
+				b.traces.traces = append(b.traces.traces[:i], b.traces.traces[i+1:]...)
+				break
+			}
+		}
+		atomic.StoreInt32(&b.traces.active, int32(len(b.traces.traces)))
+		// packets are sent under the read lock so none can be sent on the closed channel
+		close(t.packets)
+		b.traces.mutex.Unlock()
+	})
+}
+
+// trace decodes a packet and sends it to the matching traces.
+func (b *Broker) trace(c *Client, direction string, header byte, body []byte, size int) {
+	p := decodeTracedPacket(header, body)
+	p.Time = time.Now()
+	p.ClientID = c.ClientID
+	p.Direction = direction
+	p.Size = size
+
+	if p.ClientID == "" && header>>4 == TypeConnect {
+		p.ClientID = connectClientID(body)
+	}
+
+	b.traces.mutex.RLock()
+	defer b.traces.mutex.RUnlock()
+
+	for _, t := range b.traces.traces {
+		if !t.matches(&p) {
+			continue
+		}
+		select {
+		case t.packets <- p:
+		default:
+			atomic.AddInt64(&t.dropped, 1)
+		}
+	}
+}
+
+// traceOutbound traces a complete packet, made of parts, about to be sent to a client.
+func (b *Broker) traceOutbound(c *Client, parts ...[]byte) {
+	packet := parts[0]
+	if len(parts) > 1 {
+		packet = gob.Join(parts, nil)
+	}
+	if len(packet) < 2 {
+		return
+	}
+
+	i := 1
+	for i < len(packet) && packet[i] >= 128 {
+		i++
+	}
+	if i >= len(packet) {
+		return
+	}
+
+	b.trace(c, TraceOutbound, packet[0], packet[i+1:], len(packet))
+}
+
+// readAhead reads the whole body of the current packet to trace and capture it. The body is then
+// served back by the Client's read methods to the packet handlers in listen.
+// fixedHeader is the first byte of the packet followed by the encoded remaining length.
+func (c *Client) readAhead(fixedHeader []byte, remLen int) error {
+	buf := getBuffer(remLen)
+	body := *buf
+	if remLen > 0 {
+		if _, err := c.readFull(body); err != nil {
+			putBuffer(buf)
+			return err
+		}
+	}
+
+	if GOTT.traces.isActive() {
+		GOTT.trace(c, TraceInbound, fixedHeader[0], body, len(fixedHeader)+remLen)
+	}
+	if c.capture != nil {
+		c.capture.write(CaptureInbound, fixedHeader, body)
+	}
+	if remLen == 0 {
+		putBuffer(buf)
+		return nil
+	}
+	c.pending, c.pendingBuf = body, buf
+	return nil
+}
+
+// readPending copies bytes read ahead by readAhead into p. The buffer goes back to the pool once it's drained.
+func (c *Client) readPending(p []byte) int {
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	if len(c.pending) == 0 {
+		c.pending = nil
+		putBuffer(c.pendingBuf)
+		c.pendingBuf = nil
+	}
+	return n
+}
+
+func decodeTracedPacket(header byte, body []byte) TracedPacket {
+	p := TracedPacket{
+		Type:  packetTypeNames[header>>4],
+		Flags: header & 0x0F,
+	}
+
+	switch header >> 4 {
+	case TypePublish:
+		p.DUP = header&0x08 != 0
+		p.QoS = (header >> 1) & 0x03
+		p.Retain = header&0x01 != 0
+
+		topic, rest, ok := readTracedString(body)
+		if !ok {
+			return p
+		}
+		p.Topic = topic
+
+		if p.QoS > 0 {
+			if len(rest) < 2 {
+				return p
+			}
+			p.PacketID = binary.BigEndian.Uint16(rest)
+			rest = rest[2:]
+		}
+
+		p.PayloadSize = len(rest)
+		if len(rest) > tracePayloadPreviewLen {
+			rest = rest[:tracePayloadPreviewLen]
+		}
+		if utf8.Valid(rest) {
+			p.Payload = string(rest)
+		} else {
+			p.Payload = hex.EncodeToString(rest)
+			p.PayloadHex = true
+		}
+	case TypePubAck, TypePubRec, TypePubRel, TypePubComp, TypeSubAck, TypeUnsubAck:
+		if len(body) >= 2 {
+			p.PacketID = binary.BigEndian.Uint16(body)
+		}
+	case TypeSubscribe, TypeUnsubscribe:
+		if len(body) < 2 {
+			return p
+		}
+		p.PacketID = binary.BigEndian.Uint16(body)
+
+		rest := body[2:]
+		for len(rest) > 0 {
+			filter, r, ok := readTracedString(rest)
+			if !ok {
+				break
+			}
+			p.Filters = append(p.Filters, filter)
+			rest = r
+			if header>>4 == TypeSubscribe && len(rest) > 0 {
+				rest = rest[1:] // requested QoS
+			}
+		}
+	}
+
+	return p
+}
+
+// connectClientID extracts the client ID from the body of a CONNECT packet.
+func connectClientID(body []byte) string {
+	if len(body) < ConnectVarHeaderLen {
+		return ""
+	}
+	id, _, _ := readTracedString(body[ConnectVarHeaderLen:])
+	return id
+}
+
+// readTracedString reads a length prefixed string and returns the remaining bytes.
+func readTracedString(b []byte) (string, []byte, bool) {
+	if len(b) < 2 {
+		return "", b, false
+	}
+	l := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+l {
+		return "", b, false
+	}
+	return string(b[2 : 2+l]), b[2+l:], true
+}
@@ -1,6 +1,7 @@
 package gott
 
 import (
+	"crypto/tls"
 	"gott/utils"
 	"log"
 	"net/http"
@@ -17,7 +18,19 @@ func onRequestHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !GOTT.invokeOnSocketOpen(conn.UnderlyingConn()) {
+	info := ConnInfo{
+		RemoteAddr: conn.RemoteAddr(),
+		LocalAddr:  conn.LocalAddr(),
+		Transport:  TransportWS,
+		Listener:   GOTT.config.WebSockets.Listen,
+	}
+	if r.TLS != nil {
+		info.Transport = TransportWSS
+		info.Listener = GOTT.config.WebSockets.WSS.Listen
+		info.PeerCertificates = r.TLS.PeerCertificates
+	}
+
+	if !GOTT.invokeOnSocketOpen(conn.UnderlyingConn(), info) {
 		_ = conn.Close()
 		return
 	}
@@ -26,7 +39,8 @@ func onRequestHandler(w http.ResponseWriter, r *http.Request) {
 
 	c := &Client{
 		wsConnection: conn,
-		connected:    atomicBool{val: true},
+		connected:    newAtomicBool(true),
+		connInfo:     info,
 	}
 	go c.listen()
 }
@@ -63,7 +77,11 @@ func (wss *webSocketsServer) Listen() {
 	}
 }
 func (wss *webSocketsServer) ListenTLS() {
-	err := http.ListenAndServeTLS(wss.config.WebSockets.WSS.Listen, wss.config.WebSockets.WSS.Cert, wss.config.WebSockets.WSS.Key, nil)
+	server := &http.Server{
+		Addr:      wss.config.WebSockets.WSS.Listen,
+		TLSConfig: &tls.Config{ClientAuth: clientAuthType(wss.config.WebSockets.WSS.ClientAuth)},
+	}
+	err := server.ListenAndServeTLS(wss.config.WebSockets.WSS.Cert, wss.config.WebSockets.WSS.Key)
 	if err != nil {
 		log.Fatal("ListenAndServeTLS WS: ", err)
 	}